@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mindriot101/lambda-local-runner/internal/awsenv"
+)
+
+// AWSOpts configure the AWS credentials and region passed to the functions
+type AWSOpts struct {
+	Profile          string `long:"profile"           description:"AWS profile to read credentials and region from"`
+	Region           string `long:"region"            description:"AWS region of the functions"`
+	DummyCredentials bool   `long:"dummy-credentials" description:"Pass fake credentials, for use with local stand-ins for AWS services"`
+	EndpointURL      string `long:"aws-endpoint-url"  description:"Point the AWS SDKs in the functions at this endpoint"`
+}
+
+// awsEnviron resolves the AWS configuration and returns it as environment
+// variables for the function containers
+func awsEnviron(opts AWSOpts) ([]string, error) {
+	cfg, err := awsenv.Resolve(awsenv.Options{
+		Profile:     opts.Profile,
+		Region:      opts.Region,
+		Dummy:       opts.DummyCredentials,
+		EndpointURL: opts.EndpointURL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("resolving AWS credentials: %w", err)
+	}
+	return cfg.Environ(), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mindriot101/lambda-local-runner/internal/build"
+	"github.com/rs/zerolog/log"
+)
+
+// buildJob updates the build directory of a function from its source
+type buildJob struct {
+	LogicalID string
+	// Source is the CodeUri directory of the function
+	Source string
+	// Target is the build directory the function is run from
+	Target string
+	// Layers are the layers of the function that are built from source
+	Layers []layerJob
+}
+
+// layerJob updates the build directory of a layer from its source
+type layerJob struct {
+	// Source is the ContentUri directory of the layer
+	Source string
+	// Target is the build directory of the layer
+	Target string
+}
+
+// builder updates the build directories of functions whose source changed,
+// either by copying the changed files or by running a build command
+type builder struct {
+	// command builds a function if set, with LLR_FUNCTION, LLR_SOURCE_DIR
+	// and LLR_BUILD_DIR set
+	command string
+	// dir is the working directory of the build command
+	dir string
+	// skip reports whether a path in the source directory is not copied
+	skip func(source, name string) bool
+
+	// builds run one at a time, as build tools rarely cope with running
+	// concurrently in the same project
+	mu sync.Mutex
+}
+
+// Build builds the functions, returning the logical IDs of those that were
+// built successfully
+func (b *builder) Build(ctx context.Context, jobs []buildJob) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	built := []string{}
+	for _, job := range jobs {
+		start := time.Now()
+		logger := log.With().Str("function", job.LogicalID).Logger()
+
+		if b.command != "" {
+			out, err := build.Command{
+				Command: b.command,
+				Dir:     b.dir,
+				Env: []string{
+					"LLR_FUNCTION=" + job.LogicalID,
+					"LLR_SOURCE_DIR=" + job.Source,
+					"LLR_BUILD_DIR=" + job.Target,
+				},
+			}.Run(ctx)
+			if err != nil {
+				logger.Error().Str("event", "build_error").Err(err).Msg("build failed, not restarting the function")
+				continue
+			}
+			logger.Debug().Str("output", string(out)).Msg("build output")
+		} else {
+			copied, err := b.sync(job)
+			if err != nil {
+				logger.Error().Str("event", "build_error").Err(err).Msg("could not copy the changed files, not restarting the function")
+				continue
+			}
+			logger.Debug().Int("files", copied).Msg("copied changed files")
+		}
+
+		logger.Info().Str("event", "build").Dur("duration", time.Since(start)).Msg("built function")
+		built = append(built, job.LogicalID)
+	}
+	return built
+}
+
+// sync copies the changed files of the function and its layers into their
+// build directories
+func (b *builder) sync(job buildJob) (int, error) {
+	copied, err := build.Sync(job.Source, job.Target, func(rel string) bool {
+		return b.skip(job.Source, filepath.Join(job.Source, rel))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, layer := range job.Layers {
+		n, err := build.Sync(layer.Source, layerBuildDir(layer.Target), func(rel string) bool {
+			return b.skip(layer.Source, filepath.Join(layer.Source, rel))
+		})
+		if err != nil {
+			return 0, fmt.Errorf("layer %s: %w", layer.Source, err)
+		}
+		copied += n
+	}
+	return copied, nil
+}
+
+// layerBuildDir returns the directory in the build directory of a layer that
+// its source is copied to. sam build puts the code of python layers in a
+// python directory.
+func layerBuildDir(target string) string {
+	if info, err := os.Stat(filepath.Join(target, "python")); err == nil && info.IsDir() {
+		return filepath.Join(target, "python")
+	}
+	return target
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mindriot101/lambda-local-runner/internal/docker"
+)
+
+func TestBuilderCopiesLayers(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"src/hello", "src/layer", "build/HelloFunction", "build/SharedLayer/python"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+	}
+	writeFile := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	writeFile("src/hello/app.py", "handler")
+	writeFile("src/layer/shared.py", "shared")
+
+	b := &builder{skip: func(source, name string) bool { return false }}
+	built := b.Build(context.Background(), []buildJob{{
+		LogicalID: "HelloFunction",
+		Source:    filepath.Join(root, "src/hello"),
+		Target:    filepath.Join(root, "build/HelloFunction"),
+		Layers: []layerJob{{
+			Source: filepath.Join(root, "src/layer"),
+			Target: filepath.Join(root, "build/SharedLayer"),
+		}},
+	}})
+	if !reflect.DeepEqual(built, []string{"HelloFunction"}) {
+		t.Fatalf("got built functions %v", built)
+	}
+
+	// python layers are built into a python directory
+	contents, err := ioutil.ReadFile(filepath.Join(root, "build/SharedLayer/python/shared.py"))
+	if err != nil || string(contents) != "shared" {
+		t.Fatalf("layer source not copied: %q %v", contents, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "build/HelloFunction/app.py")); err != nil {
+		t.Fatalf("function source not copied: %v", err)
+	}
+}
+
+func TestLayerJobs(t *testing.T) {
+	m := &functionManager{opts: Opts{WatchSource: true}}
+	m.opts.Args.Template = "/project/template.yaml"
+	definition := HandlerDefinition{
+		LogicalID: "HelloFunction",
+		Layers:    []string{"SharedLayer", "RemoteLayer"},
+		LayerURIs: []string{"layers/shared", ""},
+	}
+	sourcePath, layerPaths := codePaths("/project/.aws-sam/build", definition)
+	args := docker.RunContainerArgs{SourcePath: sourcePath, LayerPaths: layerPaths}
+
+	got := m.layerJobs(definition, args)
+	want := []layerJob{{Source: "/project/layers/shared", Target: "/project/.aws-sam/build/SharedLayer"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, expected %v", got, want)
+	}
+
+	m.opts.WatchSource = false
+	if got := m.layerJobs(definition, args); got != nil {
+		t.Fatalf("layers should only be built when watching the source, got %v", got)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/client"
+	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/rs/zerolog/log"
+)
+
+// CleanupOpts are the options for the `cleanup` command
+type CleanupOpts struct{}
+
+// cleanup removes every container and image created by any copy of this
+// program, e.g. after it was killed without a chance to clean up
+func cleanup(ctx context.Context, jsonOutput bool) error {
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return fmt.Errorf("connecting to docker: %w", err)
+	}
+	cli := docker.New(dockerClient)
+
+	containers, images, err := cli.Cleanup(ctx)
+	if err != nil {
+		return fmt.Errorf("cleaning up: %w", err)
+	}
+
+	if jsonOutput {
+		log.Info().Str("event", "cleanup").Int("containers", containers).Int("images", images).Msg("removed containers and images")
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Removed %d containers and %d images\n", containers, images)
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mindriot101/lambda-local-runner/internal/config"
+)
+
+// ConfigOpts are the options for the `config` command
+type ConfigOpts struct {
+	Show ConfigShowOpts `command:"show" description:"Print the effective configuration of the run command"`
+}
+
+// ConfigShowOpts are the options for the `config show` command
+type ConfigShowOpts struct{}
+
+// usesConfig checks whether the command reads the config files
+func usesConfig(command string) bool {
+	for _, name := range config.Commands {
+		if command == name {
+			return true
+		}
+	}
+	return command == "config"
+}
+
+// applyConfig uses the values from the config files as the defaults of the
+// command line options, so that flags and environment variables take
+// precedence over them
+func applyConfig(parser *flags.Parser, cfg *config.Config) error {
+	for _, command := range config.Commands {
+		for _, name := range cfg.Names(command) {
+			option := parser.Find(command).FindOptionByLongName(name)
+			if option == nil {
+				// the template of run is a positional argument
+				if command == config.CommandRun && name == "template" {
+					continue
+				}
+				source, _ := cfg.Source(command, name)
+				return fmt.Errorf("unknown option %s for %s in %s", name, command, source)
+			}
+			option.Default = cfg.Options[command][name]
+		}
+	}
+	return nil
+}
+
+// templateFile returns the template given on the command line, in the
+// LLR_TEMPLATE environment variable or in the config files, in that order
+func templateFile(arg string, cfg *config.Config) string {
+	if arg != "" {
+		return arg
+	}
+	if env := os.Getenv("LLR_TEMPLATE"); env != "" {
+		return env
+	}
+	return cfg.Get(config.CommandRun, "template")
+}
+
+// showConfig prints the effective options of the run command as a config
+// file, with where each value came from
+func showConfig(w io.Writer, parser *flags.Parser, cfg *config.Config, template string) {
+	fmt.Fprintf(w, "template = %s # %s\n", strconv.Quote(template), templateSource(cfg))
+
+	for _, option := range commandOptions(parser.Find("run").Group) {
+		// skip options without a value, e.g. --help
+		if option.LongName == "" || option.Field().Type.Kind() == reflect.Func {
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s # %s\n", option.LongName, formatValue(option.Value()), optionSource(option, cfg))
+	}
+
+	logicalIDs := make([]string, 0, len(cfg.Functions))
+	for logicalID := range cfg.Functions {
+		logicalIDs = append(logicalIDs, logicalID)
+	}
+	sort.Strings(logicalIDs)
+	for _, logicalID := range logicalIDs {
+		f := cfg.Functions[logicalID]
+		fmt.Fprintf(w, "\n[functions.%s]\n", logicalID)
+		if f.MaxConcurrency != 0 {
+			fmt.Fprintf(w, "max-concurrency = %d\n", f.MaxConcurrency)
+		}
+		if f.DependenciesDir != "" {
+			fmt.Fprintf(w, "deps-dir = %s\n", strconv.Quote(f.DependenciesDir))
+		}
+		if len(f.Environment) > 0 {
+			env := make([]string, 0, len(f.Environment))
+			for name, value := range f.Environment {
+				env = append(env, fmt.Sprintf("%s = %s", name, strconv.Quote(value)))
+			}
+			sort.Strings(env)
+			fmt.Fprintf(w, "environment = { %s }\n", strings.Join(env, ", "))
+		}
+	}
+}
+
+// commandOptions returns the options of a group and all of its subgroups
+func commandOptions(group *flags.Group) []*flags.Option {
+	options := group.Options()
+	for _, g := range group.Groups() {
+		options = append(options, commandOptions(g)...)
+	}
+	return options
+}
+
+func templateSource(cfg *config.Config) string {
+	if os.Getenv("LLR_TEMPLATE") != "" {
+		return "env LLR_TEMPLATE"
+	}
+	if source, ok := cfg.Source(config.CommandRun, "template"); ok {
+		return source
+	}
+	return "unset"
+}
+
+func optionSource(option *flags.Option, cfg *config.Config) string {
+	// options given defaults are marked as set too
+	if option.IsSet() && !option.IsSetDefault() {
+		return "flag"
+	}
+	if key := option.EnvKeyWithNamespace(); key != "" {
+		if _, ok := os.LookupEnv(key); ok {
+			return "env " + key
+		}
+	}
+	if source, ok := cfg.Source(config.CommandRun, option.LongName); ok {
+		return source
+	}
+	return "default"
+}
+
+// formatValue formats an option value as a TOML value
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case time.Duration:
+		return strconv.Quote(v.String())
+	case []string:
+		quoted := make([]string, 0, len(v))
+		for _, s := range v {
+			quoted = append(quoted, strconv.Quote(s))
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+
+	if rv := reflect.ValueOf(value); rv.Kind() == reflect.String {
+		return strconv.Quote(rv.String())
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/mindriot101/lambda-local-runner/internal/config"
+)
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	t.Setenv("LLR_HOST", "127.0.0.2")
+	cfg := config.New()
+	cfg.Options[config.CommandRun] = map[string][]string{
+		"root":     {"build"},
+		"port":     {"3001"},
+		"host":     {"0.0.0.0"},
+		"template": {"template.yaml"},
+	}
+	cfg.Options[config.CommandInvoke] = map[string][]string{
+		"template": {"template.yaml"},
+	}
+
+	var opts Options
+	parser := flags.NewParser(&opts, flags.None)
+	if err := applyConfig(parser, cfg); err != nil {
+		t.Fatalf("applying config: %v", err)
+	}
+	if _, err := parser.ParseArgs([]string{"run", "--port", "4000"}); err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+
+	if opts.Run.RootDir != "build" {
+		t.Fatalf("root %q not read from the config", opts.Run.RootDir)
+	}
+	if opts.Run.Host != "127.0.0.2" {
+		t.Fatalf("host %q not read from the environment", opts.Run.Host)
+	}
+	if opts.Run.Port != 4000 {
+		t.Fatalf("port %d not read from the flag", opts.Run.Port)
+	}
+	if opts.Invoke.Port != 0 {
+		t.Fatalf("invoke port %d should not be read from the port of run", opts.Invoke.Port)
+	}
+	if opts.Invoke.Template != "template.yaml" {
+		t.Fatalf("invoke template %q not read from the config", opts.Invoke.Template)
+	}
+	if got := templateFile(opts.Run.Args.Template, cfg); got != "template.yaml" {
+		t.Fatalf("run template %q not read from the config", got)
+	}
+}
+
+func TestApplyConfigUnknownOption(t *testing.T) {
+	cfg := config.New()
+	cfg.Options[config.CommandInvoke]["no-such-option"] = []string{"1"}
+	cfg.Sources[config.CommandInvoke]["no-such-option"] = "llr.toml"
+
+	var opts Options
+	if err := applyConfig(flags.NewParser(&opts, flags.None), cfg); err == nil {
+		t.Fatalf("expected an error for an unknown option")
+	}
+}
+
+func TestFunctionEnv(t *testing.T) {
+	definition := HandlerDefinition{
+		LogicalID:   "Function",
+		Environment: map[string]string{"A": "template", "B": "template", "C": "template", "AWS_REGION": "template"},
+	}
+	fn := config.Function{Environment: map[string]string{"B": "config", "C": "config"}}
+	vars := envVars{
+		"Parameters": {"C": "parameters"},
+		"Function":   {"D": float64(1)},
+		"Other":      {"A": "other"},
+	}
+
+	got := functionEnv(definition, fn, vars, []string{"AWS_REGION=eu-west-1"})
+	want := []string{"A=template", "AWS_REGION=eu-west-1", "B=config", "C=parameters", "D=1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, expected %v", got, want)
+	}
+}
@@ -6,16 +6,12 @@ import (
 )
 
 func TestContainerName(t *testing.T) {
-	endpoint := Endpoint{
-		Method:  "get",
-		URLPath: "/hello/a/b",
-	}
 	definition := HandlerDefinition{
 		LogicalID: "HelloWorldFunction",
 	}
 
-	got := containerName(endpoint, definition)
-	prefix := "llr-HelloWorldFunction-get_hello_a_b-"
+	got := containerName(definition)
+	prefix := "llr-HelloWorldFunction-"
 
 	if !strings.HasPrefix(got, prefix) {
 		t.Fatalf("invalid container name, %s does not begin with %s", got, prefix)
@@ -29,10 +25,6 @@ func TestContainerName(t *testing.T) {
 func TestUniqueContainerName(t *testing.T) {
 	m := make(map[string]bool)
 
-	endpoint := Endpoint{
-		Method:  "get",
-		URLPath: "/hello/a/b",
-	}
 	definition := HandlerDefinition{
 		LogicalID: "HelloWorldFunction",
 	}
@@ -40,7 +32,7 @@ func TestUniqueContainerName(t *testing.T) {
 	n := 1024
 
 	for i := 0; i < n; i++ {
-		name := containerName(endpoint, definition)
+		name := containerName(definition)
 		m[name] = true
 	}
 
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpointMappingFunctions(t *testing.T) {
+	hello := HandlerDefinition{LogicalID: "HelloFunction"}
+	other := HandlerDefinition{LogicalID: "OtherFunction"}
+	mapping := EndpointMapping{
+		Endpoint{URLPath: "/hello", Method: "get"}:  hello,
+		Endpoint{URLPath: "/hello", Method: "post"}: hello,
+		Endpoint{URLPath: "/other", Method: "get"}:  other,
+	}
+
+	functions := mapping.Functions()
+	if len(functions) != 2 {
+		t.Fatalf("expected 2 functions, found %d", len(functions))
+	}
+
+	if functions[0].LogicalID != "HelloFunction" || functions[1].LogicalID != "OtherFunction" {
+		t.Fatalf("invalid functions %v", functions)
+	}
+
+	endpoints := mapping.Endpoints("HelloFunction")
+	if len(endpoints) != 2 {
+		t.Fatalf("expected 2 endpoints, found %d", len(endpoints))
+	}
+
+	if endpoints[0].Method != "get" || endpoints[1].Method != "post" {
+		t.Fatalf("invalid endpoints %v", endpoints)
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	mapping, err := parseTemplate("testdata/integration/template.yaml", nil)
+	if err != nil {
+		t.Fatalf("parsing template: %v", err)
+	}
+
+	functions := mapping.Functions()
+	if len(functions) != 1 {
+		t.Fatalf("expected 1 function, found %d", len(functions))
+	}
+
+	def := functions[0]
+	if def.LogicalID != "HelloWorldFunction" || def.Runtime != "python3.9" || def.Architecture != "x86_64" || def.Handler != "app.lambda_handler" {
+		t.Fatalf("invalid function definition %+v", def)
+	}
+
+	if len(mapping.Endpoints("HelloWorldFunction")) != 2 {
+		t.Fatalf("expected both endpoints to be handled by the function")
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	reserved := func(n int) *int { return &n }
+
+	if got := maxConcurrency(4, nil); got != 4 {
+		t.Fatalf("unset reserved concurrency should not limit, got %d", got)
+	}
+
+	if got := maxConcurrency(4, reserved(2)); got != 2 {
+		t.Fatalf("reserved concurrency should limit, got %d", got)
+	}
+
+	if got := maxConcurrency(4, reserved(10)); got != 4 {
+		t.Fatalf("reserved concurrency should not raise the limit, got %d", got)
+	}
+
+	if !throttled(HandlerDefinition{ReservedConcurrency: reserved(0)}) {
+		t.Fatalf("a reserved concurrency of 0 should throttle the function")
+	}
+	if throttled(HandlerDefinition{}) {
+		t.Fatalf("unset reserved concurrency should not throttle the function")
+	}
+}
+
+func TestParseFunctionLayers(t *testing.T) {
+	def, err := parseFunction("testdata/layers/template.yaml", "HelloWorldFunction", nil)
+	if err != nil {
+		t.Fatalf("parsing template: %v", err)
+	}
+
+	if len(def.Layers) != 1 || def.Layers[0] != "SharedLayer" {
+		t.Fatalf("expected only the layer from the template, found %v", def.Layers)
+	}
+	if len(def.LayerURIs) != 1 || def.LayerURIs[0] != "shared/" {
+		t.Fatalf("invalid layer uris %v", def.LayerURIs)
+	}
+	if def.CodeURI != "hello_world/" {
+		t.Fatalf("invalid code uri %q", def.CodeURI)
+	}
+}
+
+func TestParseFunctionGlobals(t *testing.T) {
+	def, err := parseFunction("testdata/integration/template.yaml", "HelloWorldFunction", nil)
+	if err != nil {
+		t.Fatalf("parsing template: %v", err)
+	}
+
+	if def.Timeout != 3*time.Second {
+		t.Fatalf("timeout %s not read from the globals", def.Timeout)
+	}
+	if def.MemorySize != 0 {
+		t.Fatalf("memory size %d should be unset", def.MemorySize)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	start, end, err := parsePortRange("9001-9100")
+	if err != nil {
+		t.Fatalf("parsing port range: %v", err)
+	}
+	if start != 9001 || end != 9100 {
+		t.Fatalf("invalid range %d-%d", start, end)
+	}
+
+	for _, invalid := range []string{"9001", "a-b", "9100-9001", "0-10", "9001-70000"} {
+		if _, _, err := parsePortRange(invalid); err == nil {
+			t.Fatalf("range %q should be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/mindriot101/lambda-local-runner/internal/config"
+)
+
+// envVars is the format of SAM's --env-vars files: the environment variables
+// of each function by logical ID, and variables for every function under
+// "Parameters"
+type envVars map[string]map[string]interface{}
+
+// readEnvVars reads an env vars file, returning nil if no file is given
+func readEnvVars(filename string) (envVars, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading env vars file: %w", err)
+	}
+	var out envVars
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("parsing env vars file %s: %w", filename, err)
+	}
+	return out, nil
+}
+
+// parseParameterOverrides parses template parameter overrides in the form
+// <name>=<value>
+func parseParameterOverrides(overrides []string) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(overrides))
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid parameter override %q, expected <name>=<value>", override)
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out, nil
+}
+
+// functionEnv returns the environment variables of a function. Variables
+// from the template are overridden by the config file, then the env vars
+// file and finally the AWS configuration.
+func functionEnv(definition HandlerDefinition, fn config.Function, vars envVars, aws []string) []string {
+	env := make(map[string]string)
+	for name, value := range definition.Environment {
+		env[name] = value
+	}
+	for name, value := range fn.Environment {
+		env[name] = value
+	}
+	for _, section := range []string{"Parameters", definition.LogicalID} {
+		for name, value := range vars[section] {
+			env[name] = fmt.Sprint(value)
+		}
+	}
+	for _, kv := range aws {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+
+	out := make([]string, 0, len(env))
+	for name, value := range env {
+		out = append(out, name+"="+value)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/mindriot101/lambda-local-runner/internal/lambdahost"
+	"github.com/mindriot101/lambda-local-runner/internal/process"
+	"github.com/mindriot101/lambda-local-runner/internal/server"
+	"github.com/rs/zerolog/log"
+)
+
+// runningFunction is a function served from the template
+type runningFunction struct {
+	host *lambdahost.LambdaHost
+	// args, maxConcurrency and throttled are the settings the host was last
+	// started or reconfigured with
+	args           docker.RunContainerArgs
+	maxConcurrency int
+	throttled      bool
+	// source is the directory with the source of the function that is
+	// watched, if it is built on changes
+	source string
+	// layers are the layers of the function built from their source along
+	// with it
+	layers []layerJob
+	// stopped receives once the host has shut down
+	stopped chan struct{}
+}
+
+// templateDiff lists the functions affected by a change to the template
+type templateDiff struct {
+	Added        []string
+	Removed      []string
+	Reconfigured []string
+}
+
+// containerRunner runs the containers of functions, either in docker or as
+// local processes
+type containerRunner interface {
+	RunContainer(ctx context.Context, args docker.RunContainerArgs) (docker.RunningContainer, error)
+	RemoveContainer(ctx context.Context, containerID string) error
+	StreamLogs(ctx context.Context, containerID string, stdout, stderr io.Writer) error
+	WaitContainer(ctx context.Context, containerID string) (docker.ExitStatus, error)
+	Logs(ctx context.Context, containerID string, stdout, stderr io.Writer) error
+}
+
+// functionManager runs a host per function in the template, and reconciles
+// the running functions with new versions of the template
+type functionManager struct {
+	opts Opts
+	// cli is nil when the functions run as processes
+	cli        *docker.Client
+	runner     containerRunner
+	ports      *lambdahost.Ports
+	logOutputs *logOutputs
+	watcher    *codeWatcher
+	vars       envVars
+	awsEnv     []string
+	// ctx is used for the containers, which are cleaned up regardless of
+	// what happens to the caller's context
+	ctx context.Context
+
+	mapping   EndpointMapping
+	functions map[string]*runningFunction
+}
+
+// containerArgs returns the arguments to start the containers of a function
+// with, building its image if necessary
+func (m *functionManager) containerArgs(definition HandlerDefinition) (docker.RunContainerArgs, error) {
+	var imageName string
+	if m.cli != nil {
+		var err error
+		imageName, err = m.cli.BuildImage(m.ctx, definition.Runtime, definition.Architecture)
+		if err != nil {
+			return docker.RunContainerArgs{}, fmt.Errorf("building docker image: %w", err)
+		}
+	} else if !process.Supported(definition.Runtime) {
+		return docker.RunContainerArgs{}, fmt.Errorf("function %s uses the %s runtime, which cannot run without docker", definition.LogicalID, definition.Runtime)
+	}
+
+	sourcePath, layerPaths, err := functionPaths(m.opts.RootDir, m.opts.Args.Template, m.opts.FromSource, definition)
+	if err != nil {
+		return docker.RunContainerArgs{}, err
+	}
+	fn := m.opts.Functions[definition.LogicalID]
+	var dependenciesPath string
+	if m.opts.FromSource {
+		dependenciesPath = functionDependencies(m.opts.DepsDir, fn)
+	}
+
+	// FIXME: this leaks implementation details about the docker layer to
+	// the lambda host
+	args := docker.RunContainerArgs{
+		ContainerName: containerName(definition),
+		ImageName:     imageName,
+		FunctionName:  definition.LogicalID,
+		Architecture:  definition.Architecture,
+		Handler:       definition.Handler,
+		SourcePath:    sourcePath,
+		LayerPaths:    layerPaths,
+		Network:       m.opts.DockerNetwork,
+		Runtime:       definition.Runtime,
+		Env:           functionEnv(definition, fn, m.vars, m.awsEnv),
+
+		DependenciesPath: dependenciesPath,
+		Timeout:          definition.Timeout,
+		MemorySize:       definition.MemorySize,
+	}
+	if definition.LogicalID == m.opts.DebugFunction {
+		args.Debug = &docker.DebugConfig{
+			Port:         m.opts.DebugPort,
+			Wait:         m.opts.DebugWait,
+			DebuggerPath: m.opts.DebuggerPath,
+		}
+	}
+	return args, nil
+}
+
+// start runs a host for the function. wg is marked done once its first
+// container is ready.
+func (m *functionManager) start(definition HandlerDefinition, wg *sync.WaitGroup) error {
+	args, err := m.containerArgs(definition)
+	if err != nil {
+		return err
+	}
+
+	logs, err := m.logOutputs.For(definition.LogicalID)
+	if err != nil {
+		return fmt.Errorf("creating log output: %w", err)
+	}
+
+	limit := maxConcurrency(functionMaxConcurrency(m.opts, definition.LogicalID), definition.ReservedConcurrency)
+	host := lambdahost.New(m.runner, args, lambdahost.Config{
+		Name:           definition.LogicalID,
+		Logs:           logs,
+		MaxConcurrency: limit,
+		Throttled:      throttled(definition),
+		IdleTimeout:    m.opts.IdleTimeout,
+		Ports:          m.ports,
+		Lazy:           m.opts.Lazy,
+		ScaleToZero:    m.opts.ScaleToZero,
+
+		CrashLoopThreshold: m.opts.CrashLoopThreshold,
+	})
+
+	f := &runningFunction{
+		host:           host,
+		args:           args,
+		maxConcurrency: limit,
+		throttled:      throttled(definition),
+		source:         m.sourceDir(definition),
+		layers:         m.layerJobs(definition, args),
+		stopped:        make(chan struct{}, 1),
+	}
+	wg.Add(1)
+	go func() {
+		// the host only returns an error if its first container could not
+		// be started, before marking wg done. Its invocations then fail
+		// straight away, and instructions sent to it are dropped.
+		if err := host.Run(m.ctx, f.stopped, wg); err != nil {
+			log.Error().Err(err).Str("function", definition.LogicalID).Msg("could not start function")
+			f.stopped <- struct{}{}
+		}
+	}()
+	m.functions[definition.LogicalID] = f
+
+	m.watch(definition.LogicalID, f)
+	return nil
+}
+
+// watch restarts the function when its code or layers change
+func (m *functionManager) watch(logicalID string, f *runningFunction) {
+	// changes to a shared layer restart every function using it
+	watchPaths := append([]string{f.args.SourcePath}, f.args.LayerPaths...)
+	if f.source != "" {
+		// the build directories are updated by the build, so the sources
+		// of the function and its layers are watched instead
+		watchPaths = []string{f.source}
+		for _, layer := range f.layers {
+			watchPaths = append(watchPaths, layer.Source)
+		}
+	}
+
+	for _, watchPath := range watchPaths {
+		if err := m.watcher.Add(watchPath, logicalID); err != nil {
+			log.Warn().Err(err).Str("path", watchPath).Msg("could not watch directory")
+		}
+	}
+}
+
+// Stop shuts the hosts of the functions down, removing their containers
+func (m *functionManager) Stop(logicalIDs []string) {
+	for _, logicalID := range logicalIDs {
+		f, ok := m.functions[logicalID]
+		if !ok {
+			continue
+		}
+
+		f.host.Shutdown()
+		<-f.stopped
+		m.watcher.Remove(logicalID)
+		delete(m.functions, logicalID)
+	}
+}
+
+// reconfigure restarts the function if its settings changed, returning
+// whether it did
+func (m *functionManager) reconfigure(definition HandlerDefinition) (bool, error) {
+	f := m.functions[definition.LogicalID]
+	args, err := m.containerArgs(definition)
+	if err != nil {
+		return false, err
+	}
+	limit := maxConcurrency(functionMaxConcurrency(m.opts, definition.LogicalID), definition.ReservedConcurrency)
+
+	// container names are random, so they are not compared
+	args.ContainerName = f.args.ContainerName
+	source := m.sourceDir(definition)
+	layers := m.layerJobs(definition, args)
+	if reflect.DeepEqual(args, f.args) && limit == f.maxConcurrency && throttled(definition) == f.throttled && source == f.source && reflect.DeepEqual(layers, f.layers) {
+		return false, nil
+	}
+
+	f.host.Reconfigure(args, limit, throttled(definition))
+	f.args = args
+	f.maxConcurrency = limit
+	f.throttled = throttled(definition)
+	f.source = source
+	f.layers = layers
+
+	// the function may use different layers
+	m.watcher.Remove(definition.LogicalID)
+	m.watch(definition.LogicalID, f)
+	return true, nil
+}
+
+// building checks whether functions are built when their source changes
+func (m *functionManager) building() bool {
+	return m.opts.WatchSource || m.opts.BuildCommand != ""
+}
+
+// sourceDir returns the absolute path of the CodeUri of the function if it
+// is built on changes, or an empty string
+func (m *functionManager) sourceDir(definition HandlerDefinition) string {
+	if !m.building() || definition.CodeURI == "" {
+		return ""
+	}
+
+	dir, err := filepath.Abs(filepath.Join(filepath.Dir(m.opts.Args.Template), definition.CodeURI))
+	if err != nil {
+		log.Warn().Err(err).Str("function", definition.LogicalID).Msg("could not find the function source")
+		return ""
+	}
+	return dir
+}
+
+// layerJobs returns the source and build directories of the layers of the
+// function that have a local ContentUri, if it is built on changes
+func (m *functionManager) layerJobs(definition HandlerDefinition, args docker.RunContainerArgs) []layerJob {
+	if !m.building() {
+		return nil
+	}
+
+	var jobs []layerJob
+	for i, uri := range definition.LayerURIs {
+		if uri == "" || i >= len(args.LayerPaths) {
+			continue
+		}
+		dir, err := filepath.Abs(filepath.Join(filepath.Dir(m.opts.Args.Template), uri))
+		if err != nil {
+			log.Warn().Err(err).Str("layer", definition.Layers[i]).Msg("could not find the layer source")
+			continue
+		}
+		jobs = append(jobs, layerJob{Source: dir, Target: args.LayerPaths[i]})
+	}
+	return jobs
+}
+
+// BuildJobs splits the functions whose code changed into those that have to
+// be built before they are restarted, and those that can be restarted
+// straight away
+func (m *functionManager) BuildJobs(logicalIDs []string) ([]buildJob, []string) {
+	var (
+		jobs    []buildJob
+		restart []string
+	)
+	for _, logicalID := range logicalIDs {
+		f, ok := m.functions[logicalID]
+		if !ok {
+			continue
+		}
+
+		if f.source == "" {
+			restart = append(restart, logicalID)
+			continue
+		}
+		jobs = append(jobs, buildJob{
+			LogicalID: logicalID,
+			Source:    f.source,
+			Target:    f.args.SourcePath,
+			Layers:    f.layers,
+		})
+	}
+	return jobs, restart
+}
+
+// runnable checks whether the function can be run, warning if it is
+// skipped: without docker, only functions whose runtime can run as a process
+// are run
+func (m *functionManager) runnable(definition HandlerDefinition) bool {
+	if m.cli != nil || process.Supported(definition.Runtime) {
+		return true
+	}
+	log.Warn().
+		Str("function", definition.LogicalID).
+		Str("runtime", definition.Runtime).
+		Msg("skipping function, its runtime cannot run without docker")
+	return false
+}
+
+// Start runs the functions handling the endpoints. wg is marked done once
+// their first containers are ready.
+func (m *functionManager) Start(mapping EndpointMapping, wg *sync.WaitGroup) error {
+	for _, definition := range mapping.Functions() {
+		if !m.runnable(definition) {
+			continue
+		}
+		if err := m.start(definition, wg); err != nil {
+			return err
+		}
+	}
+	m.mapping = mapping
+	return nil
+}
+
+// Apply reconciles the running functions with a new version of the template.
+// New functions are started in the background, and wg is marked done once
+// their first containers are ready. Removed functions keep running until they
+// are stopped with Stop, so that they can serve requests until the routes
+// have been switched.
+func (m *functionManager) Apply(mapping EndpointMapping, wg *sync.WaitGroup) (templateDiff, error) {
+	var diff templateDiff
+
+	// functions that can no longer run are removed
+	definitions := make(map[string]HandlerDefinition)
+	for _, definition := range mapping.Functions() {
+		if m.runnable(definition) {
+			definitions[definition.LogicalID] = definition
+		}
+	}
+
+	for logicalID := range m.functions {
+		if _, ok := definitions[logicalID]; !ok {
+			diff.Removed = append(diff.Removed, logicalID)
+		}
+	}
+
+	for _, definition := range mapping.Functions() {
+		if _, ok := definitions[definition.LogicalID]; !ok {
+			continue
+		}
+		if _, ok := m.functions[definition.LogicalID]; !ok {
+			if err := m.start(definition, wg); err != nil {
+				return diff, fmt.Errorf("starting function %s: %w", definition.LogicalID, err)
+			}
+			diff.Added = append(diff.Added, definition.LogicalID)
+			continue
+		}
+
+		changed, err := m.reconfigure(definition)
+		if err != nil {
+			return diff, fmt.Errorf("reconfiguring function %s: %w", definition.LogicalID, err)
+		}
+		if changed {
+			diff.Reconfigured = append(diff.Reconfigured, definition.LogicalID)
+		}
+	}
+	m.mapping = mapping
+
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
+
+// Routes returns the routes of the endpoints in the template, sorted by
+// function
+func (m *functionManager) Routes() []server.Route {
+	routes := []server.Route{}
+	for _, definition := range m.mapping.Functions() {
+		f, ok := m.functions[definition.LogicalID]
+		if !ok {
+			continue
+		}
+
+		// every route handled by this function shares the same host
+		for _, endpoint := range m.mapping.Endpoints(definition.LogicalID) {
+			routes = append(routes, server.Route{
+				Method:   string(endpoint.Method),
+				Path:     endpoint.URLPath,
+				Function: definition.LogicalID,
+				Invoker:  f.host,
+			})
+		}
+	}
+	return routes
+}
+
+// Restart restarts the functions with the given logical IDs
+func (m *functionManager) Restart(logicalIDs []string) {
+	for _, logicalID := range logicalIDs {
+		if f, ok := m.functions[logicalID]; ok {
+			f.host.Restart()
+		}
+	}
+}
+
+// Shutdown stops every function, waiting for their containers to be removed
+func (m *functionManager) Shutdown() {
+	for _, f := range m.functions {
+		f.host.Shutdown()
+	}
+	for logicalID, f := range m.functions {
+		<-f.stopped
+		delete(m.functions, logicalID)
+	}
+}
+
+// RemoveContainers removes the containers of every function that is still
+// running, e.g. if starting the functions failed
+func (m *functionManager) RemoveContainers() {
+	for _, f := range m.functions {
+		if err := f.host.RemoveContainer(m.ctx); err != nil {
+			log.Warn().Err(err).Msg("could not remove the lambda containers")
+		}
+	}
+}
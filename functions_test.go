@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/mindriot101/lambda-local-runner/internal/server"
+)
+
+func TestRunnable(t *testing.T) {
+	processes := &functionManager{}
+	if !processes.runnable(HandlerDefinition{LogicalID: "GoFunction", Runtime: "provided.al2"}) {
+		t.Fatalf("provided functions should run without docker")
+	}
+	if processes.runnable(HandlerDefinition{LogicalID: "PythonFunction", Runtime: "python3.9"}) {
+		t.Fatalf("python functions should be skipped without docker")
+	}
+
+	containers := &functionManager{cli: &docker.Client{}}
+	if !containers.runnable(HandlerDefinition{LogicalID: "PythonFunction", Runtime: "python3.9"}) {
+		t.Fatalf("every function should run with docker")
+	}
+}
+
+// fakeRunner records the containers started and removed, which run until
+// they are removed
+type fakeRunner struct {
+	mu      sync.Mutex
+	started []docker.RunContainerArgs
+	removed []string
+	// onRemove is called before a container is removed, if set
+	onRemove func(containerID string)
+}
+
+func (f *fakeRunner) RunContainer(ctx context.Context, args docker.RunContainerArgs) (docker.RunningContainer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.started = append(f.started, args)
+	return docker.RunningContainer{
+		ID:   args.FunctionName + "-" + strconv.Itoa(len(f.started)),
+		Addr: "127.0.0.1:1",
+	}, nil
+}
+
+func (f *fakeRunner) RemoveContainer(ctx context.Context, containerID string) error {
+	if f.onRemove != nil {
+		f.onRemove(containerID)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, containerID)
+	return nil
+}
+
+func (f *fakeRunner) StreamLogs(ctx context.Context, containerID string, stdout, stderr io.Writer) error {
+	return nil
+}
+
+func (f *fakeRunner) WaitContainer(ctx context.Context, containerID string) (docker.ExitStatus, error) {
+	<-ctx.Done()
+	return docker.ExitStatus{}, ctx.Err()
+}
+
+func (f *fakeRunner) Logs(ctx context.Context, containerID string, stdout, stderr io.Writer) error {
+	return nil
+}
+
+// startedArgs returns the arguments of the containers started for the
+// function
+func (f *fakeRunner) startedArgs(logicalID string) []docker.RunContainerArgs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []docker.RunContainerArgs
+	for _, args := range f.started {
+		if args.FunctionName == logicalID {
+			out = append(out, args)
+		}
+	}
+	return out
+}
+
+func newTestFunctionManager(t *testing.T, runner containerRunner) *functionManager {
+	t.Helper()
+
+	watcher, err := newCodeWatcher(watchConfig{})
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	t.Cleanup(func() { watcher.Close() })
+
+	opts := Opts{RootDir: t.TempDir(), MaxConcurrency: 1}
+	for _, logicalID := range []string{"HelloFunction", "OtherFunction"} {
+		if err := os.Mkdir(filepath.Join(opts.RootDir, logicalID), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+	}
+	return &functionManager{
+		opts:       opts,
+		runner:     runner,
+		logOutputs: newLogOutputs("", false, false),
+		watcher:    watcher,
+		ctx:        context.Background(),
+		functions:  make(map[string]*runningFunction),
+	}
+}
+
+func TestApply(t *testing.T) {
+	hello := HandlerDefinition{
+		LogicalID:   "HelloFunction",
+		Runtime:     "provided.al2",
+		Handler:     "bootstrap",
+		Environment: map[string]string{"GREETING": "hello"},
+		Timeout:     3 * time.Second,
+		MemorySize:  128,
+	}
+	other := HandlerDefinition{
+		LogicalID: "OtherFunction",
+		Runtime:   "provided.al2",
+		Handler:   "bootstrap",
+	}
+	mapping := func(definitions ...HandlerDefinition) EndpointMapping {
+		m := EndpointMapping{}
+		for _, definition := range definitions {
+			m[Endpoint{URLPath: "/" + definition.LogicalID, Method: MethodGET}] = definition
+		}
+		return m
+	}
+	changed := func(change func(*HandlerDefinition)) HandlerDefinition {
+		definition := hello
+		definition.Environment = map[string]string{"GREETING": "hello"}
+		change(&definition)
+		return definition
+	}
+
+	tests := []struct {
+		name     string
+		mapping  EndpointMapping
+		expected templateDiff
+		// restarted is whether HelloFunction gets a new container
+		restarted bool
+	}{
+		{
+			name:    "unchanged",
+			mapping: mapping(hello),
+		},
+		{
+			name:     "function added",
+			mapping:  mapping(hello, other),
+			expected: templateDiff{Added: []string{"OtherFunction"}},
+		},
+		{
+			name:     "function removed",
+			mapping:  mapping(other),
+			expected: templateDiff{Added: []string{"OtherFunction"}, Removed: []string{"HelloFunction"}},
+		},
+		{
+			name:      "environment changed",
+			mapping:   mapping(changed(func(d *HandlerDefinition) { d.Environment["GREETING"] = "hi" })),
+			expected:  templateDiff{Reconfigured: []string{"HelloFunction"}},
+			restarted: true,
+		},
+		{
+			name:      "timeout changed",
+			mapping:   mapping(changed(func(d *HandlerDefinition) { d.Timeout = 10 * time.Second })),
+			expected:  templateDiff{Reconfigured: []string{"HelloFunction"}},
+			restarted: true,
+		},
+		{
+			name:      "memory size changed",
+			mapping:   mapping(changed(func(d *HandlerDefinition) { d.MemorySize = 512 })),
+			expected:  templateDiff{Reconfigured: []string{"HelloFunction"}},
+			restarted: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			m := newTestFunctionManager(t, runner)
+			defer m.Shutdown()
+
+			var wg sync.WaitGroup
+			if err := m.Start(mapping(hello), &wg); err != nil {
+				t.Fatalf("starting functions: %v", err)
+			}
+			wg.Wait()
+
+			diff, err := m.Apply(test.mapping, &wg)
+			if err != nil {
+				t.Fatalf("applying template: %v", err)
+			}
+			wg.Wait()
+			if !reflect.DeepEqual(diff, test.expected) {
+				t.Fatalf("invalid diff, expected %+v found %+v", test.expected, diff)
+			}
+
+			if !test.restarted {
+				if n := len(runner.startedArgs("HelloFunction")); n != 1 {
+					t.Fatalf("function should not be restarted, found %d containers", n)
+				}
+				return
+			}
+
+			// the function is restarted with the new settings
+			expected, err := m.containerArgs(test.mapping.Functions()[0])
+			if err != nil {
+				t.Fatalf("finding container arguments: %v", err)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				started := runner.startedArgs("HelloFunction")
+				if len(started) == 2 {
+					got := started[1]
+					got.ContainerName = expected.ContainerName
+					if !reflect.DeepEqual(got, expected) {
+						t.Fatalf("invalid arguments, expected %+v found %+v", expected, got)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("function was not restarted, found %d containers", len(started))
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestReloadTemplateSwitchesRoutesBeforeStopping(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.yaml")
+	writeTemplate := func(functions ...string) {
+		contents := "Transform: AWS::Serverless-2016-10-31\nResources:\n"
+		for _, logicalID := range functions {
+			contents += "  " + logicalID + `:
+    Type: AWS::Serverless::Function
+    Properties:
+      CodeUri: ` + logicalID + `/
+      Handler: bootstrap
+      Runtime: provided.al2
+      Events:
+        Api:
+          Type: Api
+          Properties:
+            Path: /` + logicalID + `
+            Method: get
+`
+		}
+		if err := ioutil.WriteFile(template, []byte(contents), 0644); err != nil {
+			t.Fatalf("writing template: %v", err)
+		}
+	}
+	writeTemplate("HelloFunction", "OtherFunction")
+
+	runner := &fakeRunner{}
+	m := newTestFunctionManager(t, runner)
+	m.opts.Args.Template = template
+	defer m.Shutdown()
+
+	mapping, err := parseTemplate(template, nil)
+	if err != nil {
+		t.Fatalf("parsing template: %v", err)
+	}
+	var wg sync.WaitGroup
+	if err := m.Start(mapping, &wg); err != nil {
+		t.Fatalf("starting functions: %v", err)
+	}
+	wg.Wait()
+	srv := server.New("localhost", 0)
+	srv.ReplaceRoutes(m.Routes())
+
+	// the removed function no longer has a route by the time its container
+	// is removed
+	statuses := make(chan int, 1)
+	runner.onRemove = func(containerID string) {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", "/OtherFunction", nil))
+		statuses <- w.Code
+	}
+
+	writeTemplate("HelloFunction")
+	reloadTemplate(m.opts, nil, srv, m, false)
+
+	select {
+	case status := <-statuses:
+		if status != 404 {
+			t.Fatalf("route of the removed function should be gone before it stops, got status %d", status)
+		}
+	default:
+		t.Fatalf("removed function was not stopped")
+	}
+	if _, ok := m.functions["OtherFunction"]; ok {
+		t.Fatalf("removed function should no longer run")
+	}
+}
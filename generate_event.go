@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mindriot101/lambda-local-runner/internal/events"
+)
+
+// HTTPEventOpts are the options shared by events that wrap an HTTP request
+type HTTPEventOpts struct {
+	Method     string   `short:"m" long:"method"     description:"HTTP method"                                      default:"GET"`
+	Path       string   `short:"p" long:"path"       description:"Request path"                                     default:"/"`
+	Query      string   `short:"q" long:"query"      description:"Raw query string, e.g. a=1&b=2"`
+	Body       string   `short:"b" long:"body"       description:"Request body"`
+	Headers    []string `          long:"header"     description:"Request header as Name:value, may be repeated"`
+	Resource   string   `          long:"resource"   description:"Route template that matched the request (default: path)"`
+	PathParams []string `          long:"path-param" description:"Path parameter as name=value, may be repeated"`
+}
+
+// GenerateEventOpts are the options for the `generate-event` command. Each
+// event source is its own subcommand.
+type GenerateEventOpts struct {
+	Region string `long:"region" description:"AWS region of the event source" default:"us-east-1"`
+
+	APIGateway   HTTPEventOpts `command:"apigateway"   description:"API Gateway REST API (v1) proxy event"`
+	APIGatewayV2 HTTPEventOpts `command:"apigatewayv2" description:"API Gateway HTTP API (v2) event"`
+	ALB          HTTPEventOpts `command:"alb"          description:"Application load balancer event"`
+
+	SQS struct {
+		Queue string `long:"queue" description:"Queue name"   default:"my-queue"`
+		Body  string `long:"body"  description:"Message body" default:"Hello from SQS!"`
+	} `command:"sqs" description:"SQS queue event"`
+
+	SNS struct {
+		Topic   string `long:"topic"   description:"Topic name"           default:"my-topic"`
+		Subject string `long:"subject" description:"Notification subject" default:"Test subject"`
+		Message string `long:"message" description:"Notification message" default:"Hello from SNS!"`
+	} `command:"sns" description:"SNS notification event"`
+
+	S3 struct {
+		Bucket    string `long:"bucket"     description:"Bucket name"            default:"my-bucket"`
+		Key       string `long:"key"        description:"Object key"             default:"test/key"`
+		Size      int64  `long:"size"       description:"Object size in bytes"   default:"1024"`
+		EventName string `long:"event-name" description:"S3 event notification" default:"ObjectCreated:Put"`
+	} `command:"s3" description:"S3 bucket notification event"`
+
+	DynamoDB struct {
+		Table     string `long:"table"      description:"Table name"                          default:"my-table"`
+		EventName string `long:"event-name" description:"INSERT, MODIFY or REMOVE"            default:"INSERT"`
+		Keys      string `long:"keys"       description:"Item keys in attribute value format" default:"{\"Id\":{\"N\":\"101\"}}"`
+		NewImage  string `long:"new-image"  description:"New item in attribute value format"  default:"{\"Id\":{\"N\":\"101\"},\"Message\":{\"S\":\"New item!\"}}"`
+		OldImage  string `long:"old-image"  description:"Old item in attribute value format"`
+	} `command:"dynamodb" description:"DynamoDB stream event"`
+
+	Kinesis struct {
+		Stream       string `long:"stream"        description:"Stream name"                   default:"my-stream"`
+		PartitionKey string `long:"partition-key" description:"Record partition key"          default:"1"`
+		Data         string `long:"data"          description:"Record data (before encoding)" default:"Hello from Kinesis!"`
+	} `command:"kinesis" description:"Kinesis stream event"`
+
+	EventBridge struct {
+		Source     string `long:"source"      description:"Event source"       default:"my.application"`
+		DetailType string `long:"detail-type" description:"Event detail type"  default:"MyEvent"`
+		Detail     string `long:"detail"      description:"Event detail (JSON)" default:"{}"`
+	} `command:"eventbridge" description:"EventBridge rule event"`
+
+	Cognito struct {
+		TriggerSource string   `long:"trigger-source" description:"Trigger source"                               default:"PreSignUp_SignUp"`
+		UserPoolID    string   `long:"user-pool-id"   description:"User pool ID"                                 default:"us-east-1_EXAMPLE"`
+		ClientID      string   `long:"client-id"      description:"App client ID"                                default:"exampleclientid"`
+		UserName      string   `long:"username"       description:"User name"                                    default:"example-user"`
+		Attributes    []string `long:"attribute"      description:"User attribute as name=value, may be repeated"`
+	} `command:"cognito" description:"Cognito user pool trigger event"`
+}
+
+// generateEvent prints a sample event for the named event source to stdout
+func generateEvent(opts GenerateEventOpts, source string) error {
+	evt, err := buildEvent(opts, source)
+	if err != nil {
+		return fmt.Errorf("building %s event: %w", source, err)
+	}
+
+	out, err := json.MarshalIndent(evt, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	fmt.Fprintf(os.Stdout, "%s\n", out)
+	return nil
+}
+
+func buildEvent(opts GenerateEventOpts, source string) (interface{}, error) {
+	region := opts.Region
+	switch source {
+	case "apigateway":
+		r, pathParams, err := opts.APIGateway.request()
+		if err != nil {
+			return nil, err
+		}
+		return events.NewAPIGatewayProxyRequest(r, opts.APIGateway.resource(), pathParams)
+	case "apigatewayv2":
+		r, pathParams, err := opts.APIGatewayV2.request()
+		if err != nil {
+			return nil, err
+		}
+		return events.NewAPIGatewayV2HTTPRequest(r, opts.APIGatewayV2.resource(), pathParams)
+	case "alb":
+		r, _, err := opts.ALB.request()
+		if err != nil {
+			return nil, err
+		}
+		return events.NewALBTargetGroupRequest(r, region)
+	case "sqs":
+		return events.NewSQSEvent(region, opts.SQS.Queue, opts.SQS.Body), nil
+	case "sns":
+		return events.NewSNSEvent(region, opts.SNS.Topic, opts.SNS.Subject, opts.SNS.Message), nil
+	case "s3":
+		return events.NewS3Event(region, opts.S3.EventName, opts.S3.Bucket, opts.S3.Key, opts.S3.Size), nil
+	case "dynamodb":
+		keys, err := rawJSON("keys", opts.DynamoDB.Keys)
+		if err != nil {
+			return nil, err
+		}
+		newImage, err := rawJSON("new image", opts.DynamoDB.NewImage)
+		if err != nil {
+			return nil, err
+		}
+		oldImage, err := rawJSON("old image", opts.DynamoDB.OldImage)
+		if err != nil {
+			return nil, err
+		}
+		return events.NewDynamoDBEvent(region, opts.DynamoDB.Table, opts.DynamoDB.EventName, keys, newImage, oldImage), nil
+	case "kinesis":
+		return events.NewKinesisEvent(region, opts.Kinesis.Stream, opts.Kinesis.PartitionKey, []byte(opts.Kinesis.Data)), nil
+	case "eventbridge":
+		detail, err := rawJSON("detail", opts.EventBridge.Detail)
+		if err != nil {
+			return nil, err
+		}
+		return events.NewEventBridgeEvent(region, opts.EventBridge.Source, opts.EventBridge.DetailType, detail), nil
+	case "cognito":
+		attributes, err := keyValues(opts.Cognito.Attributes, "=")
+		if err != nil {
+			return nil, fmt.Errorf("parsing attributes: %w", err)
+		}
+		return events.NewCognitoEvent(region, opts.Cognito.TriggerSource, opts.Cognito.UserPoolID, opts.Cognito.ClientID, opts.Cognito.UserName, attributes), nil
+	default:
+		return nil, fmt.Errorf("unknown event source %s", source)
+	}
+}
+
+// request builds the HTTP request the event is generated from, so generated
+// events go through exactly the same code as requests proxied by the server
+func (o HTTPEventOpts) request() (*http.Request, map[string]string, error) {
+	url := "http://localhost" + o.Path
+	if o.Query != "" {
+		url += "?" + o.Query
+	}
+
+	r, err := http.NewRequest(strings.ToUpper(o.Method), url, strings.NewReader(o.Body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	headers, err := keyValues(o.Headers, ":")
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing headers: %w", err)
+	}
+	for k, v := range headers {
+		r.Header.Add(k, v)
+	}
+
+	pathParams, err := keyValues(o.PathParams, "=")
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing path parameters: %w", err)
+	}
+
+	return r, pathParams, nil
+}
+
+func (o HTTPEventOpts) resource() string {
+	if o.Resource != "" {
+		return o.Resource
+	}
+	return o.Path
+}
+
+// keyValues parses a list of `key<sep>value` pairs
+func keyValues(pairs []string, sep string) (map[string]string, error) {
+	out := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, sep, 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid value %q, expected key%svalue", pair, sep)
+		}
+		out[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return out, nil
+}
+
+// rawJSON validates a JSON flag value so that it can be embedded in an event
+func rawJSON(name, value string) (json.RawMessage, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if !json.Valid([]byte(value)) {
+		return nil, fmt.Errorf("invalid JSON for %s", name)
+	}
+	return json.RawMessage(value), nil
+}
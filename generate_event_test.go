@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mindriot101/lambda-local-runner/internal/events"
+)
+
+func TestGenerateAPIGatewayEvent(t *testing.T) {
+	opts := GenerateEventOpts{
+		Region: "us-east-1",
+		APIGateway: HTTPEventOpts{
+			Method:     "post",
+			Path:       "/users/42",
+			Body:       "hello",
+			Headers:    []string{"X-Foo: bar"},
+			Resource:   "/users/{id}",
+			PathParams: []string{"id=42"},
+		},
+	}
+
+	evt, err := buildEvent(opts, "apigateway")
+	if err != nil {
+		t.Fatalf("building event: %v", err)
+	}
+
+	req, ok := evt.(*events.APIGatewayProxyRequest)
+	if !ok {
+		t.Fatalf("invalid event type %T", evt)
+	}
+
+	if req.HTTPMethod != "POST" {
+		t.Fatalf("invalid method %s", req.HTTPMethod)
+	}
+
+	if req.Headers["X-Foo"] != "bar" {
+		t.Fatalf("invalid headers %v", req.Headers)
+	}
+
+	if req.PathParameters["id"] != "42" {
+		t.Fatalf("invalid path parameters %v", req.PathParameters)
+	}
+}
+
+func TestGenerateEventInvalidJSON(t *testing.T) {
+	opts := GenerateEventOpts{}
+	opts.EventBridge.Detail = "{not json"
+
+	if _, err := buildEvent(opts, "eventbridge"); err == nil {
+		t.Fatalf("expected error from invalid detail")
+	}
+}
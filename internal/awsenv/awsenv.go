@@ -0,0 +1,274 @@
+package awsenv
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultRegion is used if no region is configured anywhere
+const defaultRegion = "us-east-1"
+
+// Options selects where the AWS configuration of the functions comes from
+type Options struct {
+	// Profile is the named profile to read credentials and region from. The
+	// AWS_PROFILE environment variable or the default profile are used if
+	// empty.
+	Profile string
+	// Region overrides the region from the environment and profile
+	Region string
+	// Dummy passes fixed fake credentials, for use with local stand-ins for
+	// AWS services
+	Dummy bool
+	// EndpointURL points the AWS SDKs in the functions at another endpoint,
+	// e.g. a local service emulator
+	EndpointURL string
+}
+
+// Config is the AWS configuration passed to the functions
+type Config struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	EndpointURL     string
+}
+
+// dummy are the credentials used with local stand-ins, which accept any
+// credentials
+var dummy = Config{
+	AccessKeyID:     "test",
+	SecretAccessKey: "test",
+}
+
+// Resolve finds the credentials and region for the functions, looking at
+// the same places as the AWS CLI: the environment, then the shared
+// credentials and config files
+func Resolve(opts Options) (Config, error) {
+	profile := opts.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+
+	var cfg Config
+	switch {
+	case opts.Dummy:
+		cfg = dummy
+
+	case opts.Profile == "" && os.Getenv("AWS_ACCESS_KEY_ID") != "":
+		cfg = Config{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+
+	default:
+		profileCfg, err := readProfile(profile)
+		if err != nil {
+			return Config{}, err
+		}
+
+		switch {
+		case profileCfg == nil && opts.Profile != "":
+			return Config{}, fmt.Errorf("profile %s not found in %s or %s", opts.Profile, credentialsFile(), configFile())
+		case profileCfg == nil:
+			log.Debug().Str("profile", profile).Msg("no AWS credentials found")
+		case profileCfg.unsupported != "":
+			// the SDKs in the functions cannot reach the credential
+			// sources of these profiles
+			err := fmt.Errorf("profile %s uses %s, which is not supported: export its credentials with `eval \"$(aws configure export-credentials --profile %s --format env)\"` first", profile, profileCfg.unsupported, profile)
+			if opts.Profile != "" {
+				return Config{}, err
+			}
+			log.Warn().Err(err).Msg("not passing AWS credentials to the functions")
+		default:
+			cfg = profileCfg.credentials
+		}
+	}
+
+	region, err := resolveRegion(opts.Region, profile)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.Region = region
+	cfg.EndpointURL = opts.EndpointURL
+	return cfg, nil
+}
+
+// profileConfig holds the settings of a profile from the shared files
+type profileConfig struct {
+	credentials Config
+	region      string
+	// unsupported names the setting of the profile that makes it get its
+	// credentials some other way than static keys, e.g. SSO
+	unsupported string
+}
+
+// unsupportedKeys are the settings of profiles whose credentials come from
+// somewhere other than the shared files
+var unsupportedKeys = []string{
+	"sso_session",
+	"sso_start_url",
+	"role_arn",
+	"source_profile",
+	"credential_process",
+	"web_identity_token_file",
+}
+
+// readProfile reads the profile from the shared credentials and config
+// files. Like the AWS SDKs, settings such as role_arn take precedence over
+// static keys, and the keys in the credentials file over those in the config
+// file. It returns nil if neither file has the profile.
+func readProfile(profile string) (*profileConfig, error) {
+	credentials, err := readSection(credentialsFile(), profile)
+	if err != nil {
+		return nil, fmt.Errorf("reading shared credentials: %w", err)
+	}
+
+	// profiles other than the default are prefixed in the config file
+	section := "profile " + profile
+	if profile == "default" {
+		section = profile
+	}
+	config, err := readSection(configFile(), section)
+	if err != nil {
+		return nil, fmt.Errorf("reading shared config: %w", err)
+	}
+
+	if credentials == nil && config == nil {
+		return nil, nil
+	}
+
+	out := &profileConfig{region: config["region"]}
+	for _, values := range []map[string]string{credentials, config} {
+		for _, key := range unsupportedKeys {
+			if values[key] != "" {
+				out.unsupported = key
+				return out, nil
+			}
+		}
+	}
+
+	for _, values := range []map[string]string{credentials, config} {
+		if values["aws_access_key_id"] != "" {
+			out.credentials = Config{
+				AccessKeyID:     values["aws_access_key_id"],
+				SecretAccessKey: values["aws_secret_access_key"],
+				SessionToken:    values["aws_session_token"],
+			}
+			return out, nil
+		}
+	}
+	return out, nil
+}
+
+// resolveRegion finds the region from the options, environment or config
+// file, in that order
+func resolveRegion(region, profile string) (string, error) {
+	for _, r := range []string{region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if r != "" {
+			return r, nil
+		}
+	}
+
+	profileCfg, err := readProfile(profile)
+	if err != nil {
+		return "", err
+	}
+	if profileCfg != nil && profileCfg.region != "" {
+		return profileCfg.region, nil
+	}
+	return defaultRegion, nil
+}
+
+// Environ returns the environment variables used by the AWS SDKs, without
+// any that are not set
+func (c Config) Environ() []string {
+	var env []string
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+
+	add("AWS_ACCESS_KEY_ID", c.AccessKeyID)
+	add("AWS_SECRET_ACCESS_KEY", c.SecretAccessKey)
+	add("AWS_SESSION_TOKEN", c.SessionToken)
+	add("AWS_REGION", c.Region)
+	add("AWS_DEFAULT_REGION", c.Region)
+	add("AWS_ENDPOINT_URL", c.EndpointURL)
+	return env
+}
+
+func credentialsFile() string {
+	if name := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); name != "" {
+		return name
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".aws", "credentials")
+}
+
+func configFile() string {
+	if name := os.Getenv("AWS_CONFIG_FILE"); name != "" {
+		return name
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".aws", "config")
+}
+
+// readSection reads the keys of a section of an ini file. It returns nil if
+// the file or section does not exist.
+func readSection(filename, section string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var values map[string]string
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == section
+			if inSection && values == nil {
+				values = make(map[string]string)
+			}
+			continue
+		}
+
+		if !inSection {
+			continue
+		}
+		if key, value, ok := cut(line, "="); ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// cut splits s around the first instance of sep
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,171 @@
+package awsenv
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const credentials = `[default]
+aws_access_key_id = default-key
+aws_secret_access_key = default-secret
+
+# a comment
+[dev]
+aws_access_key_id=dev-key
+aws_secret_access_key=dev-secret
+aws_session_token=dev-token
+`
+
+const config = `[default]
+region = eu-west-1
+
+[profile dev]
+region = ap-southeast-2
+
+[profile config-only]
+region = eu-central-1
+aws_access_key_id = config-key
+aws_secret_access_key = config-secret
+
+[profile sso]
+sso_session = my-sso
+sso_account_id = 123456789012
+sso_role_name = Admin
+region = us-west-1
+
+[profile assumed]
+role_arn = arn:aws:iam::123456789012:role/Admin
+source_profile = default
+`
+
+// setup points the shared files at fixtures and clears the environment
+func setup(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{"credentials": credentials, "config": config} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	for _, name := range []string{"AWS_PROFILE", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_REGION", "AWS_DEFAULT_REGION"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		opts Options
+		want Config
+	}{
+		{
+			name: "default profile",
+			want: Config{AccessKeyID: "default-key", SecretAccessKey: "default-secret", Region: "eu-west-1"},
+		},
+		{
+			name: "named profile",
+			opts: Options{Profile: "dev"},
+			want: Config{AccessKeyID: "dev-key", SecretAccessKey: "dev-secret", SessionToken: "dev-token", Region: "ap-southeast-2"},
+		},
+		{
+			name: "credentials from the config file",
+			opts: Options{Profile: "config-only"},
+			want: Config{AccessKeyID: "config-key", SecretAccessKey: "config-secret", Region: "eu-central-1"},
+		},
+		{
+			name: "unsupported profile from environment",
+			env:  map[string]string{"AWS_PROFILE": "sso"},
+			want: Config{Region: "us-west-1"},
+		},
+		{
+			name: "profile from environment",
+			env:  map[string]string{"AWS_PROFILE": "dev"},
+			want: Config{AccessKeyID: "dev-key", SecretAccessKey: "dev-secret", SessionToken: "dev-token", Region: "ap-southeast-2"},
+		},
+		{
+			name: "environment credentials",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "env-key", "AWS_SECRET_ACCESS_KEY": "env-secret", "AWS_REGION": "us-west-2"},
+			want: Config{AccessKeyID: "env-key", SecretAccessKey: "env-secret", Region: "us-west-2"},
+		},
+		{
+			name: "explicit profile overrides environment credentials",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "env-key", "AWS_SECRET_ACCESS_KEY": "env-secret"},
+			opts: Options{Profile: "dev", Region: "us-east-2"},
+			want: Config{AccessKeyID: "dev-key", SecretAccessKey: "dev-secret", SessionToken: "dev-token", Region: "us-east-2"},
+		},
+		{
+			name: "dummy credentials",
+			env:  map[string]string{"AWS_DEFAULT_REGION": "sa-east-1"},
+			opts: Options{Dummy: true, EndpointURL: "http://localstack:4566"},
+			want: Config{AccessKeyID: "test", SecretAccessKey: "test", Region: "sa-east-1", EndpointURL: "http://localstack:4566"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			setup(t)
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+
+			got, err := Resolve(tc.opts)
+			if err != nil {
+				t.Fatalf("resolving: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("got %+v, expected %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveMissingProfile(t *testing.T) {
+	setup(t)
+
+	if _, err := Resolve(Options{Profile: "missing"}); err == nil {
+		t.Fatalf("expected an error for a missing profile")
+	}
+}
+
+func TestResolveUnsupportedProfile(t *testing.T) {
+	setup(t)
+
+	for _, profile := range []string{"sso", "assumed"} {
+		if _, err := Resolve(Options{Profile: profile}); err == nil {
+			t.Fatalf("expected an error for profile %s", profile)
+		}
+	}
+}
+
+func TestResolveWithoutSharedFiles(t *testing.T) {
+	setup(t)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+
+	got, err := Resolve(Options{})
+	if err != nil {
+		t.Fatalf("resolving: %v", err)
+	}
+	if want := (Config{Region: "us-east-1"}); got != want {
+		t.Fatalf("got %+v, expected %+v", got, want)
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	cfg := Config{AccessKeyID: "key", SecretAccessKey: "secret", Region: "eu-west-1"}
+	want := []string{
+		"AWS_ACCESS_KEY_ID=key",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"AWS_REGION=eu-west-1",
+		"AWS_DEFAULT_REGION=eu-west-1",
+	}
+	if got := cfg.Environ(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, expected %v", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Sync copies the files in src that are missing from dst, or differ in size
+// or modification time, into dst. Files that only exist in dst, such as the
+// dependencies installed by a build, are left alone. Paths relative to src
+// for which skip returns true are not copied. Sync returns the number of
+// files copied.
+func Sync(src, dst string, skip func(rel string) bool) (int, error) {
+	copied := 0
+	err := filepath.Walk(src, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case !info.Mode().IsRegular():
+			// sockets, devices and symlinks are not part of the code
+			return nil
+		}
+
+		if existing, err := os.Stat(target); err == nil && existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime()) {
+			return nil
+		}
+		if err := copyFile(name, target, info); err != nil {
+			return fmt.Errorf("copying %s: %w", rel, err)
+		}
+		copied++
+		return nil
+	})
+	return copied, err
+}
+
+// copyFile copies the file, keeping its mode and modification time so it is
+// skipped by the next sync
+func copyFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// Command is a shell command that builds a function
+type Command struct {
+	// Command is run with sh -c
+	Command string
+	// Dir is the working directory of the command
+	Dir string
+	// Env are added to the environment of the command
+	Env []string
+}
+
+// Run runs the command, returning its combined output. The error includes
+// the output if the command fails.
+func (c Command) Run(ctx context.Context) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Command)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(), c.Env...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return out.Bytes(), fmt.Errorf("running %q: %w\n%s", c.Command, err, bytes.TrimSpace(out.Bytes()))
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,96 @@
+package build
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("creating directory: %v", err)
+	}
+	if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("reading %s: %v", name, err)
+	}
+	return string(b)
+}
+
+func TestSync(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(src, "app.py"), "v1")
+	writeFile(t, filepath.Join(src, "pkg", "lib.py"), "lib")
+	writeFile(t, filepath.Join(src, "__pycache__", "app.pyc"), "compiled")
+	// installed by the build
+	writeFile(t, filepath.Join(dst, "requests", "__init__.py"), "dependency")
+
+	skip := func(rel string) bool { return filepath.Base(rel) == "__pycache__" }
+
+	copied, err := Sync(src, dst, skip)
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if copied != 2 {
+		t.Fatalf("copied %d files, expected 2", copied)
+	}
+	if got := readFile(t, filepath.Join(dst, "pkg", "lib.py")); got != "lib" {
+		t.Fatalf("invalid contents %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "__pycache__")); !os.IsNotExist(err) {
+		t.Fatalf("skipped directory was copied")
+	}
+	if got := readFile(t, filepath.Join(dst, "requests", "__init__.py")); got != "dependency" {
+		t.Fatalf("dependency was modified: %q", got)
+	}
+
+	// only changed files are copied again
+	writeFile(t, filepath.Join(src, "app.py"), "v2")
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(src, "app.py"), later, later); err != nil {
+		t.Fatalf("touching file: %v", err)
+	}
+	copied, err = Sync(src, dst, skip)
+	if err != nil {
+		t.Fatalf("syncing: %v", err)
+	}
+	if copied != 1 {
+		t.Fatalf("copied %d files, expected 1", copied)
+	}
+	if got := readFile(t, filepath.Join(dst, "app.py")); got != "v2" {
+		t.Fatalf("invalid contents %q", got)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir := t.TempDir()
+	out, err := Command{
+		Command: `echo "building $LLR_FUNCTION in $(basename "$PWD")"`,
+		Dir:     dir,
+		Env:     []string{"LLR_FUNCTION=HelloWorldFunction"},
+	}.Run(context.Background())
+	if err != nil {
+		t.Fatalf("running command: %v", err)
+	}
+	if want := "building HelloWorldFunction in " + filepath.Base(dir); strings.TrimSpace(string(out)) != want {
+		t.Fatalf("invalid output %q", out)
+	}
+
+	_, err = Command{Command: "echo broken >&2; exit 3"}.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected an error with the command output, got %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// FileName is the project config file read from the working directory
+	FileName = "llr.toml"
+	// SAMFileName is the SAM CLI config file, some of whose settings are
+	// used as defaults
+	SAMFileName = "samconfig.toml"
+)
+
+// The commands whose options are read from the config files
+const (
+	CommandRun    = "run"
+	CommandInvoke = "invoke"
+)
+
+// Commands are the commands whose options are read from the config files
+var Commands = []string{CommandRun, CommandInvoke}
+
+// sharedKeys are the keys of llr.toml that set the options of invoke as well
+// as run, as they mean the same for both. Other keys only set options of run;
+// options of invoke alone are set in the [invoke] table.
+var sharedKeys = map[string]bool{
+	"root":                true,
+	"template":            true,
+	"docker-network":      true,
+	"parameter-overrides": true,
+	"env-vars":            true,
+	"from-source":         true,
+	"deps-dir":            true,
+	"no-docker":           true,
+}
+
+// samCommand describes where the options of a command are found in
+// samconfig.toml
+type samCommand struct {
+	// tables are the tables read, in increasing order of precedence
+	tables [][]string
+	// keys maps the SAM CLI settings that are used to the options they set
+	keys map[string]string
+}
+
+// samCommands maps each command to the settings of the SAM CLI command it
+// corresponds to
+var samCommands = map[string]samCommand{
+	CommandRun: {
+		tables: [][]string{
+			{"default", "global", "parameters"},
+			{"default", "local_start_api", "parameters"},
+		},
+		keys: map[string]string{
+			"template":            "template",
+			"template_file":       "template",
+			"port":                "port",
+			"host":                "host",
+			"docker_network":      "docker-network",
+			"env_vars":            "env-vars",
+			"parameter_overrides": "parameter-overrides",
+		},
+	},
+	CommandInvoke: {
+		tables: [][]string{
+			{"default", "global", "parameters"},
+			{"default", "local_invoke", "parameters"},
+		},
+		keys: map[string]string{
+			"template":            "template",
+			"template_file":       "template",
+			"docker_network":      "docker-network",
+			"env_vars":            "env-vars",
+			"parameter_overrides": "parameter-overrides",
+		},
+	},
+}
+
+// Function holds the settings for a single function
+type Function struct {
+	// Environment are extra environment variables for the function
+	Environment map[string]string
+	// MaxConcurrency overrides the maximum number of containers for the
+	// function if it is not 0
+	MaxConcurrency int
+	// DependenciesDir overrides the dependencies directory of the function
+	// when running from source
+	DependenciesDir string
+}
+
+// Config holds the defaults read from the config files
+type Config struct {
+	// Options maps each command to the long names of its options and their
+	// values
+	Options map[string]map[string][]string
+	// Sources maps each command to the long names of its options and the
+	// file they were read from
+	Sources map[string]map[string]string
+	// Functions are the settings for individual functions, by logical ID
+	Functions map[string]Function
+}
+
+// New creates an empty Config
+func New() *Config {
+	cfg := &Config{
+		Options:   make(map[string]map[string][]string),
+		Sources:   make(map[string]map[string]string),
+		Functions: make(map[string]Function),
+	}
+	for _, command := range Commands {
+		cfg.Options[command] = make(map[string][]string)
+		cfg.Sources[command] = make(map[string]string)
+	}
+	return cfg
+}
+
+// Load reads samconfig.toml and then llr.toml from the directory, with the
+// settings in llr.toml taking precedence. The LLR_CONFIG environment
+// variable names a different file to read instead of llr.toml. Missing files
+// are skipped. As samconfig.toml is written for the SAM CLI, it is skipped
+// with a warning if it cannot be used.
+func Load(dir string) (*Config, error) {
+	cfg := New()
+	if err := cfg.loadSAM(filepath.Join(dir, SAMFileName)); err != nil {
+		log.Warn().Err(err).Msg("ignoring the SAM config file")
+	}
+
+	filename := os.Getenv("LLR_CONFIG")
+	if filename == "" {
+		filename = filepath.Join(dir, FileName)
+	}
+	if err := cfg.load(filename); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Names returns the long names of the options of the command set in the
+// config files, sorted
+func (c *Config) Names(command string) []string {
+	names := make([]string, 0, len(c.Options[command]))
+	for name := range c.Options[command] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the first value of an option of the command, or an empty
+// string if it is not set
+func (c *Config) Get(command, name string) string {
+	if values := c.Options[command][name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Source returns the file an option of the command was read from
+func (c *Config) Source(command, name string) (string, bool) {
+	source, ok := c.Sources[command][name]
+	return source, ok
+}
+
+// read parses a TOML file, returning nil if it does not exist
+func read(filename string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filename, err)
+	}
+
+	var doc map[string]interface{}
+	if _, err := toml.Decode(string(b), &doc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	return doc, nil
+}
+
+// subtable finds or creates the nested table with the given path
+func subtable(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, key := range keys {
+		switch existing := table[key].(type) {
+		case nil:
+			child := make(map[string]interface{})
+			table[key] = child
+			table = child
+		case map[string]interface{}:
+			table = existing
+		default:
+			return nil, fmt.Errorf("key %s is not a table", key)
+		}
+	}
+	return table, nil
+}
+
+func (c *Config) load(filename string) error {
+	doc, err := read(filename)
+	if err != nil || doc == nil {
+		return err
+	}
+
+	for key, value := range doc {
+		switch name := strings.ReplaceAll(key, "_", "-"); name {
+		case "functions":
+			if err := c.loadFunctions(value); err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+
+		case CommandInvoke:
+			table, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: invoke must be a table", filename)
+			}
+			if err := c.loadOptions(table, CommandInvoke, filename); err != nil {
+				return err
+			}
+
+		default:
+			if err := c.loadOptions(map[string]interface{}{key: value}, CommandRun, filename); err != nil {
+				return err
+			}
+			if sharedKeys[name] || name == "parameters" {
+				if err := c.loadOptions(map[string]interface{}{key: value}, CommandInvoke, filename); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadOptions sets the options of the command from the keys of a table
+func (c *Config) loadOptions(table map[string]interface{}, command, filename string) error {
+	for key, value := range table {
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "parameters" {
+			// a table of parameter names and values
+			parameters, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: parameters must be a table", filename)
+			}
+			values, err := keyValues(parameters)
+			if err != nil {
+				return fmt.Errorf("%s: parameters: %w", filename, err)
+			}
+			c.set(command, "parameter-overrides", values, filename)
+			continue
+		}
+
+		values, err := optionValues(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", filename, key, err)
+		}
+		c.set(command, name, values, filename)
+	}
+	return nil
+}
+
+func (c *Config) loadFunctions(value interface{}) error {
+	functions, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("functions must be a table")
+	}
+
+	for logicalID, value := range functions {
+		settings, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("functions.%s must be a table", logicalID)
+		}
+
+		var f Function
+		for key, value := range settings {
+			switch strings.ReplaceAll(key, "_", "-") {
+			case "environment":
+				env, ok := value.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("functions.%s.environment must be a table", logicalID)
+				}
+				f.Environment = make(map[string]string, len(env))
+				for name, value := range env {
+					s, err := stringValue(value)
+					if err != nil {
+						return fmt.Errorf("functions.%s.environment.%s: %w", logicalID, name, err)
+					}
+					f.Environment[name] = s
+				}
+
+			case "max-concurrency":
+				n, ok := value.(int64)
+				if !ok || n < 1 {
+					return fmt.Errorf("functions.%s.max_concurrency must be a positive integer", logicalID)
+				}
+				f.MaxConcurrency = int(n)
+
+			case "deps-dir":
+				s, ok := value.(string)
+				if !ok {
+					return fmt.Errorf("functions.%s.deps_dir must be a string", logicalID)
+				}
+				f.DependenciesDir = s
+
+			default:
+				return fmt.Errorf("unknown setting functions.%s.%s", logicalID, key)
+			}
+		}
+		c.Functions[logicalID] = f
+	}
+	return nil
+}
+
+// loadSAM reads the settings used from samconfig.toml. Nothing is set if
+// any of them cannot be used.
+func (c *Config) loadSAM(filename string) error {
+	doc, err := read(filename)
+	if err != nil || doc == nil {
+		return err
+	}
+
+	sam := New()
+	for command, samCmd := range samCommands {
+		for _, path := range samCmd.tables {
+			table, err := subtable(doc, path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+
+			for key, value := range table {
+				name, ok := samCmd.keys[key]
+				if !ok {
+					continue
+				}
+
+				var values []string
+				if s, ok := value.(string); ok && name == "parameter-overrides" {
+					values = splitParameters(s)
+				} else if values, err = optionValues(value); err != nil {
+					return fmt.Errorf("%s: %s: %w", filename, key, err)
+				}
+				sam.set(command, name, values, filename)
+			}
+		}
+	}
+
+	for command, options := range sam.Options {
+		for name, values := range options {
+			c.set(command, name, values, filename)
+		}
+	}
+	return nil
+}
+
+func (c *Config) set(command, name string, values []string, filename string) {
+	c.Options[command][name] = values
+	c.Sources[command][name] = filename
+}
+
+// optionValues converts a config value to command line option values. Arrays
+// set options that can be repeated.
+func optionValues(value interface{}) ([]string, error) {
+	if items, ok := value.([]interface{}); ok {
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			s, err := stringValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+
+	s, err := stringValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return []string{s}, nil
+}
+
+func stringValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// keyValues converts a table to sorted name=value pairs
+func keyValues(table map[string]interface{}) ([]string, error) {
+	values := make([]string, 0, len(table))
+	for name, value := range table {
+		s, err := stringValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		values = append(values, name+"="+s)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// splitParameters splits SAM parameter overrides, e.g. `A=1 B="two words"`,
+// into name=value pairs
+func splitParameters(s string) []string {
+	var (
+		out     []string
+		current strings.Builder
+		quoted  bool
+	)
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if current.Len() > 0 {
+				out = append(out, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if current.Len() > 0 {
+		out = append(out, current.String())
+	}
+	return out
+}
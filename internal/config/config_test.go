@@ -0,0 +1,216 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLR_CONFIG", "")
+	writeFile(t, dir, SAMFileName, `version = 0.1
+[default.global.parameters]
+template_file = "sam.yaml"
+[default.local_start_api.parameters]
+port = 3000
+host = "0.0.0.0"
+warm_containers = "EAGER"
+parameter_overrides = "Stage=prod Name=\"two words\""
+`)
+	writeFile(t, dir, FileName, `root = ".aws-sam/build"
+port = 3001
+watch_include = ["*.py", "*.json"]
+
+[parameters]
+Stage = "local"
+
+[functions.HelloWorldFunction]
+max_concurrency = 2
+deps_dir = ".venv/lib/python3.9/site-packages"
+environment = { TABLE_NAME = "local", DEBUG = true }
+`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+
+	wantOptions := map[string][]string{
+		"template":            {"sam.yaml"},
+		"port":                {"3001"},
+		"host":                {"0.0.0.0"},
+		"root":                {".aws-sam/build"},
+		"watch-include":       {"*.py", "*.json"},
+		"parameter-overrides": {"Stage=local"},
+	}
+	if got := cfg.Options[CommandRun]; !reflect.DeepEqual(got, wantOptions) {
+		t.Fatalf("got run options %v, expected %v", got, wantOptions)
+	}
+	if source, _ := cfg.Source(CommandRun, "host"); source != filepath.Join(dir, SAMFileName) {
+		t.Fatalf("host read from %s", source)
+	}
+	if source, _ := cfg.Source(CommandRun, "port"); source != filepath.Join(dir, FileName) {
+		t.Fatalf("port read from %s", source)
+	}
+
+	wantInvoke := map[string][]string{
+		"template":            {"sam.yaml"},
+		"root":                {".aws-sam/build"},
+		"parameter-overrides": {"Stage=local"},
+	}
+	if got := cfg.Options[CommandInvoke]; !reflect.DeepEqual(got, wantInvoke) {
+		t.Fatalf("got invoke options %v, expected %v", got, wantInvoke)
+	}
+
+	wantFunction := Function{
+		Environment:     map[string]string{"TABLE_NAME": "local", "DEBUG": "true"},
+		MaxConcurrency:  2,
+		DependenciesDir: ".venv/lib/python3.9/site-packages",
+	}
+	if got := cfg.Functions["HelloWorldFunction"]; !reflect.DeepEqual(got, wantFunction) {
+		t.Fatalf("got function settings %+v, expected %+v", got, wantFunction)
+	}
+}
+
+func TestLoadSAMParameters(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLR_CONFIG", filepath.Join(dir, "missing.toml"))
+	writeFile(t, dir, SAMFileName, `[default.local_start_api.parameters]
+parameter_overrides = "Stage=prod Name=\"two words\""
+`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	want := []string{"Stage=prod", "Name=two words"}
+	if got := cfg.Options[CommandRun]["parameter-overrides"]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, expected %v", got, want)
+	}
+}
+
+func TestLoadUnknownFunctionSetting(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLR_CONFIG", "")
+	writeFile(t, dir, FileName, "[functions.HelloWorldFunction]\nmemory = 128\n")
+
+	if _, err := Load(dir); err == nil {
+		t.Fatalf("expected an error for an unknown function setting")
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLR_CONFIG", "")
+	writeFile(t, dir, FileName, `build_command = """
+make \
+  build"""
+watch_exclude = [
+  "*.log", # comment
+]
+
+[functions.HelloWorldFunction]
+environment = { GREETING = "caf\u00e9" }
+`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if got := cfg.Get(CommandRun, "build-command"); got != "make build" {
+		t.Fatalf("invalid multi-line string %q", got)
+	}
+	if got := cfg.Options[CommandRun]["watch-exclude"]; !reflect.DeepEqual(got, []string{"*.log"}) {
+		t.Fatalf("invalid array %v", got)
+	}
+	if got := cfg.Functions["HelloWorldFunction"].Environment["GREETING"]; got != "café" {
+		t.Fatalf("invalid escaped string %q", got)
+	}
+}
+
+func TestLoadInvalidSAMConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLR_CONFIG", "")
+	writeFile(t, dir, SAMFileName, `[default.local_start_api.parameters]
+port = 3000
+host = ["not", "a", "table"
+`)
+	writeFile(t, dir, FileName, "root = \"build\"\n")
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("an invalid SAM config should only be a warning: %v", err)
+	}
+	if _, ok := cfg.Options[CommandRun]["port"]; ok {
+		t.Fatalf("nothing should be read from an invalid SAM config")
+	}
+	if got := cfg.Get(CommandRun, "root"); got != "build" {
+		t.Fatalf("llr.toml should still be read, got root %q", got)
+	}
+}
+
+func TestLoadSAMArraysOfTables(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLR_CONFIG", filepath.Join(dir, "missing.toml"))
+	writeFile(t, dir, SAMFileName, `[[default.deploy.parameters.tags]]
+name = "team"
+
+[default.local_start_api.parameters]
+port = 3000
+`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if got := cfg.Get(CommandRun, "port"); got != "3000" {
+		t.Fatalf("got port %q, expected 3000", got)
+	}
+}
+
+func TestLoadInvokeOptions(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLR_CONFIG", "")
+	writeFile(t, dir, SAMFileName, `[default.local_invoke.parameters]
+template_file = "invoke.yaml"
+docker_network = "invoke-net"
+`)
+	writeFile(t, dir, FileName, `port = 3001
+docker_network = "llr-net"
+
+[invoke]
+event = "event.json"
+`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if _, ok := cfg.Options[CommandInvoke]["port"]; ok {
+		t.Fatalf("port should only set the option of run")
+	}
+	if got := cfg.Get(CommandInvoke, "event"); got != "event.json" {
+		t.Fatalf("got invoke event %q, expected event.json", got)
+	}
+	if got := cfg.Get(CommandInvoke, "template"); got != "invoke.yaml" {
+		t.Fatalf("got invoke template %q, expected invoke.yaml", got)
+	}
+	if got := cfg.Get(CommandRun, "template"); got != "" {
+		t.Fatalf("local_invoke should not set the template of run, got %q", got)
+	}
+	if got := cfg.Get(CommandInvoke, "docker-network"); got != "llr-net" {
+		t.Fatalf("llr.toml should take precedence, got docker network %q", got)
+	}
+	if _, ok := cfg.Options[CommandRun]["event"]; ok {
+		t.Fatalf("the invoke table should not set options of run")
+	}
+}
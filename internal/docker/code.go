@@ -0,0 +1,216 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/rs/zerolog/log"
+)
+
+// codeEntry is a file or directory on the host that is placed in the
+// container
+type codeEntry struct {
+	source string
+	target string
+}
+
+// codeEntries lists where the function code and its layers go in the
+// container. The code goes in /var/task, and the contents of each layer
+// directory are merged into /opt entry by entry so that several layers can
+// share /opt; if two layers provide the same entry, the first one wins. The
+// extensions of the layers are merged into /opt/extensions file by file. The
+// dependencies directory, if any, takes the place of the runtime's entry in
+// /opt ahead of the layers.
+func codeEntries(sourcePath string, layerPaths []string, dependenciesPath string, runtime string) ([]codeEntry, error) {
+	absSourcePath, _ := filepath.Abs(sourcePath)
+	entries := []codeEntry{{source: absSourcePath, target: "/var/task"}}
+
+	seen := make(map[string]string)
+	if dependenciesPath != "" {
+		entry, target, err := dependenciesTarget(runtime)
+		if err != nil {
+			return nil, err
+		}
+		absDependenciesPath, _ := filepath.Abs(dependenciesPath)
+		entries = append(entries, codeEntry{source: absDependenciesPath, target: target})
+		seen[entry] = dependenciesPath
+	}
+
+	extensions, err := Extensions(layerPaths)
+	if err != nil {
+		return nil, err
+	}
+	for _, extension := range extensions {
+		entries = append(entries, codeEntry{
+			source: extension,
+			target: "/opt/extensions/" + filepath.Base(extension),
+		})
+	}
+
+	for _, layerPath := range layerPaths {
+		absLayerPath, _ := filepath.Abs(layerPath)
+		files, err := ioutil.ReadDir(absLayerPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading layer %s: %w", layerPath, err)
+		}
+
+		for _, file := range files {
+			if file.Name() == "extensions" && file.IsDir() {
+				continue
+			}
+			target := "/opt/" + file.Name()
+			if other, ok := seen[target]; ok {
+				log.Warn().Str("path", target).Str("layer", layerPath).Str("used_layer", other).Msg("path provided by more than one layer")
+				continue
+			}
+			seen[target] = layerPath
+
+			entries = append(entries, codeEntry{
+				source: filepath.Join(absLayerPath, file.Name()),
+				target: target,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// ExtensionNames returns the names of the extensions, which they register
+// with
+func ExtensionNames(extensions []string) []string {
+	names := make([]string, 0, len(extensions))
+	for _, extension := range extensions {
+		names = append(names, filepath.Base(extension))
+	}
+	return names
+}
+
+// Extensions lists the executables in the extensions directories of the
+// layers, which lambda starts along with the runtime. If two layers provide
+// an extension with the same name, the first one wins.
+func Extensions(layerPaths []string) ([]string, error) {
+	var extensions []string
+	seen := make(map[string]string)
+	for _, layerPath := range layerPaths {
+		dir, _ := filepath.Abs(filepath.Join(layerPath, "extensions"))
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading extensions of layer %s: %w", layerPath, err)
+		}
+
+		for _, file := range files {
+			if file.IsDir() || file.Mode()&0111 == 0 {
+				continue
+			}
+			if other, ok := seen[file.Name()]; ok {
+				log.Warn().Str("extension", file.Name()).Str("layer", layerPath).Str("used_layer", other).Msg("extension provided by more than one layer")
+				continue
+			}
+			seen[file.Name()] = layerPath
+			extensions = append(extensions, filepath.Join(dir, file.Name()))
+		}
+	}
+	return extensions, nil
+}
+
+// dependenciesTarget returns where the runtime looks for packages provided by
+// layers: the entry of /opt it uses, and the directory the packages go in
+func dependenciesTarget(runtime string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(runtime, "python"):
+		return "/opt/python", "/opt/python", nil
+	case strings.HasPrefix(runtime, "nodejs"):
+		return "/opt/nodejs", "/opt/nodejs/node_modules", nil
+	default:
+		return "", "", fmt.Errorf("a dependencies directory is not supported for the %s runtime", runtime)
+	}
+}
+
+// codeMounts bind mounts the code into the container, so changes on the host
+// are visible straight away. Layers are mounted read only.
+func codeMounts(entries []codeEntry) []mount.Mount {
+	mounts := make([]mount.Mount, 0, len(entries))
+	for _, entry := range entries {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   entry.source,
+			Target:   entry.target,
+			ReadOnly: entry.target != "/var/task",
+		})
+	}
+	return mounts
+}
+
+// codeArchive packs the code into a tar archive to be extracted at the root
+// of the container, for daemons that cannot bind mount files from this
+// machine
+func codeArchive(entries []codeEntry) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, entry := range entries {
+		if err := addTree(tw, entry.source, entry.target); err != nil {
+			return nil, fmt.Errorf("archiving %s: %w", entry.source, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("closing archive: %w", err)
+	}
+	return buf, nil
+}
+
+// addTree writes the file or directory tree at source into the archive
+// under target
+func addTree(tw *tar.Writer, source, target string) error {
+	return filepath.Walk(source, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, name)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(target, filepath.ToSlash(rel))[1:]
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
@@ -0,0 +1,148 @@
+package docker
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCodeArchive(t *testing.T) {
+	root := t.TempDir()
+	for name, contents := range map[string]string{
+		"HelloFunction/app.py":               "print('hello')",
+		"HelloFunction/pkg/module.py":        "",
+		"SharedLayer/python/shared.py":       "",
+		"OtherLayer/python/other.py":         "",
+		"OtherLayer/extensions/my-extension": "",
+	} {
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+		// extensions are only started if they are executable
+		mode := os.FileMode(0644)
+		if filepath.Base(filepath.Dir(name)) == "extensions" {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), mode); err != nil {
+			t.Fatalf("writing file: %v", err)
+		}
+	}
+
+	entries, err := codeEntries(filepath.Join(root, "HelloFunction"), []string{
+		filepath.Join(root, "SharedLayer"),
+		filepath.Join(root, "OtherLayer"),
+	}, "", "python3.8")
+	if err != nil {
+		t.Fatalf("finding code: %v", err)
+	}
+
+	archive, err := codeArchive(entries)
+	if err != nil {
+		t.Fatalf("archiving code: %v", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading archive: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+
+	// the python directory of the second layer is shadowed by the first
+	expected := []string{
+		"opt/extensions/my-extension",
+		"opt/python/",
+		"opt/python/shared.py",
+		"var/task/",
+		"var/task/app.py",
+		"var/task/pkg/",
+		"var/task/pkg/module.py",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("invalid archive contents, expected %v found %v", expected, names)
+	}
+}
+
+func TestCodeEntriesDependencies(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"HelloFunction", "Layer/python", "Layer/extensions", "deps"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+	}
+
+	entries, err := codeEntries(filepath.Join(root, "HelloFunction"), []string{filepath.Join(root, "Layer")}, filepath.Join(root, "deps"), "python3.9")
+	if err != nil {
+		t.Fatalf("finding code: %v", err)
+	}
+
+	// the dependencies take the place of the python directory of the layer
+	expected := []codeEntry{
+		{source: filepath.Join(root, "HelloFunction"), target: "/var/task"},
+		{source: filepath.Join(root, "deps"), target: "/opt/python"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("invalid entries, expected %v found %v", expected, entries)
+	}
+
+	entries, err = codeEntries(filepath.Join(root, "HelloFunction"), nil, filepath.Join(root, "deps"), "nodejs14.x")
+	if err != nil {
+		t.Fatalf("finding code: %v", err)
+	}
+	if target := entries[1].target; target != "/opt/nodejs/node_modules" {
+		t.Fatalf("invalid target for nodejs dependencies %s", target)
+	}
+
+	if _, err := codeEntries(filepath.Join(root, "HelloFunction"), nil, filepath.Join(root, "deps"), "go1.x"); err == nil {
+		t.Fatalf("expected an error for an unsupported runtime")
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	root := t.TempDir()
+	for name, mode := range map[string]os.FileMode{
+		"Layer/extensions/secrets":        0755,
+		"Layer/extensions/README":         0644,
+		"OtherLayer/extensions/secrets":   0755,
+		"OtherLayer/extensions/telemetry": 0755,
+	} {
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+		if err := ioutil.WriteFile(name, nil, mode); err != nil {
+			t.Fatalf("writing file: %v", err)
+		}
+	}
+
+	entries, err := codeEntries(filepath.Join(root, "HelloFunction"), []string{
+		filepath.Join(root, "Layer"),
+		filepath.Join(root, "OtherLayer"),
+	}, "", "provided.al2")
+	if err != nil {
+		t.Fatalf("finding code: %v", err)
+	}
+
+	// the extensions of both layers are merged, and the first layer wins
+	expected := []codeEntry{
+		{source: filepath.Join(root, "HelloFunction"), target: "/var/task"},
+		{source: filepath.Join(root, "Layer", "extensions", "secrets"), target: "/opt/extensions/secrets"},
+		{source: filepath.Join(root, "OtherLayer", "extensions", "telemetry"), target: "/opt/extensions/telemetry"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("invalid entries, expected %v found %v", expected, entries)
+	}
+}
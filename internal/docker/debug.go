@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+const (
+	// debuggerDir is where the debugger binaries are mounted in the container
+	debuggerDir = "/tmp/lambci_debug_files"
+	// debugTimeout replaces the invocation timeout of a function being
+	// debugged
+	debugTimeout = 24 * time.Hour
+)
+
+// DebugConfig starts a container with a debug agent listening for a
+// debugger to attach
+type DebugConfig struct {
+	// Port is the port the debug agent listens on, published on the same
+	// host port
+	Port int
+	// Wait makes the function wait for the debugger to attach before
+	// running the handler
+	Wait bool
+	// DebuggerPath is a directory containing the debugger binaries, which
+	// is needed for runtimes without a built in debug agent (dlv for go)
+	DebuggerPath string
+}
+
+// debugSettings describes how a container runs with a debug agent
+type debugSettings struct {
+	// bootstrap replaces the runtime bootstrap as the entrypoint of the
+	// container
+	bootstrap []string
+	env       []string
+	mounts    []mount.Mount
+}
+
+// newDebugSettings works out the runtime specific debug agent
+// configuration, following the conventions of the SAM CLI
+func newDebugSettings(runtime, handler string, cfg DebugConfig) (debugSettings, error) {
+	listen := fmt.Sprintf("0.0.0.0:%d", cfg.Port)
+
+	switch {
+	case strings.HasPrefix(runtime, "python"):
+		// debugpy has to be installed alongside the function code
+		bootstrap := []string{"/var/lang/bin/" + runtime, "-m", "debugpy", "--listen", listen}
+		if cfg.Wait {
+			bootstrap = append(bootstrap, "--wait-for-client")
+		}
+		script := "/var/runtime/bootstrap.py"
+		if runtime == "python3.7" {
+			script = "/var/runtime/bootstrap"
+		}
+		return debugSettings{bootstrap: append(bootstrap, script)}, nil
+
+	case strings.HasPrefix(runtime, "nodejs"):
+		inspect := "--inspect=" + listen
+		if cfg.Wait {
+			inspect = "--inspect-brk=" + listen
+		}
+		script := "/var/runtime/index.mjs"
+		if nodeVersion(runtime) < 18 {
+			script = "/var/runtime/index.js"
+		}
+		return debugSettings{
+			bootstrap: []string{"/var/lang/bin/node", inspect, "--nolazy", "--expose-gc", "--max-http-header-size", "81920", script},
+			env:       []string{"NODE_PATH=/opt/nodejs/node_modules:/opt/nodejs/node14/node_modules:/var/runtime/node_modules"},
+		}, nil
+
+	case strings.HasPrefix(runtime, "java"):
+		suspend := "n"
+		if cfg.Wait {
+			suspend = "y"
+		}
+		address := "*:" + strconv.Itoa(cfg.Port)
+		if strings.HasPrefix(runtime, "java8") {
+			address = strconv.Itoa(cfg.Port)
+		}
+		return debugSettings{
+			env: []string{fmt.Sprintf("_JAVA_OPTIONS=-agentlib:jdwp=transport=dt_socket,server=y,suspend=%s,quiet=y,address=%s -XX:+UseSerialGC -Djava.net.preferIPv4Stack=true", suspend, address)},
+		}, nil
+
+	case runtime == "go1.x" || strings.HasPrefix(runtime, "provided"):
+		if cfg.DebuggerPath == "" {
+			return debugSettings{}, fmt.Errorf("debugging %s needs the directory containing dlv", runtime)
+		}
+		absDebuggerPath, _ := filepath.Abs(cfg.DebuggerPath)
+
+		executable := "/var/task/bootstrap"
+		if runtime == "go1.x" {
+			executable = "/var/task/" + handler
+		}
+		bootstrap := []string{debuggerDir + "/dlv", "--listen=" + listen, "--headless=true", "--api-version=2", "--accept-multiclient"}
+		if !cfg.Wait {
+			bootstrap = append(bootstrap, "--continue")
+		}
+		return debugSettings{
+			bootstrap: append(bootstrap, "exec", executable),
+			mounts: []mount.Mount{
+				{
+					Type:     mount.TypeBind,
+					Source:   absDebuggerPath,
+					Target:   debuggerDir,
+					ReadOnly: true,
+				},
+			},
+		}, nil
+
+	default:
+		return debugSettings{}, fmt.Errorf("debugging is not supported for runtime %s", runtime)
+	}
+}
+
+// nodeVersion returns the major version of a nodejs runtime, e.g. 18 for
+// nodejs18.x
+func nodeVersion(runtime string) int {
+	version := strings.TrimSuffix(strings.TrimPrefix(runtime, "nodejs"), ".x")
+	n, _ := strconv.Atoi(version)
+	return n
+}
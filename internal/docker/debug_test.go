@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDebugSettingsPython(t *testing.T) {
+	settings, err := newDebugSettings("python3.9", "app.handler", DebugConfig{Port: 5858, Wait: true})
+	if err != nil {
+		t.Fatalf("configuring debugger: %v", err)
+	}
+
+	expected := []string{"/var/lang/bin/python3.9", "-m", "debugpy", "--listen", "0.0.0.0:5858", "--wait-for-client", "/var/runtime/bootstrap.py"}
+	if !reflect.DeepEqual(settings.bootstrap, expected) {
+		t.Fatalf("invalid bootstrap, expected %v found %v", expected, settings.bootstrap)
+	}
+}
+
+func TestDebugSettingsNode(t *testing.T) {
+	settings, err := newDebugSettings("nodejs16.x", "app.handler", DebugConfig{Port: 9229})
+	if err != nil {
+		t.Fatalf("configuring debugger: %v", err)
+	}
+	if settings.bootstrap[1] != "--inspect=0.0.0.0:9229" || settings.bootstrap[len(settings.bootstrap)-1] != "/var/runtime/index.js" {
+		t.Fatalf("invalid bootstrap %v", settings.bootstrap)
+	}
+
+	settings, err = newDebugSettings("nodejs18.x", "app.handler", DebugConfig{Port: 9229, Wait: true})
+	if err != nil {
+		t.Fatalf("configuring debugger: %v", err)
+	}
+	if settings.bootstrap[1] != "--inspect-brk=0.0.0.0:9229" || settings.bootstrap[len(settings.bootstrap)-1] != "/var/runtime/index.mjs" {
+		t.Fatalf("invalid bootstrap %v", settings.bootstrap)
+	}
+}
+
+func TestDebugSettingsJava(t *testing.T) {
+	settings, err := newDebugSettings("java11", "app.Handler::handleRequest", DebugConfig{Port: 5005, Wait: true})
+	if err != nil {
+		t.Fatalf("configuring debugger: %v", err)
+	}
+	if len(settings.bootstrap) != 0 || len(settings.env) != 1 || !strings.Contains(settings.env[0], "suspend=y,quiet=y,address=*:5005") {
+		t.Fatalf("invalid settings %+v", settings)
+	}
+}
+
+func TestDebugSettingsGo(t *testing.T) {
+	if _, err := newDebugSettings("go1.x", "hello", DebugConfig{Port: 5986}); err == nil {
+		t.Fatalf("debugging go should need the path to dlv")
+	}
+
+	settings, err := newDebugSettings("go1.x", "hello", DebugConfig{Port: 5986, DebuggerPath: "/home/me/go/bin"})
+	if err != nil {
+		t.Fatalf("configuring debugger: %v", err)
+	}
+	if settings.bootstrap[len(settings.bootstrap)-1] != "/var/task/hello" || len(settings.mounts) != 1 || settings.mounts[0].Target != debuggerDir {
+		t.Fatalf("invalid settings %+v", settings)
+	}
+}
+
+func TestDebugSettingsUnsupported(t *testing.T) {
+	if _, err := newDebugSettings("ruby2.7", "app.handler", DebugConfig{Port: 5858}); err == nil {
+		t.Fatalf("expected error for unsupported runtime")
+	}
+}
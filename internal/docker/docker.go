@@ -7,22 +7,36 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
+	"net"
+	"net/url"
 	"os"
-	"path/filepath"
+	goruntime "runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
+	"github.com/mindriot101/lambda-local-runner/internal/runtimeapi"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog/log"
 )
 
 const samVersion = "1.38.1"
 
+const (
+	// readyTimeout is how long the runtime in a container has to initialise
+	readyTimeout = 30 * time.Second
+	// logTailLines is the number of lines of container output included in
+	// start up errors
+	logTailLines = 20
+)
+
 // dockerclient represents the functions that we rely on from the docker API
 type dockerclient interface {
 	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error)
@@ -31,6 +45,14 @@ type dockerclient interface {
 	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
 	ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error)
 	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
+	ImageRemove(ctx context.Context, imageID string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+	NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+	ContainerTop(ctx context.Context, containerID string, arguments []string) (container.ContainerTopOKBody, error)
+	DaemonHost() string
 }
 
 type RunArgs struct {
@@ -42,214 +64,739 @@ type RunArgs struct {
 
 type Client struct {
 	cli dockerclient
+
+	mu sync.Mutex
+	// images caches the built image names by runtime and architecture
+	images map[string]string
+
+	// inContainer is set if this program is itself running in a docker
+	// container, where the docker host is not this machine
+	inContainer bool
+	// remoteHost is the host name of the docker daemon if it is on another
+	// machine. The code is then copied into containers rather than mounted.
+	remoteHost string
+	// session labels the containers created by this client
+	session session
+
+	// runtimes holds the runtime API of each container, by container ID
+	runtimesMu sync.Mutex
+	runtimes   map[string]*runtimeapi.Server
+	// listenHost and apiHost are where the runtime APIs listen and the host
+	// the containers reach them on
+	hostsOnce  sync.Once
+	listenHost string
+	apiHost    string
+	hostsErr   error
 }
 
 func New(cli dockerclient) *Client {
+	_, err := os.Stat("/.dockerenv")
+	remoteHost := daemonRemoteHost(cli.DaemonHost())
+	if remoteHost != "" {
+		log.Debug().Str("host", remoteHost).Msg("docker daemon is remote, copying code into containers")
+	}
+
 	return &Client{
-		cli,
+		cli:         cli,
+		images:      make(map[string]string),
+		inContainer: err == nil,
+		remoteHost:  remoteHost,
+		session:     newSession(),
+		runtimes:    make(map[string]*runtimeapi.Server),
+	}
+}
+
+// daemonRemoteHost returns the host name of the docker daemon from its
+// address, or an empty string if the daemon runs on this machine
+func daemonRemoteHost(daemonHost string) string {
+	u, err := url.Parse(daemonHost)
+	if err != nil {
+		return ""
+	}
+
+	switch u.Scheme {
+	case "tcp", "http", "https", "ssh":
+	default:
+		// unix sockets and named pipes are always local
+		return ""
+	}
+
+	switch host := u.Hostname(); host {
+	case "", "localhost", "127.0.0.1", "::1":
+		return ""
+	default:
+		return host
 	}
 }
 
 type RunContainerArgs struct {
 	ContainerName string
 	ImageName     string
-	Handler       string
-	SourcePath    string
-	Port          int
+	// FunctionName is reported to the function as AWS_LAMBDA_FUNCTION_NAME
+	FunctionName string
+	// Architecture is the lambda architecture, either x86_64 or arm64
+	Architecture string
+	Handler      string
+	SourcePath   string
+	// LayerPaths are the directories of the layers used by the function,
+	// which are merged into /opt in order
+	LayerPaths []string
+	// DependenciesPath is a directory of packages for the function, e.g. a
+	// virtualenv's site-packages, placed where the runtime finds packages
+	// from layers
+	DependenciesPath string
+	// Port is the port the runtime API of the container listens on. A free
+	// port is used if it is 0.
+	Port int
+	// Network is the docker network the container is attached to, instead
+	// of the default bridge network
+	Network string
+	// Runtime is the lambda runtime, e.g. python3.9, used to configure the
+	// debug agent
+	Runtime string
+	// Env are extra environment variables for the function, e.g. AWS
+	// credentials
+	Env []string
+	// Debug starts the container with a debug agent if set
+	Debug *DebugConfig
+	// Timeout and MemorySize are the settings of the function in the
+	// template, with the lambda defaults used if they are 0
+	Timeout    time.Duration
+	MemorySize int
+}
+
+// FunctionTimeout returns the timeout of the function
+func (a RunContainerArgs) FunctionTimeout() time.Duration {
+	if a.Timeout <= 0 {
+		return runtimeapi.DefaultTimeout
+	}
+	return a.Timeout
+}
+
+// FunctionMemorySize returns the memory size of the function in MB
+func (a RunContainerArgs) FunctionMemorySize() int {
+	if a.MemorySize <= 0 {
+		return runtimeapi.DefaultMemorySize
+	}
+	return a.MemorySize
+}
+
+// RunningContainer identifies a started container
+type RunningContainer struct {
+	ID string
+	// Port is the port the runtime API of the container listens on
+	Port int
+	// Addr is the address (host:port) invocations are sent to
+	Addr string
 }
 
-func (c *Client) RunContainer(ctx context.Context, args RunContainerArgs) (string, error) {
+// dockerHost is the name containers reach this machine on, unless it is in a
+// container itself or the docker daemon is remote
+const dockerHost = "host.docker.internal"
+
+// sandboxHostname is the host name extensions listen on in lambda
+const sandboxHostname = "sandbox.localdomain"
+
+// bootstrapScript starts the extensions in /opt/extensions, then the runtime
+// from the first bootstrap found, in the same order as the runtime interface
+// emulator
+const bootstrapScript = `for extension in /opt/extensions/*; do
+	if [ -f "$extension" ] && [ -x "$extension" ]; then "$extension" & fi
+done
+for bootstrap in /var/runtime/bootstrap /var/task/bootstrap /opt/bootstrap; do
+	if [ -x "$bootstrap" ]; then exec "$bootstrap"; fi
+done
+echo "no bootstrap found in /var/runtime, /var/task or /opt" >&2
+exit 127`
+
+func (c *Client) RunContainer(ctx context.Context, args RunContainerArgs) (RunningContainer, error) {
+	listenHost, apiHost, err := c.runtimeAPIHosts(ctx)
+	if err != nil {
+		return RunningContainer{}, err
+	}
+
+	extensions, err := Extensions(args.LayerPaths)
+	if err != nil {
+		return RunningContainer{}, err
+	}
+
+	timeout := args.FunctionTimeout()
+	var debug debugSettings
+	if args.Debug != nil {
+		// the function may be paused in the debugger for as long as it takes
+		timeout = debugTimeout
+		debug, err = newDebugSettings(args.Runtime, args.Handler, *args.Debug)
+		if err != nil {
+			return RunningContainer{}, fmt.Errorf("configuring debugger: %w", err)
+		}
+		// the extensions are started by the bootstrap script, which a
+		// debug agent replaces
+		if len(debug.bootstrap) > 0 {
+			extensions = nil
+		}
+	}
+
+	api, err := runtimeapi.Listen(net.JoinHostPort(listenHost, strconv.Itoa(args.Port)), runtimeapi.Config{
+		FunctionName: args.FunctionName,
+		Region:       EnvValue(args.Env, "AWS_REGION"),
+		MemorySize:   args.FunctionMemorySize(),
+		Timeout:      timeout,
+		Handler:      args.Handler,
+		Extensions:   ExtensionNames(extensions),
+	})
+	if err != nil {
+		return RunningContainer{}, fmt.Errorf("starting runtime API: %w", err)
+	}
+
 	// create the container
-	hPort := strconv.Itoa(args.Port)
-	cPort := "8080"
 	config := &container.Config{
-		Image: args.ImageName,
-		ExposedPorts: nat.PortSet{
-			nat.Port(cPort): {},
-		},
-		Cmd: []string{"/var/aws-lambda-rie", "--log-level", "debug"},
-		Env: []string{
-			"AWS_LAMBDA_FUNCTION_VERSION=$LATEST",
-			fmt.Sprintf("AWS_LAMBDA_FUNCTION_HANDLER=%s", args.Handler),
-			"AWS_LAMBDA_FUNCTION_NAME=HelloWorldFunction",
-			"AWS_LAMBDA_FUNCTION_MEMORY_SIZE=128",
-		},
+		Image:      args.ImageName,
+		Entrypoint: []string{"/bin/sh", "-c", bootstrapScript},
+		// extensions receive telemetry on sandbox.localdomain, which
+		// resolves to the container's own address
+		Hostname: sandboxHostname,
+		Labels:   c.session.containerLabels(args.FunctionName),
+		Env:      LambdaEnv(args, net.JoinHostPort(apiHost, strconv.Itoa(api.Port())), timeout),
+	}
+
+	code, err := codeEntries(args.SourcePath, args.LayerPaths, args.DependenciesPath, args.Runtime)
+	if err != nil {
+		api.Close()
+		return RunningContainer{}, fmt.Errorf("finding function code: %w", err)
+	}
+	hostConfig := &container.HostConfig{}
+	if apiHost == dockerHost {
+		hostConfig.ExtraHosts = []string{dockerHost + ":host-gateway"}
+	}
+	// a remote daemon cannot see the files on this machine, so the code is
+	// copied in once the container has been created
+	if c.remoteHost == "" {
+		hostConfig.Mounts = codeMounts(code)
 	}
 
-	absSourcePath, _ := filepath.Abs(args.SourcePath)
-	hostConfig := &container.HostConfig{
-		PortBindings: nat.PortMap{
-			nat.Port(cPort): []nat.PortBinding{
+	if args.Debug != nil {
+		// loopback on a remote daemon is not reachable from here
+		hostIP := "127.0.0.1"
+		if c.remoteHost != "" {
+			hostIP = "0.0.0.0"
+		}
+		debugPort := nat.Port(fmt.Sprintf("%d/tcp", args.Debug.Port))
+		config.ExposedPorts = nat.PortSet{debugPort: {}}
+		hostConfig.PortBindings = nat.PortMap{
+			debugPort: []nat.PortBinding{
 				{
-					HostIP:   "0.0.0.0",
-					HostPort: hPort,
+					HostIP:   hostIP,
+					HostPort: strconv.Itoa(args.Debug.Port),
 				},
 			},
-		},
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: absSourcePath,
-				Target: "/var/task",
+		}
+		if len(debug.bootstrap) > 0 {
+			config.Entrypoint = debug.bootstrap
+		}
+		config.Env = append(config.Env, debug.env...)
+		hostConfig.Mounts = append(hostConfig.Mounts, debug.mounts...)
+	}
+
+	var networkingConfig *network.NetworkingConfig
+	if args.Network != "" {
+		hostConfig.NetworkMode = container.NetworkMode(args.Network)
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				args.Network: {},
 			},
-		},
+		}
 	}
 
 	log.Debug().Msg("creating container")
-	resp, err := c.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, args.ContainerName)
+	resp, err := c.cli.ContainerCreate(ctx, config, hostConfig, networkingConfig, platform(args.Architecture), args.ContainerName)
 	if err != nil {
-		return "", fmt.Errorf("creating container: %w", err)
+		api.Close()
+		return RunningContainer{}, fmt.Errorf("creating container: %w", err)
 	}
+	c.runtimesMu.Lock()
+	c.runtimes[resp.ID] = api
+	c.runtimesMu.Unlock()
+
+	// the caller only gets the container ID on success, so the container
+	// has to be cleaned up here if it cannot be started
+	cleanup := func() {
+		if err := c.RemoveContainer(context.Background(), resp.ID); err != nil {
+			log.Warn().Err(err).Str("container_id", resp.ID).Msg("could not remove container that failed to start")
+		}
+	}
+
+	if c.remoteHost != "" {
+		if err := c.copyCode(ctx, resp.ID, code); err != nil {
+			cleanup()
+			return RunningContainer{}, fmt.Errorf("copying function code: %w", err)
+		}
+	}
+
+	// only a daemon on this linux machine, or its network when this
+	// program runs in a container, routes to the containers
+	reachable := c.remoteHost == "" && (c.inContainer || goruntime.GOOS == "linux")
+	if len(extensions) > 0 && !reachable {
+		api.SetUnreachable("as the containers cannot be reached from this machine with Docker Desktop or a remote docker daemon")
+	}
+
 	// start the container
 	log.Debug().Str("container_id", resp.ID).Msg("starting container")
 	if err := c.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		return "", fmt.Errorf("starting container: %w", err)
+		cleanup()
+		return RunningContainer{}, fmt.Errorf("starting container: %w", err)
 	}
 
-	log.Debug().Str("container_id", resp.ID).Msg("waiting for container to start")
-	if err := c.containerWait(ctx, resp.ID); err != nil {
-		return "", fmt.Errorf("waiting for container: %w", err)
+	if len(extensions) > 0 && reachable {
+		if ip := c.containerIP(ctx, resp.ID); ip != "" {
+			api.SetSandboxHost(ip)
+		}
 	}
 
-	return resp.ID, nil
+	// a function waiting for a debugger only initialises once it attaches
+	ready := api.Ready()
+	if args.Debug != nil && args.Debug.Wait {
+		ready = nil
+	}
+	log.Debug().Str("container_id", resp.ID).Int("port", api.Port()).Msg("waiting for container to be ready")
+	if err := c.containerWait(ctx, resp.ID, ready); err != nil {
+		// checked before the container and its runtime API are removed
+		pending := api.InitPending()
+		cleanup()
+		if pending != "" {
+			return RunningContainer{}, fmt.Errorf("waiting for container (still waiting for %s): %w", pending, err)
+		}
+		return RunningContainer{}, fmt.Errorf("waiting for container: %w", err)
+	}
+	if err := api.InitError(); err != nil {
+		cleanup()
+		return RunningContainer{}, fmt.Errorf("initialising function: %w", err)
+	}
 
-	// wait for the container to exit
-	// log.Debug().Msg("waiting for container")
-	// resC, errC := c.cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	return RunningContainer{
+		ID:   resp.ID,
+		Port: api.Port(),
+		// the runtime API only listens on one interface
+		Addr: net.JoinHostPort(listenHost, strconv.Itoa(api.Port())),
+	}, nil
+}
+
+// copyCode uploads the function code into a created container
+func (c *Client) copyCode(ctx context.Context, containerID string, code []codeEntry) error {
+	archive, err := codeArchive(code)
+	if err != nil {
+		return err
+	}
 
-	// // TODO: optionally print container logs
+	log.Debug().Str("container_id", containerID).Int("bytes", archive.Len()).Msg("copying code into container")
+	return c.cli.CopyToContainer(ctx, containerID, "/", archive, types.CopyToContainerOptions{})
+}
 
-	// for {
-	// 	select {
-	// 	case msg := <-resC:
-	// 		log.Debug().Interface("msg", msg).Msg("received message")
-	// 	case err := <-errC:
-	// 		if err != nil && !errors.Is(err, context.Canceled) {
-	// 			return "", fmt.Errorf("waiting for container: %w", err)
-	// 		}
-	// 	}
-	// }
+// runtimeAPIHosts returns the address the runtime APIs listen on, and the
+// host the containers reach them on. They are worked out once per client.
+// The runtime APIs only listen on the interface the containers reach, so
+// they are not exposed to the rest of the network.
+func (c *Client) runtimeAPIHosts(ctx context.Context) (string, string, error) {
+	c.hostsOnce.Do(func() {
+		c.listenHost, c.apiHost, c.hostsErr = c.findRuntimeAPIHosts(ctx)
+		if c.hostsErr == nil {
+			log.Debug().Str("listen", c.listenHost).Str("host", c.apiHost).Msg("serving the runtime API")
+		}
+	})
+	return c.listenHost, c.apiHost, c.hostsErr
 }
 
-func (c *Client) containerWait(ctx context.Context, containerID string) error {
+func (c *Client) findRuntimeAPIHosts(ctx context.Context) (string, string, error) {
+	switch {
+	case c.remoteHost != "":
+		// the daemon reaches this machine on the address used to reach the
+		// daemon. Dialing UDP sends nothing.
+		conn, err := net.Dial("udp", net.JoinHostPort(c.remoteHost, "9"))
+		if err != nil {
+			return "", "", fmt.Errorf("finding the local address of the docker daemon's network: %w", err)
+		}
+		defer conn.Close()
+		ip := conn.LocalAddr().(*net.UDPAddr).IP.String()
+		return ip, ip, nil
+
+	case c.inContainer:
+		// the containers are on a docker network with this one
+		hostname, _ := os.Hostname()
+		addrs, err := net.LookupHost(hostname)
+		if err != nil {
+			return "", "", fmt.Errorf("finding the address of this container: %w", err)
+		}
+		return addrs[0], addrs[0], nil
+
+	case goruntime.GOOS != "linux":
+		// docker desktop forwards the docker host to the loopback interface
+		return "127.0.0.1", dockerHost, nil
+
+	default:
+		// the docker host is the gateway of the default bridge network,
+		// which containers on other networks can reach too
+		res, err := c.cli.NetworkInspect(ctx, "bridge", types.NetworkInspectOptions{})
+		if err != nil {
+			return "", "", fmt.Errorf("finding the gateway of the bridge network: %w", err)
+		}
+		if len(res.IPAM.Config) == 0 || res.IPAM.Config[0].Gateway == "" {
+			return "", "", fmt.Errorf("the bridge network has no gateway")
+		}
+		return res.IPAM.Config[0].Gateway, dockerHost, nil
+	}
+}
+
+// containerIP returns the address of a container on its network, or an empty
+// string if it cannot be found
+func (c *Client) containerIP(ctx context.Context, containerID string) string {
+	res, err := c.cli.ContainerInspect(ctx, containerID)
+	if err != nil || res.NetworkSettings == nil {
+		log.Debug().Err(err).Str("container_id", containerID).Msg("could not find the container address")
+		return ""
+	}
+
+	if ip := res.NetworkSettings.IPAddress; ip != "" {
+		return ip
+	}
+	for _, endpoint := range res.NetworkSettings.Networks {
+		if endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress
+		}
+	}
+	return ""
+}
+
+// waitExtensions waits until the extensions in the container have exited, or
+// the deadline passes
+func (c *Client) waitExtensions(ctx context.Context, containerID string, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	for {
+		top, err := c.cli.ContainerTop(ctx, containerID, nil)
+		if err != nil {
+			// the container has stopped, or the deadline has passed
+			return
+		}
+		if !runningExtensions(top) {
+			return
+		}
+
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			log.Debug().Str("container_id", containerID).Msg("extensions did not exit before the shutdown deadline")
+			return
+		}
+	}
+}
+
+// runningExtensions checks whether any of the processes in a container are
+// extensions
+func runningExtensions(top container.ContainerTopOKBody) bool {
+	column := -1
+	for i, title := range top.Titles {
+		if title == "CMD" || title == "COMMAND" {
+			column = i
+		}
+	}
+	if column < 0 {
+		return false
+	}
+
+	for _, process := range top.Processes {
+		if column < len(process) && strings.Contains(process[column], "/opt/extensions/") {
+			return true
+		}
+	}
+	return false
+}
+
+// runtime returns the runtime API of a container
+func (c *Client) runtime(containerID string) (*runtimeapi.Server, bool) {
+	c.runtimesMu.Lock()
+	defer c.runtimesMu.Unlock()
+
+	api, ok := c.runtimes[containerID]
+	return api, ok
+}
+
+// LambdaEnv returns the environment lambda gives the runtime of the function,
+// followed by the extra variables of the function
+func LambdaEnv(args RunContainerArgs, runtimeAPI string, timeout time.Duration) []string {
+	env := []string{
+		fmt.Sprintf("AWS_LAMBDA_RUNTIME_API=%s", runtimeAPI),
+		"AWS_LAMBDA_FUNCTION_VERSION=$LATEST",
+		fmt.Sprintf("AWS_LAMBDA_FUNCTION_HANDLER=%s", args.Handler),
+		fmt.Sprintf("_HANDLER=%s", args.Handler),
+		fmt.Sprintf("AWS_LAMBDA_FUNCTION_NAME=%s", args.FunctionName),
+		fmt.Sprintf("AWS_LAMBDA_FUNCTION_MEMORY_SIZE=%d", args.FunctionMemorySize()),
+		fmt.Sprintf("AWS_LAMBDA_FUNCTION_TIMEOUT=%d", int(timeout.Seconds())),
+		fmt.Sprintf("AWS_LAMBDA_LOG_GROUP_NAME=/aws/lambda/%s", args.FunctionName),
+		"AWS_LAMBDA_LOG_STREAM_NAME=$LATEST",
+	}
+	return append(env, args.Env...)
+}
+
+// EnvValue returns the value of a variable in a list of NAME=value pairs
+func EnvValue(env []string, name string) string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return strings.TrimPrefix(kv, name+"=")
+		}
+	}
+	return ""
+}
+
+// containerWait waits until the runtime in the container is ready, backing
+// off between checks of the container. A nil ready channel only waits for
+// the container to be running. If the container exits or does not become
+// ready in time, the error includes the end of its output.
+func (c *Client) containerWait(ctx context.Context, containerID string, ready <-chan struct{}) error {
 	logger := log.With().Str("container_id", containerID).Logger()
+
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	backoff := 50 * time.Millisecond
 	for {
 		res, err := c.cli.ContainerInspect(ctx, containerID)
 		if err != nil {
-			return fmt.Errorf("waiting for container: %w", err)
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("lambda runtime not ready after %s%s", readyTimeout, c.logTail(containerID))
+			}
+			return fmt.Errorf("inspecting container: %w", err)
 		}
+
 		switch res.State.Status {
 		case "running":
-			logger.Debug().Msg("container running")
-			return nil
-		case "removing", "exiting", "dead":
-			logger.Fatal().Msg("container failed to start")
-			return fmt.Errorf("container start failed with state %s", res.State.Status)
+			if ready == nil {
+				logger.Debug().Msg("container running")
+				return nil
+			}
+			logger.Trace().Msg("lambda runtime not ready yet")
+		case "removing", "exited", "dead":
+			return fmt.Errorf("container exited with code %d before it was ready%s", res.State.ExitCode, c.logTail(containerID))
 		default:
 		}
+
+		select {
+		case <-ready:
+			logger.Debug().Msg("container ready")
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("lambda runtime not ready after %s%s", readyTimeout, c.logTail(containerID))
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+	}
+}
+
+// logTail returns the last lines of the container output, formatted to be
+// appended to an error message
+func (c *Client) logTail(containerID string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var out bytes.Buffer
+	if err := c.Logs(ctx, containerID, &out, &out); err != nil || out.Len() == 0 {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	if len(lines) > logTailLines {
+		lines = lines[len(lines)-logTailLines:]
+	}
+	return ", container output:\n" + strings.Join(lines, "\n")
+}
+
+// ExitStatus describes how a container stopped
+type ExitStatus struct {
+	// ExitCode is the exit code of the container process, or -1 if it is
+	// not known
+	ExitCode int64 `json:"exit_code"`
+	// OOMKilled is set if the container was killed for running out of memory
+	OOMKilled bool `json:"oom_killed"`
+}
+
+// WaitContainer blocks until the container stops running and reports how it
+// exited
+func (c *Client) WaitContainer(ctx context.Context, containerID string) (ExitStatus, error) {
+	status := ExitStatus{ExitCode: -1}
+
+	resC, errC := c.cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case res := <-resC:
+		status.ExitCode = res.StatusCode
+	case err := <-errC:
+		return status, fmt.Errorf("waiting for container: %w", err)
+	}
+
+	// the container may already have been removed, in which case the OOM
+	// flag is not available
+	res, err := c.cli.ContainerInspect(ctx, containerID)
+	if err == nil && res.ContainerJSONBase != nil && res.State != nil {
+		status.OOMKilled = res.State.OOMKilled
 	}
+	return status, nil
 }
 
+// RemoveContainer removes the container, after giving its extensions the
+// chance to shut down
 func (c *Client) RemoveContainer(ctx context.Context, containerID string) error {
+	if api, ok := c.runtime(containerID); ok {
+		if deadline := api.Shutdown(); !deadline.IsZero() {
+			c.waitExtensions(ctx, containerID, deadline)
+		}
+	}
+
 	log.Debug().Str("container_id", containerID).Msg("removing container")
 	if err := c.cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{
 		Force: true,
 	}); err != nil {
 		return fmt.Errorf("removing container: %w", err)
 	}
+
+	c.runtimesMu.Lock()
+	api, ok := c.runtimes[containerID]
+	delete(c.runtimes, containerID)
+	c.runtimesMu.Unlock()
+	if ok {
+		api.Close()
+	}
+	return nil
+}
+
+// Logs copies the output the container has produced so far into the given
+// writers
+func (c *Client) Logs(ctx context.Context, containerID string, stdout, stderr io.Writer) error {
+	log.Debug().Str("container_id", containerID).Msg("fetching container logs")
+	rc, err := c.cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return fmt.Errorf("fetching container logs: %w", err)
+	}
+	defer rc.Close()
+
+	if _, err := stdcopy.StdCopy(stdout, stderr, rc); err != nil {
+		return fmt.Errorf("copying container logs: %w", err)
+	}
+	if api, ok := c.runtime(containerID); ok {
+		api.CopyLogs(stdout)
+	}
 	return nil
 }
 
-// BuildImage builds a docker image
+// StreamLogs follows the output of the container, copying it into the given
+// writers until the container stops or the context is cancelled. The
+// START, END and REPORT lines of invocations are written to stdout.
+func (c *Client) StreamLogs(ctx context.Context, containerID string, stdout, stderr io.Writer) error {
+	log.Debug().Str("container_id", containerID).Msg("streaming container logs")
+	if api, ok := c.runtime(containerID); ok {
+		api.SetLogs(stdout)
+		// the output is also sent to extensions subscribed to the logs
+		output := api.Output()
+		stdout = io.MultiWriter(stdout, output)
+		stderr = io.MultiWriter(stderr, output)
+	}
+	rc, err := c.cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("fetching container logs: %w", err)
+	}
+	defer rc.Close()
+
+	if _, err := stdcopy.StdCopy(stdout, stderr, rc); err != nil {
+		return fmt.Errorf("copying container logs: %w", err)
+	}
+	return nil
+}
+
+// BuildImage builds the docker image for the given lambda runtime and
+// architecture. Images are only built once per runtime and architecture, and
+// subsequent calls return the previously built image.
 //
 // https://stackoverflow.com/a/46518557
-func (c *Client) BuildImage(ctx context.Context) (string, error) {
-	// FIXME: hardcoding
-	platform := "x86_64"
-	riePath, err := fetchRIE(platform)
-	if err != nil {
-		return "", fmt.Errorf("fetching lambda RIE: %w", err)
+func (c *Client) BuildImage(ctx context.Context, runtime, architecture string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := fmt.Sprintf("%s-%s", runtime, architecture)
+	if imageName, ok := c.images[key]; ok {
+		log.Debug().Str("image", imageName).Msg("using previously built image")
+		return imageName, nil
 	}
-	// FIXME: hardcoding runtime
-	dockerfileSrc := fmt.Sprintf(`
-FROM  public.ecr.aws/sam/emulation-python3.8:latest
 
-COPY aws-lambda-rie /var/aws-lambda-rie
-	`)
+	tag := "latest"
+	if architecture == "arm64" {
+		tag = "latest-arm64"
+	}
+	dockerfileSrc := fmt.Sprintf(`
+FROM  public.ecr.aws/sam/emulation-%s:%s
+	`, runtime, tag)
 
 	buf := new(bytes.Buffer)
 	tw := tar.NewWriter(buf)
-	defer tw.Close()
 
 	// write dockerfile
-	writeTarEntry(tw, "Dockerfile", []byte(dockerfileSrc), 0o655)
+	if err := writeTarEntry(tw, "Dockerfile", []byte(dockerfileSrc), 0o655); err != nil {
+		return "", fmt.Errorf("writing dockerfile: %w", err)
+	}
 
-	// write aws-lambda-rie
-	lambdaRIESrc, err := ioutil.ReadFile(riePath)
-	if err != nil {
-		return "", fmt.Errorf("reading rie contents: %w", err)
+	if err := tw.Close(); err != nil {
+		return "", fmt.Errorf("closing build context: %w", err)
 	}
-	writeTarEntry(tw, "aws-lambda-rie", lambdaRIESrc, 0o777)
 
 	buildContext := bytes.NewReader(buf.Bytes())
 
-	imageName := fmt.Sprintf("lambda-local-runner-%s:latest", platform)
+	imageName := fmt.Sprintf("lambda-local-runner-%s:latest", key)
+	log.Debug().Str("image", imageName).Msg("building image")
+	var buildPlatform string
+	if p := platform(architecture); p != nil {
+		buildPlatform = fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
 	res, err := c.cli.ImageBuild(ctx, buildContext, types.ImageBuildOptions{
 		Tags:       []string{imageName},
 		Context:    buildContext,
 		Dockerfile: "Dockerfile",
 		Remove:     true,
 		PullParent: true,
+		Platform:   buildPlatform,
+		Labels: map[string]string{
+			labelManaged: "true",
+		},
 	})
 	if err != nil {
 		return "", fmt.Errorf("building image: %w", err)
 	}
 	defer res.Body.Close()
-	_, _ = io.Copy(ioutil.Discard, res.Body)
-	if err != nil {
-		return "", fmt.Errorf("printing build command output: %w", err)
+	// pull and build failures are reported in the output rather than by
+	// ImageBuild
+	if err := jsonmessage.DisplayJSONMessagesStream(res.Body, ioutil.Discard, 0, false, nil); err != nil {
+		return "", fmt.Errorf("building image: %w", err)
 	}
 
+	c.images[key] = imageName
 	return imageName, nil
 }
 
-const rieAMD64Url = "https://github.com/aws/aws-lambda-runtime-interface-emulator/releases/latest/download/aws-lambda-rie"
-const rieARM64Url = "https://github.com/aws/aws-lambda-runtime-interface-emulator/releases/latest/download/aws-lambda-rie-arm64"
-
-func fetchRIE(platform string) (string, error) {
-	var url string
-	switch platform {
-	case "x86_64":
-		url = rieAMD64Url
+// platform converts a lambda architecture into the docker platform to run
+// it on. A nil platform means the daemon default.
+func platform(architecture string) *specs.Platform {
+	switch architecture {
 	case "arm64":
-		url = rieARM64Url
+		return &specs.Platform{OS: "linux", Architecture: "arm64"}
+	case "x86_64":
+		return &specs.Platform{OS: "linux", Architecture: "amd64"}
 	default:
-		return "", fmt.Errorf("unsupported platform %s", platform)
-	}
-	cacheLocation := fmt.Sprintf("/tmp/aws-lambda-rie-%s", platform)
-
-	logger := log.With().Str("src", url).Str("dest", cacheLocation).Logger()
-
-	logger.Debug().Msg("fetching file")
-
-	info, err := os.Stat(cacheLocation)
-	if err == nil {
-		logger.Debug().Msg("entry exists")
-		if !info.IsDir() {
-			logger.Debug().Msg("cached file found")
-			return cacheLocation, nil
-		}
-
-		return "", fmt.Errorf("cahce location %s is a directory", cacheLocation)
-	}
-
-	// file does not exist so fetch
-	logger.Debug().Msg("fetching remote file")
-	if err = fetchFile(cacheLocation, rieAMD64Url); err != nil {
-		return "", fmt.Errorf("fetching file: %w", err)
+		return nil
 	}
-
-	return cacheLocation, nil
 }
 
 func writeTarEntry(tarfile *tar.Writer, name string, contents []byte, mode int64) error {
@@ -265,22 +812,3 @@ func writeTarEntry(tarfile *tar.Writer, name string, contents []byte, mode int64
 	}
 	return nil
 }
-
-func fetchFile(filepath, url string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("making http request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		return fmt.Errorf("creating filepath %s: %w", filepath, err)
-	}
-	defer out.Close()
-
-	if _, err := io.Copy(out, resp.Body); err != nil {
-		return fmt.Errorf("copying file contents: %w", err)
-	}
-	return nil
-}
@@ -0,0 +1,203 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeClient reports a fixed container state and output
+type fakeClient struct {
+	dockerclient
+
+	inspect types.ContainerJSON
+	output  string
+}
+
+func (f *fakeClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return f.inspect, nil
+}
+
+func (f *fakeClient) ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	w := stdcopy.NewStdWriter(&buf, stdcopy.Stderr)
+	w.Write([]byte(f.output))
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (f *fakeClient) DaemonHost() string {
+	return "unix:///var/run/docker.sock"
+}
+
+func TestContainerWaitExited(t *testing.T) {
+	c := New(&fakeClient{
+		inspect: types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				State: &types.ContainerState{
+					Status:   "exited",
+					ExitCode: 2,
+				},
+			},
+		},
+		output: "Traceback (most recent call last):\nImportError: no module named app\n",
+	})
+
+	err := c.containerWait(context.Background(), "containerID", make(chan struct{}))
+	if err == nil {
+		t.Fatalf("exited container should not be ready")
+	}
+
+	msg := err.Error()
+	if !strings.Contains(msg, "exited with code 2") || !strings.Contains(msg, "ImportError: no module named app") {
+		t.Fatalf("error should include the exit code and container output, found %q", msg)
+	}
+}
+
+func TestDaemonRemoteHost(t *testing.T) {
+	tests := []struct {
+		daemonHost string
+		expected   string
+	}{
+		{"unix:///var/run/docker.sock", ""},
+		{"npipe:////./pipe/docker_engine", ""},
+		{"tcp://localhost:2375", ""},
+		{"tcp://127.0.0.1:2376", ""},
+		{"tcp://docker:2375", "docker"},
+		{"ssh://user@build-server", "build-server"},
+	}
+	for _, test := range tests {
+		if got := daemonRemoteHost(test.daemonHost); got != test.expected {
+			t.Fatalf("%s: expected %q found %q", test.daemonHost, test.expected, got)
+		}
+	}
+}
+
+func TestSessionStale(t *testing.T) {
+	s := session{id: "current", hostname: "laptop", pid: os.Getpid()}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected bool
+	}{
+		{"current session", s.containerLabels("Fn"), false},
+		{"other machine", map[string]string{labelSession: "old", labelHostname: "ci", labelPID: "999999999"}, false},
+		{"live process", map[string]string{labelSession: "old", labelHostname: "laptop", labelPID: strconv.Itoa(os.Getpid())}, false},
+		{"dead process", map[string]string{labelSession: "old", labelHostname: "laptop", labelPID: "999999999"}, true},
+	}
+	for _, test := range tests {
+		if got := s.stale(test.labels); got != test.expected {
+			t.Fatalf("%s: expected stale=%v", test.name, test.expected)
+		}
+	}
+}
+
+// runClient runs containers whose runtime asks the runtime API on the
+// gateway of the bridge network for an event
+type runClient struct {
+	*fakeClient
+
+	gateway string
+	env     []string
+}
+
+func (r *runClient) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return types.NetworkResource{IPAM: network.IPAM{Config: []network.IPAMConfig{{Gateway: r.gateway}}}}, nil
+}
+
+func (r *runClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, containerName string) (container.ContainerCreateCreatedBody, error) {
+	r.env = config.Env
+	return container.ContainerCreateCreatedBody{ID: "containerID"}, nil
+}
+
+func (r *runClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	_, port, err := net.SplitHostPort(EnvValue(r.env, "AWS_LAMBDA_RUNTIME_API"))
+	if err != nil {
+		return err
+	}
+	// the runtime reaches the docker host on the gateway
+	go http.Get("http://" + net.JoinHostPort(r.gateway, port) + "/2018-06-01/runtime/invocation/next")
+	return nil
+}
+
+func (r *runClient) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	return nil
+}
+
+func TestRunContainerListensOnGateway(t *testing.T) {
+	if goruntime.GOOS != "linux" {
+		t.Skip("the runtime API only listens on the bridge gateway on linux")
+	}
+
+	cli := &runClient{
+		fakeClient: &fakeClient{inspect: types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "running"}},
+		}},
+		// a loopback address other than 127.0.0.1 stands in for the gateway
+		gateway: "127.0.0.2",
+	}
+	c := New(cli)
+	c.inContainer = false
+
+	running, err := c.RunContainer(context.Background(), RunContainerArgs{
+		FunctionName: "Function",
+		SourcePath:   t.TempDir(),
+		Runtime:      "python3.9",
+		Timeout:      3 * time.Second,
+		MemorySize:   512,
+	})
+	if err != nil {
+		t.Fatalf("running container: %v", err)
+	}
+	defer c.RemoveContainer(context.Background(), running.ID)
+
+	host, _, err := net.SplitHostPort(running.Addr)
+	if err != nil || host != cli.gateway {
+		t.Fatalf("invocations should be sent to the address the runtime API listens on, got %s", running.Addr)
+	}
+	if got := EnvValue(cli.env, "AWS_LAMBDA_FUNCTION_TIMEOUT"); got != "3" {
+		t.Fatalf("got timeout %s, expected the timeout of the function", got)
+	}
+	if got := EnvValue(cli.env, "AWS_LAMBDA_FUNCTION_MEMORY_SIZE"); got != "512" {
+		t.Fatalf("got memory size %s, expected the memory size of the function", got)
+	}
+}
+
+// buildClient reports a build that fails while pulling the base image
+type buildClient struct {
+	*fakeClient
+}
+
+func (b *buildClient) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	output := `{"status":"Pulling from sam/emulation-python3.9"}
+{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}
+`
+	return types.ImageBuildResponse{Body: ioutil.NopCloser(strings.NewReader(output))}, nil
+}
+
+func TestBuildImageReportsFailures(t *testing.T) {
+	c := New(&buildClient{fakeClient: &fakeClient{}})
+
+	_, err := c.BuildImage(context.Background(), "python3.9", "x86_64")
+	if err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Fatalf("the build failure should be returned, got %v", err)
+	}
+	if len(c.images) != 0 {
+		t.Fatalf("a failed build should not be cached")
+	}
+}
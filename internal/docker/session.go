@@ -0,0 +1,157 @@
+package docker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/rs/zerolog/log"
+)
+
+// Labels attached to everything this program creates, so it can be found
+// again after the process has died
+const (
+	labelManaged  = "lambda-local-runner.managed"
+	labelSession  = "lambda-local-runner.session"
+	labelHostname = "lambda-local-runner.hostname"
+	labelPID      = "lambda-local-runner.pid"
+	labelFunction = "lambda-local-runner.function"
+)
+
+// session identifies the running copy of this program
+type session struct {
+	id       string
+	hostname string
+	pid      int
+}
+
+func newSession() session {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	hostname, _ := os.Hostname()
+
+	return session{
+		id:       hex.EncodeToString(b),
+		hostname: hostname,
+		pid:      os.Getpid(),
+	}
+}
+
+// containerLabels returns the labels of a container running the function
+func (s session) containerLabels(functionName string) map[string]string {
+	return map[string]string{
+		labelManaged:  "true",
+		labelSession:  s.id,
+		labelHostname: s.hostname,
+		labelPID:      strconv.Itoa(s.pid),
+		labelFunction: functionName,
+	}
+}
+
+// stale checks whether a container with the given labels belongs to a copy
+// of this program that is no longer running. Containers started on other
+// machines are never considered stale, as their process cannot be checked.
+func (s session) stale(labels map[string]string) bool {
+	if labels[labelSession] == s.id || labels[labelHostname] != s.hostname {
+		return false
+	}
+
+	pid, err := strconv.Atoi(labels[labelPID])
+	if err != nil {
+		return true
+	}
+	return !processAlive(pid)
+}
+
+// processAlive checks whether a process with the given ID is running
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// finding the process only succeeds for running processes on windows
+	if runtime.GOOS == "windows" {
+		return true
+	}
+
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// managedFilter matches everything created by this program
+func managedFilter() types.ContainerListOptions {
+	return types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelManaged+"=true")),
+	}
+}
+
+// Sweep removes containers left behind by copies of this program that did
+// not shut down cleanly, returning the number removed
+func (c *Client) Sweep(ctx context.Context) (int, error) {
+	containers, err := c.cli.ContainerList(ctx, managedFilter())
+	if err != nil {
+		return 0, fmt.Errorf("listing containers: %w", err)
+	}
+
+	removed := 0
+	for _, ctr := range containers {
+		if !c.session.stale(ctr.Labels) {
+			continue
+		}
+
+		log.Debug().Str("container_id", ctr.ID).Str("session", ctr.Labels[labelSession]).Msg("removing container from a dead session")
+		if err := c.RemoveContainer(ctx, ctr.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Cleanup removes every container and image created by this program,
+// whichever session created them. It returns the number of containers and
+// images removed.
+func (c *Client) Cleanup(ctx context.Context) (int, int, error) {
+	containers, err := c.cli.ContainerList(ctx, managedFilter())
+	if err != nil {
+		return 0, 0, fmt.Errorf("listing containers: %w", err)
+	}
+
+	for i, ctr := range containers {
+		if err := c.RemoveContainer(ctx, ctr.ID); err != nil {
+			return i, 0, err
+		}
+	}
+
+	images, err := c.cli.ImageList(ctx, types.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", labelManaged+"=true")),
+	})
+	if err != nil {
+		return len(containers), 0, fmt.Errorf("listing images: %w", err)
+	}
+
+	for i, image := range images {
+		log.Debug().Str("image_id", image.ID).Msg("removing image")
+		if _, err := c.cli.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{
+			Force:         true,
+			PruneChildren: true,
+		}); err != nil {
+			return len(containers), i, fmt.Errorf("removing image: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.images = make(map[string]string)
+	c.mu.Unlock()
+
+	return len(containers), len(images), nil
+}
@@ -0,0 +1,386 @@
+package events
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// AccountID is the fake AWS account ID used in all generated events
+const AccountID = "123456789012"
+
+// SQSMessage is a single record of an SQS event
+type SQSMessage struct {
+	MessageID         string                 `json:"messageId"`
+	ReceiptHandle     string                 `json:"receiptHandle"`
+	Body              string                 `json:"body"`
+	Attributes        map[string]string      `json:"attributes"`
+	MessageAttributes map[string]interface{} `json:"messageAttributes"`
+	MD5OfBody         string                 `json:"md5OfBody"`
+	EventSource       string                 `json:"eventSource"`
+	EventSourceARN    string                 `json:"eventSourceARN"`
+	AWSRegion         string                 `json:"awsRegion"`
+}
+
+// SQSEvent is the event sent by an SQS queue
+type SQSEvent struct {
+	Records []SQSMessage `json:"Records"`
+}
+
+// SNSEntity is the notification contained in an SNS event record
+type SNSEntity struct {
+	Type              string                 `json:"Type"`
+	MessageID         string                 `json:"MessageId"`
+	TopicArn          string                 `json:"TopicArn"`
+	Subject           string                 `json:"Subject"`
+	Message           string                 `json:"Message"`
+	Timestamp         string                 `json:"Timestamp"`
+	SignatureVersion  string                 `json:"SignatureVersion"`
+	Signature         string                 `json:"Signature"`
+	SigningCertURL    string                 `json:"SigningCertUrl"`
+	UnsubscribeURL    string                 `json:"UnsubscribeUrl"`
+	MessageAttributes map[string]interface{} `json:"MessageAttributes"`
+}
+
+// SNSEventRecord is a single record of an SNS event
+type SNSEventRecord struct {
+	EventVersion         string    `json:"EventVersion"`
+	EventSubscriptionArn string    `json:"EventSubscriptionArn"`
+	EventSource          string    `json:"EventSource"`
+	SNS                  SNSEntity `json:"Sns"`
+}
+
+// SNSEvent is the event sent by an SNS topic subscription
+type SNSEvent struct {
+	Records []SNSEventRecord `json:"Records"`
+}
+
+// S3Object describes the object an S3 event refers to
+type S3Object struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"eTag"`
+	Sequencer string `json:"sequencer"`
+}
+
+// S3Bucket describes the bucket an S3 event refers to
+type S3Bucket struct {
+	Name          string            `json:"name"`
+	OwnerIdentity map[string]string `json:"ownerIdentity"`
+	Arn           string            `json:"arn"`
+}
+
+// S3Entity holds the bucket and object of an S3 event record
+type S3Entity struct {
+	SchemaVersion   string   `json:"s3SchemaVersion"`
+	ConfigurationID string   `json:"configurationId"`
+	Bucket          S3Bucket `json:"bucket"`
+	Object          S3Object `json:"object"`
+}
+
+// S3EventRecord is a single record of an S3 event notification
+type S3EventRecord struct {
+	EventVersion      string            `json:"eventVersion"`
+	EventSource       string            `json:"eventSource"`
+	AWSRegion         string            `json:"awsRegion"`
+	EventTime         string            `json:"eventTime"`
+	EventName         string            `json:"eventName"`
+	UserIdentity      map[string]string `json:"userIdentity"`
+	RequestParameters map[string]string `json:"requestParameters"`
+	ResponseElements  map[string]string `json:"responseElements"`
+	S3                S3Entity          `json:"s3"`
+}
+
+// S3Event is the event sent by an S3 bucket notification
+type S3Event struct {
+	Records []S3EventRecord `json:"Records"`
+}
+
+// DynamoDBStreamRecord holds the item changes of a DynamoDB stream record
+type DynamoDBStreamRecord struct {
+	ApproximateCreationDateTime int64           `json:"ApproximateCreationDateTime"`
+	Keys                        json.RawMessage `json:"Keys"`
+	NewImage                    json.RawMessage `json:"NewImage,omitempty"`
+	OldImage                    json.RawMessage `json:"OldImage,omitempty"`
+	SequenceNumber              string          `json:"SequenceNumber"`
+	SizeBytes                   int             `json:"SizeBytes"`
+	StreamViewType              string          `json:"StreamViewType"`
+}
+
+// DynamoDBEventRecord is a single record of a DynamoDB stream event
+type DynamoDBEventRecord struct {
+	EventID        string               `json:"eventID"`
+	EventName      string               `json:"eventName"`
+	EventVersion   string               `json:"eventVersion"`
+	EventSource    string               `json:"eventSource"`
+	AWSRegion      string               `json:"awsRegion"`
+	DynamoDB       DynamoDBStreamRecord `json:"dynamodb"`
+	EventSourceArn string               `json:"eventSourceARN"`
+}
+
+// DynamoDBEvent is the event sent by a DynamoDB stream
+type DynamoDBEvent struct {
+	Records []DynamoDBEventRecord `json:"Records"`
+}
+
+// KinesisRecord holds the data of a Kinesis event record
+type KinesisRecord struct {
+	KinesisSchemaVersion        string  `json:"kinesisSchemaVersion"`
+	PartitionKey                string  `json:"partitionKey"`
+	SequenceNumber              string  `json:"sequenceNumber"`
+	Data                        string  `json:"data"`
+	ApproximateArrivalTimestamp float64 `json:"approximateArrivalTimestamp"`
+}
+
+// KinesisEventRecord is a single record of a Kinesis stream event
+type KinesisEventRecord struct {
+	Kinesis           KinesisRecord `json:"kinesis"`
+	EventSource       string        `json:"eventSource"`
+	EventVersion      string        `json:"eventVersion"`
+	EventID           string        `json:"eventID"`
+	EventName         string        `json:"eventName"`
+	InvokeIdentityArn string        `json:"invokeIdentityArn"`
+	AWSRegion         string        `json:"awsRegion"`
+	EventSourceArn    string        `json:"eventSourceARN"`
+}
+
+// KinesisEvent is the event sent by a Kinesis stream
+type KinesisEvent struct {
+	Records []KinesisEventRecord `json:"Records"`
+}
+
+// EventBridgeEvent is the event sent by an EventBridge rule
+type EventBridgeEvent struct {
+	Version    string          `json:"version"`
+	ID         string          `json:"id"`
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       string          `json:"time"`
+	Region     string          `json:"region"`
+	Resources  []string        `json:"resources"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// CognitoCallerContext describes the client that caused a Cognito trigger
+type CognitoCallerContext struct {
+	AWSSDKVersion string `json:"awsSdkVersion"`
+	ClientID      string `json:"clientId"`
+}
+
+// CognitoEvent is the event sent by a Cognito user pool trigger
+type CognitoEvent struct {
+	Version       string                 `json:"version"`
+	TriggerSource string                 `json:"triggerSource"`
+	Region        string                 `json:"region"`
+	UserPoolID    string                 `json:"userPoolId"`
+	UserName      string                 `json:"userName"`
+	CallerContext CognitoCallerContext   `json:"callerContext"`
+	Request       map[string]interface{} `json:"request"`
+	Response      map[string]interface{} `json:"response"`
+}
+
+// NewSQSEvent builds an event containing a single message from the named
+// queue
+func NewSQSEvent(region, queueName, body string) *SQSEvent {
+	now := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	sum := md5.Sum([]byte(body))
+	return &SQSEvent{
+		Records: []SQSMessage{
+			{
+				MessageID:     newID(),
+				ReceiptHandle: base64.StdEncoding.EncodeToString([]byte(newID())),
+				Body:          body,
+				Attributes: map[string]string{
+					"ApproximateReceiveCount":          "1",
+					"SentTimestamp":                    now,
+					"SenderId":                         AccountID,
+					"ApproximateFirstReceiveTimestamp": now,
+				},
+				MessageAttributes: map[string]interface{}{},
+				MD5OfBody:         hex.EncodeToString(sum[:]),
+				EventSource:       "aws:sqs",
+				EventSourceARN:    arn("sqs", region, queueName),
+				AWSRegion:         region,
+			},
+		},
+	}
+}
+
+// NewSNSEvent builds an event containing a single notification from the
+// named topic
+func NewSNSEvent(region, topicName, subject, message string) *SNSEvent {
+	topicArn := arn("sns", region, topicName)
+	return &SNSEvent{
+		Records: []SNSEventRecord{
+			{
+				EventVersion:         "1.0",
+				EventSubscriptionArn: fmt.Sprintf("%s:%s", topicArn, newID()),
+				EventSource:          "aws:sns",
+				SNS: SNSEntity{
+					Type:              "Notification",
+					MessageID:         newID(),
+					TopicArn:          topicArn,
+					Subject:           subject,
+					Message:           message,
+					Timestamp:         time.Now().UTC().Format(time.RFC3339Nano),
+					SignatureVersion:  "1",
+					Signature:         "EXAMPLE",
+					SigningCertURL:    "EXAMPLE",
+					UnsubscribeURL:    "EXAMPLE",
+					MessageAttributes: map[string]interface{}{},
+				},
+			},
+		},
+	}
+}
+
+// NewS3Event builds a bucket notification for a single object
+func NewS3Event(region, eventName, bucket, key string, size int64) *S3Event {
+	return &S3Event{
+		Records: []S3EventRecord{
+			{
+				EventVersion: "2.1",
+				EventSource:  "aws:s3",
+				AWSRegion:    region,
+				EventTime:    time.Now().UTC().Format(time.RFC3339Nano),
+				EventName:    eventName,
+				UserIdentity: map[string]string{
+					"principalId": "EXAMPLE",
+				},
+				RequestParameters: map[string]string{
+					"sourceIPAddress": "127.0.0.1",
+				},
+				ResponseElements: map[string]string{
+					"x-amz-request-id": newHexID()[:16],
+					"x-amz-id-2":       newID(),
+				},
+				S3: S3Entity{
+					SchemaVersion:   "1.0",
+					ConfigurationID: "testConfigRule",
+					Bucket: S3Bucket{
+						Name: bucket,
+						OwnerIdentity: map[string]string{
+							"principalId": "EXAMPLE",
+						},
+						Arn: fmt.Sprintf("arn:aws:s3:::%s", bucket),
+					},
+					Object: S3Object{
+						Key:       key,
+						Size:      size,
+						ETag:      newHexID(),
+						Sequencer: "0A1B2C3D4E5F678901",
+					},
+				},
+			},
+		},
+	}
+}
+
+// NewDynamoDBEvent builds a stream event with a single record. The keys and
+// images are in DynamoDB attribute value format.
+func NewDynamoDBEvent(region, tableName, eventName string, keys, newImage, oldImage json.RawMessage) *DynamoDBEvent {
+	streamArn := fmt.Sprintf("%s/stream/%s", arn("dynamodb", region, "table/"+tableName), time.Now().UTC().Format("2006-01-02T15:04:05.000"))
+	return &DynamoDBEvent{
+		Records: []DynamoDBEventRecord{
+			{
+				EventID:      newID(),
+				EventName:    eventName,
+				EventVersion: "1.1",
+				EventSource:  "aws:dynamodb",
+				AWSRegion:    region,
+				DynamoDB: DynamoDBStreamRecord{
+					ApproximateCreationDateTime: time.Now().Unix(),
+					Keys:                        keys,
+					NewImage:                    newImage,
+					OldImage:                    oldImage,
+					SequenceNumber:              "111",
+					SizeBytes:                   len(keys) + len(newImage) + len(oldImage),
+					StreamViewType:              "NEW_AND_OLD_IMAGES",
+				},
+				EventSourceArn: streamArn,
+			},
+		},
+	}
+}
+
+// NewKinesisEvent builds a stream event with a single record
+func NewKinesisEvent(region, streamName, partitionKey string, data []byte) *KinesisEvent {
+	return &KinesisEvent{
+		Records: []KinesisEventRecord{
+			{
+				Kinesis: KinesisRecord{
+					KinesisSchemaVersion:        "1.0",
+					PartitionKey:                partitionKey,
+					SequenceNumber:              "49590338271490256608559692538361571095921575989136588898",
+					Data:                        base64.StdEncoding.EncodeToString(data),
+					ApproximateArrivalTimestamp: float64(time.Now().UnixNano()) / float64(time.Second),
+				},
+				EventSource:       "aws:kinesis",
+				EventVersion:      "1.0",
+				EventID:           "shardId-000000000006:49590338271490256608559692538361571095921575989136588898",
+				EventName:         "aws:kinesis:record",
+				InvokeIdentityArn: fmt.Sprintf("arn:aws:iam::%s:role/lambda-role", AccountID),
+				AWSRegion:         region,
+				EventSourceArn:    arn("kinesis", region, "stream/"+streamName),
+			},
+		},
+	}
+}
+
+// NewEventBridgeEvent builds an event delivered by an EventBridge rule
+func NewEventBridgeEvent(region, source, detailType string, detail json.RawMessage) *EventBridgeEvent {
+	return &EventBridgeEvent{
+		Version:    "0",
+		ID:         newID(),
+		DetailType: detailType,
+		Source:     source,
+		Account:    AccountID,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Region:     region,
+		Resources:  []string{},
+		Detail:     detail,
+	}
+}
+
+// NewCognitoEvent builds a user pool trigger event
+func NewCognitoEvent(region, triggerSource, userPoolID, clientID, userName string, userAttributes map[string]string) *CognitoEvent {
+	return &CognitoEvent{
+		Version:       "1",
+		TriggerSource: triggerSource,
+		Region:        region,
+		UserPoolID:    userPoolID,
+		UserName:      userName,
+		CallerContext: CognitoCallerContext{
+			AWSSDKVersion: "aws-sdk-unknown-unknown",
+			ClientID:      clientID,
+		},
+		Request: map[string]interface{}{
+			"userAttributes": userAttributes,
+		},
+		Response: map[string]interface{}{},
+	}
+}
+
+func arn(service, region, resource string) string {
+	return fmt.Sprintf("arn:aws:%s:%s:%s:%s", service, region, AccountID, resource)
+}
+
+// newHexID generates a random 32 character hex identifier
+func newHexID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newID generates a random UUID-formatted identifier
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
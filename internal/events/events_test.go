@@ -0,0 +1,179 @@
+package events
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// roundTrip marshals the event and unmarshals it into a generic map, to check
+// the field names the runtimes see
+func roundTrip(t *testing.T, evt interface{}) map[string]interface{} {
+	t.Helper()
+
+	body, err := json.Marshal(evt)
+	if err != nil {
+		t.Fatalf("marshalling event: %v", err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("unmarshalling event: %v", err)
+	}
+	return out
+}
+
+// firstRecord returns the single record of an event with a Records list
+func firstRecord(t *testing.T, evt map[string]interface{}) map[string]interface{} {
+	t.Helper()
+
+	records, ok := evt["Records"].([]interface{})
+	if !ok || len(records) != 1 {
+		t.Fatalf("expected a single record, got %v", evt["Records"])
+	}
+	return records[0].(map[string]interface{})
+}
+
+func TestSQSEvent(t *testing.T) {
+	evt := NewSQSEvent("eu-west-1", "queue", "hello")
+	record := firstRecord(t, roundTrip(t, evt))
+
+	if record["body"] != "hello" {
+		t.Fatalf("invalid body %v", record["body"])
+	}
+	sum := md5.Sum([]byte("hello"))
+	if record["md5OfBody"] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("invalid md5 of body %v", record["md5OfBody"])
+	}
+	if record["eventSource"] != "aws:sqs" {
+		t.Fatalf("invalid event source %v", record["eventSource"])
+	}
+	if record["eventSourceARN"] != "arn:aws:sqs:eu-west-1:123456789012:queue" {
+		t.Fatalf("invalid event source arn %v", record["eventSourceARN"])
+	}
+	if record["awsRegion"] != "eu-west-1" {
+		t.Fatalf("invalid region %v", record["awsRegion"])
+	}
+	if evt.Records[0].Attributes["SenderId"] != AccountID {
+		t.Fatalf("invalid attributes %v", evt.Records[0].Attributes)
+	}
+}
+
+func TestSNSEvent(t *testing.T) {
+	evt := NewSNSEvent("eu-west-1", "topic", "subject", "message")
+	record := firstRecord(t, roundTrip(t, evt))
+
+	if record["EventSource"] != "aws:sns" {
+		t.Fatalf("invalid event source %v", record["EventSource"])
+	}
+	sns := record["Sns"].(map[string]interface{})
+	if sns["TopicArn"] != "arn:aws:sns:eu-west-1:123456789012:topic" {
+		t.Fatalf("invalid topic arn %v", sns["TopicArn"])
+	}
+	if sns["Subject"] != "subject" || sns["Message"] != "message" {
+		t.Fatalf("invalid subject %v or message %v", sns["Subject"], sns["Message"])
+	}
+	if !strings.HasPrefix(record["EventSubscriptionArn"].(string), "arn:aws:sns:eu-west-1:123456789012:topic:") {
+		t.Fatalf("invalid subscription arn %v", record["EventSubscriptionArn"])
+	}
+}
+
+func TestS3Event(t *testing.T) {
+	evt := NewS3Event("eu-west-1", "ObjectCreated:Put", "bucket", "path/to/key", 1024)
+	record := firstRecord(t, roundTrip(t, evt))
+
+	if record["eventName"] != "ObjectCreated:Put" || record["eventSource"] != "aws:s3" {
+		t.Fatalf("invalid event name %v or source %v", record["eventName"], record["eventSource"])
+	}
+	s3 := record["s3"].(map[string]interface{})
+	bucket := s3["bucket"].(map[string]interface{})
+	if bucket["name"] != "bucket" || bucket["arn"] != "arn:aws:s3:::bucket" {
+		t.Fatalf("invalid bucket %v", bucket)
+	}
+	object := s3["object"].(map[string]interface{})
+	if object["key"] != "path/to/key" || object["size"] != float64(1024) {
+		t.Fatalf("invalid object %v", object)
+	}
+}
+
+func TestDynamoDBEvent(t *testing.T) {
+	keys := json.RawMessage(`{"Id":{"N":"101"}}`)
+	newImage := json.RawMessage(`{"Id":{"N":"101"},"Message":{"S":"New item!"}}`)
+	evt := NewDynamoDBEvent("eu-west-1", "table", "INSERT", keys, newImage, nil)
+	record := firstRecord(t, roundTrip(t, evt))
+
+	if record["eventName"] != "INSERT" || record["eventSource"] != "aws:dynamodb" {
+		t.Fatalf("invalid event name %v or source %v", record["eventName"], record["eventSource"])
+	}
+	if !strings.HasPrefix(record["eventSourceARN"].(string), "arn:aws:dynamodb:eu-west-1:123456789012:table/table/stream/") {
+		t.Fatalf("invalid event source arn %v", record["eventSourceARN"])
+	}
+	stream := record["dynamodb"].(map[string]interface{})
+	if _, ok := stream["OldImage"]; ok {
+		t.Fatalf("old image should be omitted for inserts")
+	}
+	image := stream["NewImage"].(map[string]interface{})
+	if image["Message"].(map[string]interface{})["S"] != "New item!" {
+		t.Fatalf("invalid new image %v", image)
+	}
+	if stream["SizeBytes"] != float64(len(keys)+len(newImage)) {
+		t.Fatalf("invalid size %v", stream["SizeBytes"])
+	}
+}
+
+func TestKinesisEvent(t *testing.T) {
+	evt := NewKinesisEvent("eu-west-1", "stream", "key", []byte("data"))
+	record := firstRecord(t, roundTrip(t, evt))
+
+	if record["eventSource"] != "aws:kinesis" || record["eventName"] != "aws:kinesis:record" {
+		t.Fatalf("invalid event source %v or name %v", record["eventSource"], record["eventName"])
+	}
+	if record["eventSourceARN"] != "arn:aws:kinesis:eu-west-1:123456789012:stream/stream" {
+		t.Fatalf("invalid event source arn %v", record["eventSourceARN"])
+	}
+	kinesis := record["kinesis"].(map[string]interface{})
+	if kinesis["partitionKey"] != "key" {
+		t.Fatalf("invalid partition key %v", kinesis["partitionKey"])
+	}
+	data, err := base64.StdEncoding.DecodeString(kinesis["data"].(string))
+	if err != nil || string(data) != "data" {
+		t.Fatalf("data should be base64 encoded, got %v", kinesis["data"])
+	}
+}
+
+func TestEventBridgeEvent(t *testing.T) {
+	evt := roundTrip(t, NewEventBridgeEvent("eu-west-1", "my.source", "Thing Happened", json.RawMessage(`{"a":1}`)))
+
+	if evt["source"] != "my.source" || evt["detail-type"] != "Thing Happened" {
+		t.Fatalf("invalid source %v or detail type %v", evt["source"], evt["detail-type"])
+	}
+	if evt["account"] != AccountID || evt["region"] != "eu-west-1" {
+		t.Fatalf("invalid account %v or region %v", evt["account"], evt["region"])
+	}
+	if evt["detail"].(map[string]interface{})["a"] != float64(1) {
+		t.Fatalf("invalid detail %v", evt["detail"])
+	}
+	if resources, ok := evt["resources"].([]interface{}); !ok || len(resources) != 0 {
+		t.Fatalf("resources should be an empty list, got %v", evt["resources"])
+	}
+}
+
+func TestCognitoEvent(t *testing.T) {
+	evt := roundTrip(t, NewCognitoEvent("eu-west-1", "PreSignUp_SignUp", "eu-west-1_pool", "client", "user", map[string]string{"email": "user@example.com"}))
+
+	if evt["triggerSource"] != "PreSignUp_SignUp" || evt["userPoolId"] != "eu-west-1_pool" || evt["userName"] != "user" {
+		t.Fatalf("invalid event %v", evt)
+	}
+	if evt["callerContext"].(map[string]interface{})["clientId"] != "client" {
+		t.Fatalf("invalid caller context %v", evt["callerContext"])
+	}
+	attributes := evt["request"].(map[string]interface{})["userAttributes"].(map[string]interface{})
+	if attributes["email"] != "user@example.com" {
+		t.Fatalf("invalid user attributes %v", attributes)
+	}
+	if response, ok := evt["response"].(map[string]interface{}); !ok || len(response) != 0 {
+		t.Fatalf("response should be an empty object, got %v", evt["response"])
+	}
+}
@@ -0,0 +1,303 @@
+package events
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// APIGatewayProxyRequestContext is the request context of an API Gateway
+// REST API (v1) proxy integration event
+type APIGatewayProxyRequestContext struct {
+	AccountID        string                 `json:"accountId"`
+	ResourceID       string                 `json:"resourceId"`
+	Stage            string                 `json:"stage"`
+	RequestID        string                 `json:"requestId"`
+	RequestTime      string                 `json:"requestTime"`
+	RequestTimeEpoch int64                  `json:"requestTimeEpoch"`
+	Identity         APIGatewayIdentity     `json:"identity"`
+	Path             string                 `json:"path"`
+	ResourcePath     string                 `json:"resourcePath"`
+	HTTPMethod       string                 `json:"httpMethod"`
+	APIID            string                 `json:"apiId"`
+	Protocol         string                 `json:"protocol"`
+	Authorizer       map[string]interface{} `json:"authorizer,omitempty"`
+}
+
+// APIGatewayIdentity describes the caller of an API Gateway REST API
+type APIGatewayIdentity struct {
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent"`
+}
+
+// APIGatewayProxyRequest is the event sent by an API Gateway REST API (v1)
+// proxy integration
+type APIGatewayProxyRequest struct {
+	Resource                        string                        `json:"resource"`
+	Path                            string                        `json:"path"`
+	HTTPMethod                      string                        `json:"httpMethod"`
+	Headers                         map[string]string             `json:"headers"`
+	MultiValueHeaders               map[string][]string           `json:"multiValueHeaders"`
+	QueryStringParameters           map[string]string             `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string           `json:"multiValueQueryStringParameters"`
+	PathParameters                  map[string]string             `json:"pathParameters"`
+	StageVariables                  map[string]string             `json:"stageVariables"`
+	RequestContext                  APIGatewayProxyRequestContext `json:"requestContext"`
+	Body                            *string                       `json:"body"`
+	IsBase64Encoded                 bool                          `json:"isBase64Encoded"`
+}
+
+// APIGatewayV2HTTPRequestContextHTTP describes the HTTP request of an API
+// Gateway HTTP API (v2) event
+type APIGatewayV2HTTPRequestContextHTTP struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Protocol  string `json:"protocol"`
+	SourceIP  string `json:"sourceIp"`
+	UserAgent string `json:"userAgent"`
+}
+
+// APIGatewayV2HTTPRequestContext is the request context of an API Gateway
+// HTTP API (v2) event
+type APIGatewayV2HTTPRequestContext struct {
+	AccountID    string                             `json:"accountId"`
+	APIID        string                             `json:"apiId"`
+	DomainName   string                             `json:"domainName"`
+	DomainPrefix string                             `json:"domainPrefix"`
+	HTTP         APIGatewayV2HTTPRequestContextHTTP `json:"http"`
+	RequestID    string                             `json:"requestId"`
+	RouteKey     string                             `json:"routeKey"`
+	Stage        string                             `json:"stage"`
+	Time         string                             `json:"time"`
+	TimeEpoch    int64                              `json:"timeEpoch"`
+}
+
+// APIGatewayV2HTTPRequest is the event sent by an API Gateway HTTP API using
+// payload format version 2.0
+type APIGatewayV2HTTPRequest struct {
+	Version               string                         `json:"version"`
+	RouteKey              string                         `json:"routeKey"`
+	RawPath               string                         `json:"rawPath"`
+	RawQueryString        string                         `json:"rawQueryString"`
+	Cookies               []string                       `json:"cookies,omitempty"`
+	Headers               map[string]string              `json:"headers"`
+	QueryStringParameters map[string]string              `json:"queryStringParameters,omitempty"`
+	PathParameters        map[string]string              `json:"pathParameters,omitempty"`
+	StageVariables        map[string]string              `json:"stageVariables,omitempty"`
+	RequestContext        APIGatewayV2HTTPRequestContext `json:"requestContext"`
+	Body                  string                         `json:"body,omitempty"`
+	IsBase64Encoded       bool                           `json:"isBase64Encoded"`
+}
+
+// ALBTargetGroupRequestContext identifies the target group that received an
+// application load balancer request
+type ALBTargetGroupRequestContext struct {
+	ELB struct {
+		TargetGroupArn string `json:"targetGroupArn"`
+	} `json:"elb"`
+}
+
+// ALBTargetGroupRequest is the event sent by an application load balancer
+type ALBTargetGroupRequest struct {
+	RequestContext        ALBTargetGroupRequestContext `json:"requestContext"`
+	HTTPMethod            string                       `json:"httpMethod"`
+	Path                  string                       `json:"path"`
+	QueryStringParameters map[string]string            `json:"queryStringParameters"`
+	Headers               map[string]string            `json:"headers"`
+	Body                  string                       `json:"body"`
+	IsBase64Encoded       bool                         `json:"isBase64Encoded"`
+}
+
+// NewAPIGatewayProxyRequest converts an HTTP request into the event API
+// Gateway sends to a REST API (v1) proxy integration. The resource is the
+// route template (e.g. `/users/{id}`) that matched the request.
+func NewAPIGatewayProxyRequest(r *http.Request, resource string, pathParams map[string]string) (*APIGatewayProxyRequest, error) {
+	body, isBase64, err := readBody(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+
+	now := time.Now()
+	evt := &APIGatewayProxyRequest{
+		Resource:          resource,
+		Path:              r.URL.Path,
+		HTTPMethod:        r.Method,
+		Headers:           singleValues(r.Header),
+		MultiValueHeaders: r.Header,
+		PathParameters:    nilIfEmpty(pathParams),
+		RequestContext: APIGatewayProxyRequestContext{
+			AccountID:        AccountID,
+			ResourceID:       "123456",
+			Stage:            "Prod",
+			RequestID:        newID(),
+			RequestTime:      now.UTC().Format("02/Jan/2006:15:04:05 -0700"),
+			RequestTimeEpoch: now.UnixNano() / int64(time.Millisecond),
+			Identity: APIGatewayIdentity{
+				SourceIP:  sourceIP(r),
+				UserAgent: r.UserAgent(),
+			},
+			Path:         "/Prod" + r.URL.Path,
+			ResourcePath: resource,
+			HTTPMethod:   r.Method,
+			APIID:        "1234567890",
+			Protocol:     r.Proto,
+		},
+		IsBase64Encoded: isBase64,
+	}
+
+	if query := r.URL.Query(); len(query) > 0 {
+		evt.QueryStringParameters = singleValues(query)
+		evt.MultiValueQueryStringParameters = query
+	}
+
+	if body != "" {
+		evt.Body = &body
+	}
+
+	return evt, nil
+}
+
+// NewAPIGatewayV2HTTPRequest converts an HTTP request into the event API
+// Gateway sends to an HTTP API (v2) integration. The route is the route
+// template (e.g. `/users/{id}`) that matched the request.
+func NewAPIGatewayV2HTTPRequest(r *http.Request, route string, pathParams map[string]string) (*APIGatewayV2HTTPRequest, error) {
+	body, isBase64, err := readBody(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+
+	headers := make(map[string]string)
+	for k, v := range r.Header {
+		// cookies are passed separately in v2 events
+		if strings.EqualFold(k, "cookie") {
+			continue
+		}
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+
+	var cookies []string
+	for _, c := range r.Cookies() {
+		cookies = append(cookies, c.String())
+	}
+
+	routeKey := fmt.Sprintf("%s %s", r.Method, route)
+	now := time.Now()
+	evt := &APIGatewayV2HTTPRequest{
+		Version:        "2.0",
+		RouteKey:       routeKey,
+		RawPath:        r.URL.Path,
+		RawQueryString: r.URL.RawQuery,
+		Cookies:        cookies,
+		Headers:        headers,
+		PathParameters: nilIfEmpty(pathParams),
+		RequestContext: APIGatewayV2HTTPRequestContext{
+			AccountID:    AccountID,
+			APIID:        "1234567890",
+			DomainName:   r.Host,
+			DomainPrefix: strings.Split(r.Host, ".")[0],
+			HTTP: APIGatewayV2HTTPRequestContextHTTP{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Protocol:  r.Proto,
+				SourceIP:  sourceIP(r),
+				UserAgent: r.UserAgent(),
+			},
+			RequestID: newID(),
+			RouteKey:  routeKey,
+			Stage:     "$default",
+			Time:      now.UTC().Format("02/Jan/2006:15:04:05 -0700"),
+			TimeEpoch: now.UnixNano() / int64(time.Millisecond),
+		},
+		Body:            body,
+		IsBase64Encoded: isBase64,
+	}
+
+	if query := r.URL.Query(); len(query) > 0 {
+		evt.QueryStringParameters = make(map[string]string)
+		for k, v := range query {
+			evt.QueryStringParameters[k] = strings.Join(v, ",")
+		}
+	}
+
+	return evt, nil
+}
+
+// NewALBTargetGroupRequest converts an HTTP request into the event an
+// application load balancer sends to a lambda target
+func NewALBTargetGroupRequest(r *http.Request, region string) (*ALBTargetGroupRequest, error) {
+	body, isBase64, err := readBody(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+
+	evt := &ALBTargetGroupRequest{
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: singleValues(r.URL.Query()),
+		Headers:               make(map[string]string),
+		Body:                  body,
+		IsBase64Encoded:       isBase64,
+	}
+	evt.RequestContext.ELB.TargetGroupArn = fmt.Sprintf("arn:aws:elasticloadbalancing:%s:%s:targetgroup/lambda-target/%s", region, AccountID, newHexID()[:16])
+	for k, v := range r.Header {
+		evt.Headers[strings.ToLower(k)] = v[len(v)-1]
+	}
+
+	return evt, nil
+}
+
+// readBody consumes the request body, base64 encoding it if it is not valid
+// UTF-8 as API Gateway does for binary payloads
+func readBody(r *http.Request) (string, bool, error) {
+	if r.Body == nil {
+		return "", false, nil
+	}
+	defer r.Body.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r.Body); err != nil {
+		return "", false, err
+	}
+
+	if !utf8.Valid(buf.Bytes()) {
+		return base64.StdEncoding.EncodeToString(buf.Bytes()), true, nil
+	}
+	return buf.String(), false, nil
+}
+
+// singleValues flattens multi-value maps to their last value, which is how
+// API Gateway populates the single value fields
+func singleValues(values map[string][]string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		if len(v) > 0 {
+			out[k] = v[len(v)-1]
+		}
+	}
+	return out
+}
+
+func nilIfEmpty(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "127.0.0.1"
+	}
+	return host
+}
@@ -0,0 +1,127 @@
+package events
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIGatewayProxyRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://localhost/users/42?a=1&a=2", strings.NewReader(`{"name": "test"}`))
+	r.Header.Set("Content-Type", "application/json")
+
+	evt, err := NewAPIGatewayProxyRequest(r, "/users/{id}", map[string]string{"id": "42"})
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+
+	if evt.Resource != "/users/{id}" {
+		t.Fatalf("invalid resource %s", evt.Resource)
+	}
+
+	if evt.Path != "/users/42" {
+		t.Fatalf("invalid path %s", evt.Path)
+	}
+
+	if evt.HTTPMethod != "POST" {
+		t.Fatalf("invalid method %s", evt.HTTPMethod)
+	}
+
+	if evt.PathParameters["id"] != "42" {
+		t.Fatalf("invalid path parameters %v", evt.PathParameters)
+	}
+
+	if evt.QueryStringParameters["a"] != "2" {
+		t.Fatalf("invalid query string parameters %v", evt.QueryStringParameters)
+	}
+
+	if len(evt.MultiValueQueryStringParameters["a"]) != 2 {
+		t.Fatalf("invalid multi value query string parameters %v", evt.MultiValueQueryStringParameters)
+	}
+
+	if evt.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("invalid headers %v", evt.Headers)
+	}
+
+	if evt.Body == nil || *evt.Body != `{"name": "test"}` {
+		t.Fatalf("invalid body %v", evt.Body)
+	}
+
+	if evt.IsBase64Encoded {
+		t.Fatalf("text body should not be base64 encoded")
+	}
+}
+
+func TestAPIGatewayProxyRequestBinaryBody(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://localhost/upload", strings.NewReader("\xff\xfe"))
+
+	evt, err := NewAPIGatewayProxyRequest(r, "/upload", nil)
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+
+	if !evt.IsBase64Encoded {
+		t.Fatalf("binary body should be base64 encoded")
+	}
+
+	if evt.Body == nil || *evt.Body != "//4=" {
+		t.Fatalf("invalid body %v", evt.Body)
+	}
+}
+
+func TestAPIGatewayV2HTTPRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://localhost/hello?a=1", nil)
+	r.Header.Set("Cookie", "session=abc")
+
+	evt, err := NewAPIGatewayV2HTTPRequest(r, "/hello", nil)
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+
+	if evt.RouteKey != "GET /hello" {
+		t.Fatalf("invalid route key %s", evt.RouteKey)
+	}
+
+	if evt.RawQueryString != "a=1" {
+		t.Fatalf("invalid raw query string %s", evt.RawQueryString)
+	}
+
+	if len(evt.Cookies) != 1 || evt.Cookies[0] != "session=abc" {
+		t.Fatalf("invalid cookies %v", evt.Cookies)
+	}
+
+	if _, ok := evt.Headers["cookie"]; ok {
+		t.Fatalf("cookies should not be included in the headers")
+	}
+}
+
+func TestALBTargetGroupRequest(t *testing.T) {
+	r := httptest.NewRequest("PUT", "http://localhost/items?a=1&a=2", strings.NewReader("item"))
+	r.Header.Add("X-Custom", "first")
+	r.Header.Add("X-Custom", "last")
+
+	evt, err := NewALBTargetGroupRequest(r, "eu-west-1")
+	if err != nil {
+		t.Fatalf("creating event: %v", err)
+	}
+
+	if evt.HTTPMethod != "PUT" || evt.Path != "/items" {
+		t.Fatalf("invalid method %s or path %s", evt.HTTPMethod, evt.Path)
+	}
+
+	if evt.QueryStringParameters["a"] != "2" {
+		t.Fatalf("invalid query string parameters %v", evt.QueryStringParameters)
+	}
+
+	if evt.Headers["x-custom"] != "last" {
+		t.Fatalf("headers should be lower case with their last value: %v", evt.Headers)
+	}
+
+	if evt.Body != "item" || evt.IsBase64Encoded {
+		t.Fatalf("invalid body %q", evt.Body)
+	}
+
+	if !strings.HasPrefix(evt.RequestContext.ELB.TargetGroupArn, "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/") {
+		t.Fatalf("invalid target group arn %s", evt.RequestContext.ELB.TargetGroupArn)
+	}
+}
@@ -0,0 +1,79 @@
+package invoke
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrorTypeHeader is set on the responses of failed invocations to the type
+// of the error, e.g. Sandbox.Timedout, as the runtime reports it to the
+// runtime API
+const ErrorTypeHeader = "Lambda-Runtime-Function-Error-Type"
+
+// ErrThrottled is returned when a function cannot be invoked because its
+// reserved concurrency is 0
+var ErrThrottled = errors.New("rate exceeded: the function is throttled")
+
+// ErrCrashLooping is returned when a function cannot be invoked because it
+// kept crashing and is no longer restarted
+var ErrCrashLooping = errors.New("the function is crash looping")
+
+// Result holds the raw response from a single lambda invocation
+type Result struct {
+	// Body is the payload returned by the function
+	Body []byte
+	// FunctionError is set if the handler raised an error rather than
+	// returning a response
+	FunctionError bool
+	// TimedOut is set if the function did not respond within its timeout,
+	// in which case the runtime may still be handling the event
+	TimedOut bool
+	// ColdStart is set if this was the first invocation handled by the
+	// container. It is filled in by the caller, which knows the container
+	// lifecycle.
+	ColdStart bool
+}
+
+// URL returns the invocation endpoint of the runtime API listening on the
+// given address
+func URL(addr string) string {
+	return fmt.Sprintf("http://%s/2015-03-31/functions/function/invocations", addr)
+}
+
+// Invoke sends the event payload to the lambda listening on the given
+// address (host:port) and returns its response
+func Invoke(ctx context.Context, addr string, payload []byte) (*Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", URL(addr), bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	client := http.Client{}
+	log.Debug().Str("addr", addr).Msg("sending request to lambda container")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid status code %d from lambda", resp.StatusCode)
+	}
+
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, resp.Body); err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	return &Result{
+		Body:          body.Bytes(),
+		FunctionError: resp.Header.Get("X-Amz-Function-Error") != "",
+		TimedOut:      resp.Header.Get(ErrorTypeHeader) == "Sandbox.Timedout",
+	}, nil
+}
@@ -0,0 +1,98 @@
+package invoke
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func serve(t *testing.T, status int, body string) string {
+	t.Helper()
+	return serveHeaders(t, status, nil, body)
+}
+
+func serveHeaders(t *testing.T, status int, header http.Header, body string) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("parsing test server url: %v", err)
+	}
+	return u.Host
+}
+
+func TestInvoke(t *testing.T) {
+	addr := serve(t, http.StatusOK, `{"statusCode": 200, "body": "hello"}`)
+
+	res, err := Invoke(context.Background(), addr, []byte("{}"))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+
+	if res.FunctionError {
+		t.Fatalf("response should not be a function error")
+	}
+
+	if string(res.Body) != `{"statusCode": 200, "body": "hello"}` {
+		t.Fatalf("invalid body %s", res.Body)
+	}
+}
+
+func TestInvokeFunctionError(t *testing.T) {
+	addr := serveHeaders(t, http.StatusOK, http.Header{"X-Amz-Function-Error": {"Unhandled"}, ErrorTypeHeader: {"Exception"}}, `{"errorMessage": "boom", "errorType": "Exception"}`)
+
+	res, err := Invoke(context.Background(), addr, []byte("{}"))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+
+	if !res.FunctionError || res.TimedOut {
+		t.Fatalf("response should be a function error, found %+v", res)
+	}
+}
+
+func TestInvokeTimedOut(t *testing.T) {
+	addr := serveHeaders(t, http.StatusOK, http.Header{"X-Amz-Function-Error": {"Unhandled"}, ErrorTypeHeader: {"Sandbox.Timedout"}}, `{"errorMessage": "Task timed out after 3.00 seconds", "errorType": "Sandbox.Timedout"}`)
+
+	res, err := Invoke(context.Background(), addr, []byte("{}"))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+
+	if !res.FunctionError || !res.TimedOut {
+		t.Fatalf("response should be a timeout, found %+v", res)
+	}
+}
+
+func TestInvokeErrorLikeResponse(t *testing.T) {
+	// only the headers say whether the function failed
+	addr := serve(t, http.StatusOK, `{"errorMessage": "not an error", "errorType": "Sandbox.Timedout"}`)
+
+	res, err := Invoke(context.Background(), addr, []byte("{}"))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+
+	if res.FunctionError || res.TimedOut {
+		t.Fatalf("successful response should not be a function error, found %+v", res)
+	}
+}
+
+func TestInvokeBadStatus(t *testing.T) {
+	addr := serve(t, http.StatusInternalServerError, "")
+
+	if _, err := Invoke(context.Background(), addr, []byte("{}")); err == nil {
+		t.Fatalf("expected error from bad status")
+	}
+}
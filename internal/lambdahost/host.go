@@ -2,33 +2,139 @@ package lambdahost
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
 	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
+	"github.com/mindriot101/lambda-local-runner/internal/logs"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// minCrashBackoff is the delay before restarting a function after it
+	// first crashes
+	minCrashBackoff = time.Second
+	// maxCrashBackoff limits the delay between restarts of a function that
+	// keeps crashing
+	maxCrashBackoff = 30 * time.Second
+)
+
 type dockerclient interface {
-	RunContainer(ctx context.Context, args docker.RunContainerArgs) (string, error)
+	RunContainer(ctx context.Context, args docker.RunContainerArgs) (docker.RunningContainer, error)
 	RemoveContainer(ctx context.Context, containerID string) error
+	StreamLogs(ctx context.Context, containerID string, stdout, stderr io.Writer) error
+	WaitContainer(ctx context.Context, containerID string) (docker.ExitStatus, error)
+}
+
+// Config holds the optional settings of a LambdaHost
+type Config struct {
+	// Name identifies the function in log output
+	Name string
+	// Logs receives the output of the lambda container. The container
+	// output is discarded if this is nil.
+	Logs io.Writer
+	// MaxConcurrency is the largest number of containers the host runs at
+	// once, and therefore the number of concurrent invocations it can
+	// handle. Defaults to 1.
+	MaxConcurrency int
+	// Throttled rejects every invocation without starting containers, like
+	// a function with a reserved concurrency of 0
+	Throttled bool
+	// IdleTimeout is how long an additional container may sit unused before
+	// it is removed. The first container is always kept warm. Defaults to
+	// 5 minutes.
+	IdleTimeout time.Duration
+	// Ports hands out the runtime API ports of the containers. If nil, a
+	// free port is used for each container, unless the run arguments have a
+	// fixed port, which limits the host to a single container.
+	Ports *Ports
+	// Lazy delays starting the first container until the first invocation,
+	// rather than when the host starts running
+	Lazy bool
+	// ScaleToZero applies the idle timeout to the last container as well, so
+	// the next invocation is a cold start
+	ScaleToZero bool
+	// CrashLoopThreshold is the number of crashes in a row after which the
+	// host stops restarting the function, until its code is reloaded.
+	// Defaults to 5.
+	CrashLoopThreshold int
 }
 
+// LambdaHost runs the containers of a single lambda function, dispatching
+// each invocation to an idle container and scaling the pool of containers up
+// to the configured concurrency
 type LambdaHost struct {
 	args   docker.RunContainerArgs
+	cfg    Config
 	events chan instruction
 	host   dockerclient
+	// stopped is closed once Run has returned, after which instructions are
+	// dropped
+	stopped chan struct{}
+
+	mu         sync.Mutex
+	containers []*container
+	// starting counts containers that are being created, so they count
+	// towards the concurrency limit
+	starting int
+	// changed is closed and replaced whenever a container becomes available
+	changed chan struct{}
+	// nextID is used to give each container a unique name
+	nextID int
+	// generation is incremented on every reload, so containers started
+	// before the reload can be told apart from their replacements
+	generation int
+	// draining holds containers replaced by a reload that are still
+	// finishing an invocation
+	draining []*container
+	// removing tracks the removal of drained containers
+	removing sync.WaitGroup
+
+	// crashes counts the crashes since the function last handled an
+	// invocation or was reloaded
+	crashes int
+	// failed is set once the function is crash looping
+	failed error
+	// crashBackoff is the delay before restarting after the first crash,
+	// which doubles with every crash in a row
+	crashBackoff time.Duration
 
-	mu          sync.Mutex
-	containerID string
+	// pending holds the settings from the latest call to Reconfigure, which
+	// are applied by the Run loop
+	pending *reconfiguration
 }
 
-func New(client dockerclient, args docker.RunContainerArgs) *LambdaHost {
+// reconfiguration holds new settings for the function
+type reconfiguration struct {
+	args           docker.RunContainerArgs
+	maxConcurrency int
+	throttled      bool
+}
+
+func New(client dockerclient, args docker.RunContainerArgs, cfg Config) *LambdaHost {
+	if cfg.MaxConcurrency < 1 || fixedPort(args, cfg) {
+		cfg.MaxConcurrency = 1
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 5 * time.Minute
+	}
+	if cfg.CrashLoopThreshold <= 0 {
+		cfg.CrashLoopThreshold = 5
+	}
+
 	return &LambdaHost{
-		args:   args,
-		host:   client,
-		events: make(chan instruction, 10),
+		args:    args,
+		cfg:     cfg,
+		host:    client,
+		events:  make(chan instruction, 10),
+		stopped: make(chan struct{}),
+		changed: make(chan struct{}),
+
+		crashBackoff: minCrashBackoff,
 	}
 }
 
@@ -40,75 +146,595 @@ func (h *LambdaHost) Restart() {
 	h.send(instructionRestart)
 }
 
+// Reconfigure restarts the function with new container arguments and
+// concurrency limits, e.g. after its definition in the template changed. Like
+// a restart, requests are not dropped.
+func (h *LambdaHost) Reconfigure(args docker.RunContainerArgs, maxConcurrency int, throttled bool) {
+	h.mu.Lock()
+	h.pending = &reconfiguration{args: args, maxConcurrency: maxConcurrency, throttled: throttled}
+	h.mu.Unlock()
+
+	h.send(instructionReconfigure)
+}
+
 func (h *LambdaHost) send(ins instruction) {
 	log.Debug().Interface("instruction", ins).Msg("sending instruction to host")
-	h.events <- ins
+	select {
+	case h.events <- ins:
+	case <-h.stopped:
+	}
 }
 
 func (h *LambdaHost) Run(ctx context.Context, done chan<- struct{}, runWg *sync.WaitGroup) error {
-	if err := h.runContainer(ctx); err != nil {
-		return fmt.Errorf("running containers: %w", err)
+	defer close(h.stopped)
+
+	if !h.cfg.Lazy && !h.cfg.Throttled {
+		if err := h.addContainer(ctx); err != nil {
+			err = fmt.Errorf("running containers: %w", err)
+			// invocations fail straight away rather than waiting for a
+			// container that is never started
+			h.mu.Lock()
+			h.failed = err
+			h.notify()
+			h.mu.Unlock()
+			runWg.Done()
+			return err
+		}
 	}
 	runWg.Done()
 
-	for ins := range h.events {
-		logger := log.With().Interface("instruction", ins).Logger()
-		logger.Debug().Msg("got message")
-
-		switch ins {
-		case instructionShutdown:
-			logger.Debug().Msg("shutting down")
-			if err := h.RemoveContainer(context.TODO()); err != nil {
-				logger.
-					Warn().
-					Err(err).
-					Str("container_name", h.args.ContainerName).
-					Msg("could not remove the lambda container")
+	reap := time.NewTicker(reapInterval(h.cfg.IdleTimeout))
+	defer reap.Stop()
+
+	for {
+		select {
+		case ins := <-h.events:
+			logger := log.With().Interface("instruction", ins).Logger()
+			logger.Debug().Msg("got message")
+
+			switch ins {
+			case instructionShutdown:
+				logger.Debug().Msg("shutting down")
+				if err := h.RemoveContainer(context.TODO()); err != nil {
+					logger.
+						Warn().
+						Err(err).
+						Str("container_name", h.args.ContainerName).
+						Msg("could not remove the lambda container")
+				}
+				done <- struct{}{}
+				return nil
+
+			case instructionRestart:
+				log.WithLevel(logs.EventLevel).Str("event", "restart").Str("function", h.cfg.Name).Msg("restarting function")
+				if err := h.reload(ctx); err != nil {
+					logger.
+						Warn().
+						Err(err).
+						Str("function", h.cfg.Name).
+						Msg("could not start the new container, the old containers are still running")
+				}
+
+			case instructionReplace:
+				h.replaceCrashed(ctx)
+
+			case instructionReconfigure:
+				h.applyPending()
+				log.WithLevel(logs.EventLevel).Str("event", "restart").Str("function", h.cfg.Name).Msg("restarting function with new configuration")
+				if err := h.reload(ctx); err != nil {
+					logger.
+						Warn().
+						Err(err).
+						Str("function", h.cfg.Name).
+						Msg("could not start the new container, the old containers are still running")
+				}
+
+			default:
+				log.Error().Interface("message_type", ins).Msg("invalid message received")
 			}
-			done <- struct{}{}
+
+		case <-reap.C:
+			h.removeIdle(context.TODO())
+		}
+	}
+}
+
+// applyPending switches to the settings passed to Reconfigure. It must only
+// be called from the Run loop.
+func (h *LambdaHost) applyPending() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pending == nil {
+		return
+	}
+	// containers of the function keep their names
+	name := h.args.ContainerName
+	h.args = h.pending.args
+	h.args.ContainerName = name
+	h.cfg.MaxConcurrency = h.pending.maxConcurrency
+	h.cfg.Throttled = h.pending.throttled
+	if h.cfg.MaxConcurrency < 1 || fixedPort(h.args, h.cfg) {
+		h.cfg.MaxConcurrency = 1
+	}
+	h.pending = nil
+}
+
+// reload replaces the containers of the host without dropping requests. The
+// new container only takes over once it is ready, and the old containers are
+// removed once their in-flight invocations have finished.
+func (h *LambdaHost) reload(ctx context.Context) error {
+	// the new code gets a fresh start
+	h.mu.Lock()
+	h.crashes = 0
+	h.failed = nil
+	h.mu.Unlock()
+
+	h.mu.Lock()
+	fixed := fixedPort(h.args, h.cfg)
+	h.mu.Unlock()
+
+	if fixed {
+		// every container uses the same port, so the old container has to go
+		// before the new one can start
+		if err := h.RemoveContainer(ctx); err != nil {
+			log.Warn().Err(err).Str("function", h.cfg.Name).Msg("could not remove the lambda container")
+		}
+		if h.cfg.Lazy || h.cfg.Throttled {
 			return nil
+		}
+		return h.addContainer(ctx)
+	}
 
-		case instructionRestart:
-			logger.Debug().Msg("restarting")
-			if err := h.RemoveContainer(context.TODO()); err != nil {
-				logger.
-					Warn().
-					Err(err).
-					Str("container_name", h.args.ContainerName).
-					Msg("could not remove the lambda container")
-			}
+	// the old containers keep handling invocations until the new container
+	// is ready, so the generation only changes once it is
+	h.mu.Lock()
+	generation := h.generation + 1
+	h.mu.Unlock()
 
-			if err := h.runContainer(ctx); err != nil {
-				return fmt.Errorf("running containers: %w", err)
-			}
+	// lazy hosts start the new container on the next invocation
+	var c *container
+	if !h.cfg.Lazy && !h.cfg.Throttled {
+		var err error
+		if c, err = h.startContainer(ctx, generation); err != nil {
+			return err
+		}
+	}
 
+	h.mu.Lock()
+	h.generation = generation
+	if c != nil {
+		h.containers = append(h.containers, c)
+	}
+	var current, idle []*container
+	for _, c := range h.containers {
+		switch {
+		case c.generation == h.generation:
+			current = append(current, c)
+		case c.busy:
+			c.retired = true
+			h.draining = append(h.draining, c)
 		default:
-			log.Error().Interface("message_type", ins).Msg("invalid message received")
+			idle = append(idle, c)
 		}
 	}
+	h.containers = current
+	h.notify()
+	h.mu.Unlock()
 
+	for _, c := range idle {
+		if err := h.removeContainer(ctx, c); err != nil {
+			log.Warn().Err(err).Str("container_name", c.name).Msg("could not remove the old container")
+		}
+	}
 	return nil
 }
 
-func (h *LambdaHost) runContainer(ctx context.Context) error {
-	var err error
+// addContainer starts a container and adds it to the pool as an idle
+// container
+func (h *LambdaHost) addContainer(ctx context.Context) error {
+	h.mu.Lock()
+	h.starting++
+	h.mu.Unlock()
+
+	return h.startReserved(ctx)
+}
+
+// startReserved starts a container in a slot of the pool that has already
+// been reserved by incrementing starting
+func (h *LambdaHost) startReserved(ctx context.Context) error {
+	h.mu.Lock()
+	generation := h.generation
+	h.mu.Unlock()
+
+	c, err := h.startContainer(ctx, generation)
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	h.starting--
+	// waiters are woken on failure too, as the slot is free again
+	defer h.notify()
+	if err != nil {
+		return err
+	}
+	if c.generation != h.generation {
+		// the code changed while the container was starting
+		h.retire(c)
+		return nil
+	}
+	h.containers = append(h.containers, c)
+	return nil
+}
+
+// startContainer runs a new container for the function, as part of the given
+// reload generation
+func (h *LambdaHost) startContainer(ctx context.Context, generation int) (*container, error) {
+	h.mu.Lock()
+	args := h.args
+	args.ContainerName = fmt.Sprintf("%s-%d", h.args.ContainerName, h.nextID)
+	h.nextID++
+	h.mu.Unlock()
 
-	h.containerID, err = h.host.RunContainer(ctx, h.args)
+	if h.cfg.Ports != nil {
+		port, err := h.cfg.Ports.Next()
+		if err != nil {
+			return nil, fmt.Errorf("allocating port: %w", err)
+		}
+		args.Port = port
+	}
+
+	running, err := h.host.RunContainer(ctx, args)
 	if err != nil {
-		return fmt.Errorf("running container: %w", err)
+		if h.cfg.Ports != nil {
+			h.cfg.Ports.Release(args.Port)
+		}
+		return nil, fmt.Errorf("running container: %w", err)
 	}
+	log.Debug().Str("container_name", args.ContainerName).Int("port", running.Port).Msg("started container")
 
-	return nil
+	if h.cfg.Logs != nil {
+		// the stream ends when the container is removed
+		go h.streamLogs(context.Background(), running.ID, args.ContainerName)
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	c := &container{
+		id:         running.ID,
+		name:       args.ContainerName,
+		port:       running.Port,
+		addr:       running.Addr,
+		generation: generation,
+		lastUsed:   time.Now(),
+		stop:       stop,
+	}
+	go h.watch(watchCtx, c)
+	return c, nil
 }
 
-func (h *LambdaHost) RemoveContainer(ctx context.Context) error {
+// watch waits for the container to stop, treating it as a crash unless the
+// host removed it
+func (h *LambdaHost) watch(ctx context.Context, c *container) {
+	status, err := h.host.WaitContainer(ctx, c.id)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("container_name", c.name).Msg("lost track of the lambda container")
+	}
+	h.crashed(c, status)
+}
+
+// crashed removes a container that stopped unexpectedly and schedules a
+// replacement, backing off on repeated crashes
+func (h *LambdaHost) crashed(c *container, status docker.ExitStatus) {
+	h.mu.Lock()
+	h.containers = without(h.containers, c)
+	retired := c.retired
+	if retired {
+		h.draining = without(h.draining, c)
+	}
+	h.notify()
+	h.mu.Unlock()
+
+	if err := h.removeContainer(context.Background(), c); err != nil {
+		log.Warn().Err(err).Str("container_name", c.name).Msg("could not remove the crashed container")
+	}
+
+	// containers replaced by a reload are not restarted
+	if retired {
+		return
+	}
+	h.recordCrash(status, c.name)
+}
+
+// recordCrash counts a crash of the function, scheduling a replacement
+// container or giving up if the function is crash looping
+func (h *LambdaHost) recordCrash(status docker.ExitStatus, containerName string) {
+	h.mu.Lock()
+	h.crashes++
+	crashes := h.crashes
+	if crashes >= h.cfg.CrashLoopThreshold && h.failed == nil {
+		h.failed = fmt.Errorf("function %s crashed %d times in a row, %s: %w", h.cfg.Name, crashes, describeExit(status), invoke.ErrCrashLooping)
+	}
+	failed := h.failed
+	// waiting invocations fail straight away if the host has given up
+	h.notify()
+	h.mu.Unlock()
+
+	backoff := h.crashBackoff << (crashes - 1)
+	if backoff > maxCrashBackoff || backoff <= 0 {
+		backoff = maxCrashBackoff
+	}
+
+	log.Warn().
+		Str("event", "crash").
+		Str("function", h.cfg.Name).
+		Str("container_name", containerName).
+		Int64("exit_code", status.ExitCode).
+		Bool("oom_killed", status.OOMKilled).
+		Int("crashes", crashes).
+		Msg("lambda container exited unexpectedly")
+
+	if failed != nil {
+		log.Error().Str("event", "crash_loop").Str("function", h.cfg.Name).Err(failed).Msg("no longer restarting the function")
+		return
+	}
+
+	time.AfterFunc(backoff, func() {
+		h.send(instructionReplace)
+	})
+}
+
+// replaceCrashed starts a container after a crash if the host should keep
+// one warm and has not given up on the function
+func (h *LambdaHost) replaceCrashed(ctx context.Context) {
+	h.mu.Lock()
+	needed := h.failed == nil && !h.cfg.Lazy && !h.cfg.Throttled && len(h.containers)+h.starting == 0
+	h.mu.Unlock()
+	if !needed {
+		return
+	}
+
+	log.WithLevel(logs.EventLevel).Str("event", "restart").Str("function", h.cfg.Name).Msg("restarting crashed function")
+	if err := h.addContainer(ctx); err != nil {
+		log.Warn().Err(err).Str("function", h.cfg.Name).Msg("could not restart the function")
+		h.recordCrash(docker.ExitStatus{ExitCode: -1}, "")
+	}
+}
+
+// Err returns the reason the host stopped restarting the function, or nil if
+// it is healthy
+func (h *LambdaHost) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.failed
+}
+
+func describeExit(status docker.ExitStatus) string {
+	if status.OOMKilled {
+		return fmt.Sprintf("last exit code %d (out of memory)", status.ExitCode)
+	}
+	return fmt.Sprintf("last exit code %d", status.ExitCode)
+}
+
+// streamLogs copies the container output to the configured writer until the
+// container is removed. Each container buffers its own partial lines.
+func (h *LambdaHost) streamLogs(ctx context.Context, containerID, containerName string) {
+	out := logs.NewLines(h.cfg.Logs)
+	if err := h.host.StreamLogs(ctx, containerID, out, out); err != nil && !errors.Is(err, context.Canceled) {
+		log.Warn().Err(err).Str("container_name", containerName).Msg("could not stream container logs")
+	}
+	if err := out.Flush(); err != nil {
+		log.Warn().Err(err).Str("container_name", containerName).Msg("could not write container logs")
+	}
+}
+
+// Invoke sends the event payload to an idle container, starting a new
+// container if they are all busy and the pool has not reached its maximum
+// size. The result records whether this was the first invocation handled by
+// the container.
+func (h *LambdaHost) Invoke(ctx context.Context, payload []byte) (*invoke.Result, error) {
+	c, coldStart, err := h.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("acquiring container: %w", err)
+	}
+	defer h.release(c)
+
+	res, err := invoke.Invoke(ctx, c.addr, payload)
+	if err != nil {
+		return nil, err
+	}
+	res.ColdStart = coldStart
+	if res.TimedOut {
+		h.recycle(c)
+	}
+
+	h.mu.Lock()
+	h.crashes = 0
+	h.mu.Unlock()
+	return res, nil
+}
+
+// acquire reserves an idle container for an invocation, waiting for one to
+// become available if the pool is at its maximum size
+func (h *LambdaHost) acquire(ctx context.Context) (*container, bool, error) {
+	h.mu.Lock()
+	for {
+		if h.cfg.Throttled {
+			h.mu.Unlock()
+			return nil, false, invoke.ErrThrottled
+		}
+		if h.failed != nil {
+			err := h.failed
+			h.mu.Unlock()
+			return nil, false, err
+		}
+
+		for _, c := range h.containers {
+			if !c.busy {
+				coldStart := !c.invoked
+				c.busy = true
+				c.invoked = true
+				h.mu.Unlock()
+				return c, coldStart, nil
+			}
+		}
+
+		if len(h.containers)+h.starting < h.cfg.MaxConcurrency {
+			h.starting++
+			h.mu.Unlock()
+			log.Debug().Str("function", h.cfg.Name).Msg("no idle containers, starting a new one")
+			// the new container outlives the request that caused it to be
+			// created
+			if err := h.startReserved(context.Background()); err != nil {
+				return nil, false, err
+			}
+			h.mu.Lock()
+			continue
+		}
+
+		changed := h.changed
+		h.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		h.mu.Lock()
+	}
+}
+
+// recycle removes a container whose invocation timed out, as its runtime may
+// still be handling the event, and replaces it. Lambda does the same with the
+// sandbox.
+func (h *LambdaHost) recycle(c *container) {
+	h.mu.Lock()
+	h.containers = without(h.containers, c)
+	h.draining = without(h.draining, c)
+	// removed here rather than when it is released
+	c.retired = false
+	h.mu.Unlock()
+
+	log.Debug().Str("container_name", c.name).Msg("removing container after a timeout")
+	if err := h.removeContainer(context.Background(), c); err != nil {
+		log.Warn().Err(err).Str("container_name", c.name).Msg("could not remove the timed out container")
+	}
+	h.send(instructionReplace)
+}
+
+// release returns a container to the pool once an invocation has finished,
+// removing it instead if it has been replaced by a reload
+func (h *LambdaHost) release(c *container) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	c.busy = false
+	c.lastUsed = time.Now()
+	if c.retired {
+		h.draining = without(h.draining, c)
+		h.retire(c)
+	}
+	h.notify()
+}
+
+// retire removes a container that is no longer part of the pool in the
+// background. Must be called with the lock held.
+func (h *LambdaHost) retire(c *container) {
+	h.removing.Add(1)
+	go func() {
+		defer h.removing.Done()
+
+		log.Debug().Str("container_name", c.name).Msg("removing replaced container")
+		if err := h.removeContainer(context.Background(), c); err != nil {
+			log.Warn().Err(err).Str("container_name", c.name).Msg("could not remove the old container")
+		}
+	}()
+}
+
+// notify wakes up any invocations waiting for a container. Must be called
+// with the lock held.
+func (h *LambdaHost) notify() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// removeIdle scales the pool back down by removing containers that have not
+// been used within the idle timeout, keeping one container warm unless the
+// host scales to zero
+func (h *LambdaHost) removeIdle(ctx context.Context) {
+	minWarm := 1
+	if h.cfg.ScaleToZero {
+		minWarm = 0
+	}
+
+	h.mu.Lock()
+	var keep, remove []*container
+	for _, c := range h.containers {
+		if !c.busy && time.Since(c.lastUsed) > h.cfg.IdleTimeout && len(h.containers)-len(remove) > minWarm {
+			remove = append(remove, c)
+		} else {
+			keep = append(keep, c)
+		}
+	}
+	h.containers = keep
+	h.mu.Unlock()
+
+	for _, c := range remove {
+		log.Debug().Str("container_name", c.name).Msg("removing idle container")
+		if err := h.removeContainer(ctx, c); err != nil {
+			log.Warn().Err(err).Str("container_name", c.name).Msg("could not remove idle container")
+		}
+	}
+}
+
+// RemoveContainer removes every container in the pool, including those
+// still draining after a reload
+func (h *LambdaHost) RemoveContainer(ctx context.Context) error {
+	h.mu.Lock()
+	containers := append(h.containers, h.draining...)
+	h.containers = nil
+	h.draining = nil
+	h.mu.Unlock()
+	h.removing.Wait()
+
+	var lastErr error
+	for _, c := range containers {
+		if err := h.removeContainer(ctx, c); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (h *LambdaHost) removeContainer(ctx context.Context, c *container) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	return h.host.RemoveContainer(ctx, h.containerID)
+	// the container is going away on purpose, so it is not a crash
+	if c.stop != nil {
+		c.stop()
+	}
+	// the port is released even if the removal failed, as the container is
+	// no longer tracked and nothing else would release it
+	if h.cfg.Ports != nil {
+		defer h.cfg.Ports.Release(c.port)
+	}
+	return h.host.RemoveContainer(ctx, c.id)
+}
+
+// fixedPort checks whether every container of the host has to use the same
+// host port. This is also the case when debugging, as the debugger port is
+// fixed.
+func fixedPort(args docker.RunContainerArgs, cfg Config) bool {
+	return cfg.Ports == nil && args.Port != 0 || args.Debug != nil
+}
+
+// reapInterval is how often the pool is checked for idle containers
+func reapInterval(idleTimeout time.Duration) time.Duration {
+	interval := idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
 }
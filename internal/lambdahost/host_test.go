@@ -2,11 +2,20 @@ package lambdahost
 
 import (
 	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
 	"github.com/rs/zerolog"
 )
 
@@ -17,6 +26,15 @@ type call struct {
 type mockClient struct {
 	mu    sync.Mutex
 	calls []call
+
+	// exits simulates containers stopping on their own
+	exits chan docker.ExitStatus
+	// runErr is returned by RunContainer if set
+	runErr error
+	// removeErr is returned by RemoveContainer if set
+	removeErr error
+	// lastArgs are the arguments of the latest RunContainer call
+	lastArgs docker.RunContainerArgs
 }
 
 func (m *mockClient) Calls() []call {
@@ -26,12 +44,26 @@ func (m *mockClient) Calls() []call {
 	return m.calls
 }
 
-func (m *mockClient) RunContainer(ctx context.Context, args docker.RunContainerArgs) (string, error) {
+func (m *mockClient) RunContainer(ctx context.Context, args docker.RunContainerArgs) (docker.RunningContainer, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	m.calls = append(m.calls, call{"RunContainer"})
-	return "containerID", nil
+	m.lastArgs = args
+	if m.runErr != nil {
+		return docker.RunningContainer{}, m.runErr
+	}
+
+	// simulate docker assigning a port
+	port := args.Port
+	if port == 0 {
+		port = 32768 + len(m.calls)
+	}
+	return docker.RunningContainer{
+		ID:   "containerID",
+		Port: port,
+		Addr: "localhost:" + strconv.Itoa(port),
+	}, nil
 }
 
 func (m *mockClient) RemoveContainer(ctx context.Context, containerID string) error {
@@ -39,7 +71,39 @@ func (m *mockClient) RemoveContainer(ctx context.Context, containerID string) er
 	defer m.mu.Unlock()
 
 	m.calls = append(m.calls, call{"RemoveContainer"})
-	return nil
+	return m.removeErr
+}
+
+func (m *mockClient) StreamLogs(ctx context.Context, containerID string, stdout, stderr io.Writer) error {
+	_, err := stdout.Write([]byte("hello from " + containerID + "\n"))
+	return err
+}
+
+func (m *mockClient) WaitContainer(ctx context.Context, containerID string) (docker.ExitStatus, error) {
+	select {
+	case status := <-m.exits:
+		return status, nil
+	case <-ctx.Done():
+		return docker.ExitStatus{ExitCode: -1}, ctx.Err()
+	}
+}
+
+func (m *mockClient) countCalls(name string) int {
+	n := 0
+	for _, c := range m.Calls() {
+		if c.name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// chanWriter sends everything written to it on a channel
+type chanWriter chan string
+
+func (c chanWriter) Write(p []byte) (int, error) {
+	c <- string(p)
+	return len(p), nil
 }
 
 func TestMain(m *testing.M) {
@@ -52,7 +116,7 @@ func TestShutdown(t *testing.T) {
 	ctx := context.Background()
 	args := docker.RunContainerArgs{}
 	client := &mockClient{}
-	host := New(client, args)
+	host := New(client, args, Config{})
 	done := make(chan struct{})
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -77,9 +141,11 @@ func TestShutdown(t *testing.T) {
 
 func TestRestart(t *testing.T) {
 	ctx := context.Background()
-	args := docker.RunContainerArgs{}
+	// a fixed port means the old container is removed before the new one
+	// is started
+	args := docker.RunContainerArgs{Port: 9001}
 	client := &mockClient{}
-	host := New(client, args)
+	host := New(client, args, Config{})
 	done := make(chan struct{})
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -110,3 +176,631 @@ func TestRestart(t *testing.T) {
 		t.Fatalf("invalid call %s expected RemoveContainer", calls[3].name)
 	}
 }
+
+func TestReconfigure(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{ContainerName: "llr-Function-abc", Handler: "app.old"}
+	client := &mockClient{}
+	host := New(client, args, Config{MaxConcurrency: 1})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	host.Reconfigure(docker.RunContainerArgs{ContainerName: "llr-Function-xyz", Handler: "app.new"}, 3, false)
+	host.Shutdown()
+	<-done
+
+	if n := client.countCalls("RunContainer"); n != 2 {
+		t.Fatalf("invalid number of containers started, found %d expected 2", n)
+	}
+
+	client.mu.Lock()
+	lastArgs := client.lastArgs
+	client.mu.Unlock()
+	if lastArgs.Handler != "app.new" {
+		t.Fatalf("new container started with handler %s", lastArgs.Handler)
+	}
+	if lastArgs.ContainerName != "llr-Function-abc-1" {
+		t.Fatalf("new container named %s", lastArgs.ContainerName)
+	}
+	if host.cfg.MaxConcurrency != 3 {
+		t.Fatalf("invalid concurrency %d, expected 3", host.cfg.MaxConcurrency)
+	}
+}
+
+func TestStreamLogs(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	logs := make(chanWriter, 1)
+	host := New(client, args, Config{Logs: logs})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	if got := <-logs; got != "hello from containerID\n" {
+		t.Fatalf("invalid log output %q", got)
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestInvokeColdStart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"statusCode": 200}`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	ctx := context.Background()
+	args := docker.RunContainerArgs{Port: port}
+	client := &mockClient{}
+	host := New(client, args, Config{})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	first, err := host.Invoke(ctx, []byte("{}"))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if !first.ColdStart {
+		t.Fatalf("first invocation should be a cold start")
+	}
+
+	second, err := host.Invoke(ctx, []byte("{}"))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if second.ColdStart {
+		t.Fatalf("second invocation should not be a cold start")
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestScaleUp(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{
+		MaxConcurrency: 2,
+		Ports:          NewPorts(9001, 9100),
+	})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	first, coldStart, err := host.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquiring first container: %v", err)
+	}
+	if !coldStart {
+		t.Fatalf("first invocation should be a cold start")
+	}
+
+	second, _, err := host.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquiring second container: %v", err)
+	}
+	if first == second {
+		t.Fatalf("busy container should not be reused")
+	}
+	if first.port == second.port {
+		t.Fatalf("containers should have different ports")
+	}
+
+	// the pool is full so the next invocation waits for a container
+	acquired := make(chan *container)
+	go func() {
+		c, _, _ := host.acquire(ctx)
+		acquired <- c
+	}()
+
+	host.release(first)
+	if third := <-acquired; third != first {
+		t.Fatalf("released container should be reused")
+	}
+
+	host.mu.Lock()
+	nContainers := len(host.containers)
+	host.mu.Unlock()
+	if nContainers != 2 {
+		t.Fatalf("expected 2 containers, found %d", nContainers)
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestRemoveIdle(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{
+		MaxConcurrency: 2,
+		IdleTimeout:    time.Millisecond,
+		Ports:          NewPorts(9001, 9100),
+	})
+
+	if err := host.addContainer(ctx); err != nil {
+		t.Fatalf("adding container: %v", err)
+	}
+	if err := host.addContainer(ctx); err != nil {
+		t.Fatalf("adding container: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	host.removeIdle(ctx)
+
+	if len(host.containers) != 1 {
+		t.Fatalf("expected one warm container to be kept, found %d", len(host.containers))
+	}
+}
+
+func TestLazyStart(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{Lazy: true})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	if nCalls := len(client.Calls()); nCalls != 0 {
+		t.Fatalf("lazy host should not start a container before the first invocation, found %d calls", nCalls)
+	}
+
+	c, coldStart, err := host.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquiring container: %v", err)
+	}
+	if !coldStart {
+		t.Fatalf("first invocation should be a cold start")
+	}
+	host.release(c)
+
+	calls := client.Calls()
+	if len(calls) != 1 || calls[0].name != "RunContainer" {
+		t.Fatalf("expected a single RunContainer call, found %v", calls)
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestThrottled(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{Throttled: true})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	if _, err := host.Invoke(ctx, []byte("{}")); !errors.Is(err, invoke.ErrThrottled) {
+		t.Fatalf("expected the invocation to be throttled, got %v", err)
+	}
+	if nCalls := len(client.Calls()); nCalls != 0 {
+		t.Fatalf("throttled host should not start containers, found %d calls", nCalls)
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestRunFailureMarksReady(t *testing.T) {
+	args := docker.RunContainerArgs{}
+	client := &mockClient{runErr: errors.New("no such image")}
+	host := New(client, args, Config{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	if err := host.Run(context.Background(), make(chan struct{}, 1), &wg); err == nil {
+		t.Fatalf("expected an error starting the first container")
+	}
+
+	// would block forever if Run had not marked wg done
+	wg.Wait()
+
+	// instructions to a stopped host are dropped rather than filling up the
+	// channel and blocking the caller
+	for i := 0; i < 20; i++ {
+		host.Restart()
+	}
+	if _, err := host.Invoke(context.Background(), nil); err == nil {
+		t.Fatalf("expected invocations of a host that could not start to fail")
+	}
+}
+
+func TestScaleToZero(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{
+		IdleTimeout: time.Millisecond,
+		ScaleToZero: true,
+	})
+
+	if err := host.addContainer(ctx); err != nil {
+		t.Fatalf("adding container: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	host.removeIdle(ctx)
+
+	if len(host.containers) != 0 {
+		t.Fatalf("expected all containers to be removed, found %d", len(host.containers))
+	}
+}
+
+func TestReloadDrainsInFlightInvocations(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{
+		MaxConcurrency: 2,
+		Ports:          NewPorts(9001, 9100),
+	})
+
+	if err := host.addContainer(ctx); err != nil {
+		t.Fatalf("adding container: %v", err)
+	}
+	old, _, err := host.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquiring container: %v", err)
+	}
+
+	if err := host.reload(ctx); err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+
+	calls := client.Calls()
+	if len(calls) != 2 || calls[1].name != "RunContainer" {
+		t.Fatalf("busy container should not be removed before the invocation finishes, found %v", calls)
+	}
+
+	// new invocations go to the new container
+	c, coldStart, err := host.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquiring container: %v", err)
+	}
+	if c == old || !coldStart {
+		t.Fatalf("invocation after reload should use the new container")
+	}
+	host.release(c)
+
+	host.release(old)
+	host.removing.Wait()
+
+	calls = client.Calls()
+	if len(calls) != 3 || calls[2].name != "RemoveContainer" {
+		t.Fatalf("old container should be removed once drained, found %v", calls)
+	}
+	if len(host.draining) != 0 {
+		t.Fatalf("expected no draining containers, found %d", len(host.draining))
+	}
+}
+
+// serverClient runs each container as a separate HTTP server, which drops
+// its connections when the container is removed, like a removed container
+type serverClient struct {
+	*mockClient
+
+	mu      sync.Mutex
+	servers map[string]*httptest.Server
+}
+
+func (s *serverClient) RunContainer(ctx context.Context, args docker.RunContainerArgs) (docker.RunningContainer, error) {
+	if _, err := s.mockClient.RunContainer(ctx, args); err != nil {
+		return docker.RunningContainer{}, err
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"statusCode": 200}`))
+	}))
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := "container" + strconv.Itoa(len(s.servers))
+	s.servers[id] = srv
+	return docker.RunningContainer{ID: id, Port: port, Addr: u.Host}, nil
+}
+
+func (s *serverClient) RemoveContainer(ctx context.Context, containerID string) error {
+	s.mu.Lock()
+	srv := s.servers[containerID]
+	s.mu.Unlock()
+
+	srv.CloseClientConnections()
+	srv.Close()
+	return s.mockClient.RemoveContainer(ctx, containerID)
+}
+
+func TestReloadKeepsRequestsInFlight(t *testing.T) {
+	ctx := context.Background()
+	client := &serverClient{mockClient: &mockClient{}, servers: make(map[string]*httptest.Server)}
+	host := New(client, docker.RunContainerArgs{}, Config{MaxConcurrency: 4})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	// requests are sent continuously while the function reloads
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	var requests sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := host.Invoke(ctx, []byte("{}")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		host.Restart()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.countCalls("RunContainer") < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("function was not reloaded, found %v", client.Calls())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	requests.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("invocation failed during reload: %v", err)
+	default:
+	}
+	if client.countCalls("RemoveContainer") == 0 {
+		t.Fatalf("old containers should be removed after the reload")
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestReloadKeepsOldContainersIfNewOneFails(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{
+		Ports: NewPorts(9001, 9100),
+	})
+	if err := host.addContainer(ctx); err != nil {
+		t.Fatalf("adding container: %v", err)
+	}
+	old := host.containers[0]
+
+	client.mu.Lock()
+	client.runErr = errors.New("container exited with code 1 before it was ready")
+	client.mu.Unlock()
+
+	if err := host.reload(ctx); err == nil {
+		t.Fatalf("reload should fail if the new container is not ready")
+	}
+
+	if len(host.containers) != 1 || host.containers[0] != old {
+		t.Fatalf("old container should keep serving requests")
+	}
+
+	// containers started to scale up are not replaced by the failed reload
+	if host.generation != old.generation {
+		t.Fatalf("failed reload should not change the generation")
+	}
+
+	calls := client.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("old container should not be removed, found %v", calls)
+	}
+}
+
+func TestCrashRestart(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{exits: make(chan docker.ExitStatus)}
+	host := New(client, args, Config{})
+	host.crashBackoff = time.Millisecond
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	client.exits <- docker.ExitStatus{ExitCode: 137, OOMKilled: true}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.countCalls("RunContainer") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("crashed container was not restarted, found %v", client.Calls())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := host.Err(); err != nil {
+		t.Fatalf("single crash should not stop the host: %v", err)
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestCrashLoop(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{exits: make(chan docker.ExitStatus)}
+	host := New(client, args, Config{CrashLoopThreshold: 2})
+	host.crashBackoff = time.Millisecond
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	client.exits <- docker.ExitStatus{ExitCode: 1}
+	client.exits <- docker.ExitStatus{ExitCode: 137, OOMKilled: true}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for host.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("host did not detect the crash loop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the error says how the function last exited
+	_, _, err := host.acquire(ctx)
+	if !errors.Is(err, invoke.ErrCrashLooping) || !strings.Contains(err.Error(), "last exit code 137 (out of memory)") {
+		t.Fatalf("invocations should fail once the function is crash looping, got %v", err)
+	}
+
+	// reloading the code gives the function another chance
+	host.Restart()
+	deadline = time.Now().Add(5 * time.Second)
+	for host.Err() != nil || client.countCalls("RunContainer") < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("reload did not restart the function")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	host.Shutdown()
+	<-done
+}
+
+func TestDynamicPorts(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{}
+	host := New(client, args, Config{MaxConcurrency: 2})
+
+	first, _, err := host.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquiring first container: %v", err)
+	}
+	second, _, err := host.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquiring second container: %v", err)
+	}
+
+	if first.port == 0 || first.port == second.port {
+		t.Fatalf("containers should use the ports assigned by docker, found %d and %d", first.port, second.port)
+	}
+}
+
+func TestRemoveFailureReleasesPort(t *testing.T) {
+	ctx := context.Background()
+	args := docker.RunContainerArgs{}
+	client := &mockClient{removeErr: errors.New("no such container")}
+	ports := NewPorts(9001, 9001)
+	host := New(client, args, Config{Ports: ports})
+
+	if err := host.addContainer(ctx); err != nil {
+		t.Fatalf("adding container: %v", err)
+	}
+	if err := host.RemoveContainer(ctx); err == nil {
+		t.Fatalf("expected the removal error")
+	}
+
+	if port, err := ports.Next(); err != nil || port != 9001 {
+		t.Fatalf("port should be released, found %d: %v", port, err)
+	}
+}
+
+func TestPortsRange(t *testing.T) {
+	ports := NewPorts(9001, 9002)
+
+	first, err := ports.Next()
+	if err != nil {
+		t.Fatalf("allocating port: %v", err)
+	}
+	if _, err := ports.Next(); err != nil {
+		t.Fatalf("allocating port: %v", err)
+	}
+	if _, err := ports.Next(); err == nil {
+		t.Fatalf("range should be used up")
+	}
+
+	ports.Release(first)
+	if port, err := ports.Next(); err != nil || port != first {
+		t.Fatalf("released port should be reused, found %d: %v", port, err)
+	}
+}
+
+func TestTimeoutRecyclesContainer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+		w.Header().Set(invoke.ErrorTypeHeader, "Sandbox.Timedout")
+		w.Write([]byte(`{"errorMessage": "Task timed out after 3.00 seconds", "errorType": "Sandbox.Timedout"}`))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	ctx := context.Background()
+	client := &mockClient{}
+	host := New(client, docker.RunContainerArgs{Port: port}, Config{})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go host.Run(ctx, done, &wg)
+	wg.Wait()
+
+	res, err := host.Invoke(ctx, []byte("{}"))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if !res.TimedOut {
+		t.Fatalf("invocation should have timed out")
+	}
+	if n := client.countCalls("RemoveContainer"); n != 1 {
+		t.Fatalf("timed out container should be removed, found %d removals", n)
+	}
+
+	// the next invocation gets a fresh container
+	if _, err := host.Invoke(ctx, []byte("{}")); err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if n := client.countCalls("RunContainer"); n < 2 {
+		t.Fatalf("expected a new container after the timeout, found %d started", n)
+	}
+
+	host.Shutdown()
+	<-done
+}
@@ -3,6 +3,8 @@ package lambdahost
 type instruction string
 
 const (
-	instructionShutdown instruction = "shutdown"
-	instructionRestart              = "restart"
+	instructionShutdown    instruction = "shutdown"
+	instructionRestart                 = "restart"
+	instructionReplace                 = "replace"
+	instructionReconfigure             = "reconfigure"
 )
@@ -0,0 +1,87 @@
+package lambdahost
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// container is a single running container in a host's pool
+type container struct {
+	id   string
+	name string
+	port int
+	// addr is the address invocations are sent to
+	addr string
+
+	// busy is set while the container is handling an invocation
+	busy bool
+	// invoked records whether the container has handled an invocation yet
+	invoked bool
+	// lastUsed is when the container last finished an invocation
+	lastUsed time.Time
+	// generation is the reload generation of the host the container was
+	// started in
+	generation int
+	// retired is set once a reload has replaced the container, so it is
+	// removed when its invocation finishes
+	retired bool
+	// stop stops watching the container for crashes
+	stop context.CancelFunc
+}
+
+// without returns the containers with c removed
+func without(containers []*container, c *container) []*container {
+	for i, other := range containers {
+		if other == c {
+			return append(containers[:i], containers[i+1:]...)
+		}
+	}
+	return containers
+}
+
+// Ports hands out runtime API ports to containers from a fixed range, reusing
+// ports that have been released. It is safe to share between hosts.
+type Ports struct {
+	mu   sync.Mutex
+	next int
+	end  int
+	free []int
+}
+
+// NewPorts creates a Ports which allocates ports from start to end
+// inclusive
+func NewPorts(start, end int) *Ports {
+	return &Ports{
+		next: start,
+		end:  end,
+	}
+}
+
+// Next returns an unused port, or an error if the range has been used up
+func (p *Ports) Next() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := len(p.free); n > 0 {
+		port := p.free[n-1]
+		p.free = p.free[:n-1]
+		return port, nil
+	}
+
+	if p.next > p.end {
+		return 0, fmt.Errorf("no free ports left in range up to %d", p.end)
+	}
+	port := p.next
+	p.next++
+	return port, nil
+}
+
+// Release marks the port as available for reuse
+func (p *Ports) Release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.free = append(p.free, port)
+}
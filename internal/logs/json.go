@@ -0,0 +1,56 @@
+package logs
+
+import (
+	"github.com/rs/zerolog"
+)
+
+// EventLevel is the level of the events logged for every request and
+// restart. They are debug messages in console mode, so that they are only
+// shown with --verbose, and are raised to info for JSON output.
+var EventLevel = zerolog.DebugLevel
+
+// JSONWriter splits container output into lines and emits each one as a
+// structured log event. Lambda lifecycle lines become their own events, with
+// the invocation statistics of REPORT lines as separate fields.
+type JSONWriter struct {
+	lineBuffer
+
+	logger zerolog.Logger
+}
+
+// NewJSONWriter creates a JSONWriter for the function with the given
+// logical ID
+func NewJSONWriter(logger zerolog.Logger, logicalID string) *JSONWriter {
+	w := &JSONWriter{
+		logger: logger.With().Str("function", logicalID).Logger(),
+	}
+	w.lineBuffer.writeLine = w.writeLine
+	return w
+}
+
+func (w *JSONWriter) writeLine(line string) error {
+	kind, requestID := Classify(line)
+	switch kind {
+	case LineStart:
+		w.logger.Info().Str("event", "function_start").Str("request_id", requestID).Msg(line)
+	case LineEnd:
+		w.logger.Info().Str("event", "function_end").Str("request_id", requestID).Msg(line)
+	case LineReport:
+		report, _ := ParseReport(line)
+		evt := w.logger.Info().
+			Str("event", "function_report").
+			Str("request_id", report.RequestID).
+			Float64("duration_ms", report.Duration).
+			Float64("billed_duration_ms", report.BilledDuration).
+			Int("memory_size_mb", report.MemorySize).
+			Int("max_memory_used_mb", report.MaxMemoryUsed).
+			Bool("cold_start", report.InitDuration > 0)
+		if report.InitDuration > 0 {
+			evt = evt.Float64("init_duration_ms", report.InitDuration)
+		}
+		evt.Msg(line)
+	default:
+		w.logger.Info().Str("event", "function_log").Msg(line)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseReport(t *testing.T) {
+	line := "REPORT RequestId: 7d5c2c8e-5b4f-4b2b-9c4f-1f0a5e9a1b2c\tInit Duration: 0.31 ms\tDuration: 106.61 ms\tBilled Duration: 107 ms\tMemory Size: 128 MB\tMax Memory Used: 42 MB\t"
+
+	report, ok := ParseReport(line)
+	if !ok {
+		t.Fatalf("line should be parsed as a report")
+	}
+
+	expected := Report{
+		RequestID:      "7d5c2c8e-5b4f-4b2b-9c4f-1f0a5e9a1b2c",
+		Duration:       106.61,
+		BilledDuration: 107,
+		InitDuration:   0.31,
+		MemorySize:     128,
+		MaxMemoryUsed:  42,
+	}
+	if report != expected {
+		t.Fatalf("invalid report, expected %+v found %+v", expected, report)
+	}
+}
+
+func TestParseReportIgnoresOtherLines(t *testing.T) {
+	if _, ok := ParseReport("START RequestId: abc Version: $LATEST"); ok {
+		t.Fatalf("START line should not be parsed as a report")
+	}
+
+	if _, ok := ParseReport("hello world"); ok {
+		t.Fatalf("output line should not be parsed as a report")
+	}
+}
+
+func TestWriterPrefixesLines(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, "HelloWorldFunction", false)
+
+	w.Write([]byte("first line\nsecond "))
+	w.Write([]byte("line\n"))
+
+	expected := "HelloWorldFunction | first line\nHelloWorldFunction | second line\n"
+	if out.String() != expected {
+		t.Fatalf("invalid output, expected %q found %q", expected, out.String())
+	}
+}
+
+func TestWriterFlushesPartialLine(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, "Fn", false)
+
+	w.Write([]byte("partial"))
+	if out.Len() != 0 {
+		t.Fatalf("partial line should be buffered")
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("flushing: %v", err)
+	}
+
+	if out.String() != "Fn | partial\n" {
+		t.Fatalf("invalid output %q", out.String())
+	}
+}
+
+func TestLinesKeepContainersApart(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, "Fn", false)
+	first, second := NewLines(w), NewLines(w)
+
+	first.Write([]byte("first "))
+	second.Write([]byte("second "))
+	first.Write([]byte("container\n"))
+	second.Write([]byte("container"))
+	second.Flush()
+
+	expected := "Fn | first container\nFn | second container\n"
+	if out.String() != expected {
+		t.Fatalf("invalid output, expected %q found %q", expected, out.String())
+	}
+}
+
+func TestWriterFormatsReport(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, "Fn", false)
+
+	w.Write([]byte("REPORT RequestId: abc-123\tDuration: 1.50 ms\tBilled Duration: 2 ms\tMemory Size: 128 MB\tMax Memory Used: 30 MB\n"))
+
+	expected := "Fn | REPORT abc-123 duration=1.50ms billed=2ms memory=30/128MB\n"
+	if out.String() != expected {
+		t.Fatalf("invalid output, expected %q found %q", expected, out.String())
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewJSONWriter(zerolog.New(&out), "Fn")
+
+	w.Write([]byte("hello\nREPORT RequestId: abc-123\tInit Duration: 3.00 ms\tDuration: 1.50 ms\tBilled Duration: 2 ms\tMemory Size: 128 MB\tMax Memory Used: 30 MB\n"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 events, found %d", len(lines))
+	}
+
+	var logLine map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &logLine); err != nil {
+		t.Fatalf("invalid json %s: %v", lines[0], err)
+	}
+	if logLine["event"] != "function_log" || logLine["function"] != "Fn" || logLine["message"] != "hello" {
+		t.Fatalf("invalid log event %v", logLine)
+	}
+
+	var report map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &report); err != nil {
+		t.Fatalf("invalid json %s: %v", lines[1], err)
+	}
+	if report["event"] != "function_report" || report["duration_ms"] != 1.5 || report["cold_start"] != true {
+		t.Fatalf("invalid report event %v", report)
+	}
+}
@@ -0,0 +1,96 @@
+package logs
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LineKind classifies a line of output from the lambda runtime
+type LineKind int
+
+const (
+	// LineOutput is anything written by the function or the runtime that is
+	// not a lifecycle line
+	LineOutput LineKind = iota
+	// LineStart marks the start of an invocation
+	LineStart
+	// LineEnd marks the end of an invocation
+	LineEnd
+	// LineReport summarises the resources used by an invocation
+	LineReport
+)
+
+// Report holds the details of a REPORT line, which lambda prints at the end
+// of every invocation
+type Report struct {
+	RequestID string `json:"request_id"`
+	// Duration of the invocation in milliseconds
+	Duration float64 `json:"duration_ms"`
+	// BilledDuration of the invocation in milliseconds
+	BilledDuration float64 `json:"billed_duration_ms"`
+	// InitDuration is the time taken to initialise the runtime in
+	// milliseconds, and is only set for cold starts
+	InitDuration float64 `json:"init_duration_ms,omitempty"`
+	// MemorySize is the configured memory in MB
+	MemorySize int `json:"memory_size_mb"`
+	// MaxMemoryUsed is the peak memory usage in MB
+	MaxMemoryUsed int `json:"max_memory_used_mb"`
+}
+
+var (
+	requestIDRe = regexp.MustCompile(`RequestId: ([0-9a-fA-F-]+)`)
+	reportRe    = regexp.MustCompile(`(Init Duration|Billed Duration|Duration|Max Memory Used|Memory Size): ([0-9.]+) (ms|MB)`)
+)
+
+// Classify determines whether the line is a lambda lifecycle line, and
+// returns the request ID it refers to if so
+func Classify(line string) (LineKind, string) {
+	var kind LineKind
+	switch {
+	case strings.HasPrefix(line, "START RequestId:"):
+		kind = LineStart
+	case strings.HasPrefix(line, "END RequestId:"):
+		kind = LineEnd
+	case strings.HasPrefix(line, "REPORT RequestId:"):
+		kind = LineReport
+	default:
+		return LineOutput, ""
+	}
+
+	var requestID string
+	if m := requestIDRe.FindStringSubmatch(line); m != nil {
+		requestID = m[1]
+	}
+	return kind, requestID
+}
+
+// ParseReport extracts the invocation statistics from a REPORT line
+func ParseReport(line string) (Report, bool) {
+	kind, requestID := Classify(line)
+	if kind != LineReport {
+		return Report{}, false
+	}
+
+	report := Report{RequestID: requestID}
+	for _, m := range reportRe.FindAllStringSubmatch(line, -1) {
+		value, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+
+		switch m[1] {
+		case "Duration":
+			report.Duration = value
+		case "Billed Duration":
+			report.BilledDuration = value
+		case "Init Duration":
+			report.InitDuration = value
+		case "Memory Size":
+			report.MemorySize = int(value)
+		case "Max Memory Used":
+			report.MaxMemoryUsed = int(value)
+		}
+	}
+	return report, true
+}
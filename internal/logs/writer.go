@@ -0,0 +1,156 @@
+package logs
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	colourReset = "\x1b[0m"
+	colourBold  = "\x1b[1m"
+)
+
+// palette is the set of colours function prefixes are drawn from
+var palette = []string{
+	"\x1b[36m", // cyan
+	"\x1b[33m", // yellow
+	"\x1b[32m", // green
+	"\x1b[35m", // magenta
+	"\x1b[34m", // blue
+	"\x1b[91m", // bright red
+	"\x1b[96m", // bright cyan
+	"\x1b[93m", // bright yellow
+}
+
+// lineBuffer splits a stream of output into lines, buffering incomplete
+// lines until the rest of the line arrives
+type lineBuffer struct {
+	writeLine func(line string) error
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer
+func (b *lineBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(b.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := string(b.buf.Next(idx + 1))
+		if err := b.writeLine(strings.TrimRight(line, "\r\n")); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any buffered partial line
+func (b *lineBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	line := b.buf.String()
+	b.buf.Reset()
+	return b.writeLine(line)
+}
+
+// Lines splits the output of a single container into lines and writes each
+// line to the underlying writer on its own. Containers of the same function
+// share its writer, so this stops their partial lines from being joined.
+type Lines struct {
+	lineBuffer
+
+	out io.Writer
+}
+
+// NewLines creates a Lines writing to out
+func NewLines(out io.Writer) *Lines {
+	l := &Lines{out: out}
+	l.lineBuffer.writeLine = l.writeLine
+	return l
+}
+
+func (l *Lines) writeLine(line string) error {
+	_, err := io.WriteString(l.out, line+"\n")
+	return err
+}
+
+// Writer splits container output into lines and writes each one to the
+// underlying writer prefixed with the function name. Lambda lifecycle lines
+// are reformatted so the invocation statistics stand out.
+type Writer struct {
+	lineBuffer
+
+	out    io.Writer
+	prefix string
+	colour string
+}
+
+// NewWriter creates a Writer for the function with the given logical ID.
+// Each function is consistently given the same colour unless colour output
+// is disabled.
+func NewWriter(out io.Writer, logicalID string, colour bool) *Writer {
+	w := &Writer{
+		out:    out,
+		prefix: logicalID,
+	}
+	w.lineBuffer.writeLine = w.writeLine
+	if colour {
+		w.colour = colourFor(logicalID)
+	}
+	return w
+}
+
+func (w *Writer) writeLine(line string) error {
+	if report, ok := ParseReport(line); ok {
+		line = w.highlight(formatReport(report))
+	} else if kind, _ := Classify(line); kind != LineOutput {
+		line = w.highlight(line)
+	}
+
+	_, err := fmt.Fprintf(w.out, "%s %s\n", w.formatPrefix(), line)
+	return err
+}
+
+func (w *Writer) formatPrefix() string {
+	if w.colour == "" {
+		return w.prefix + " |"
+	}
+	return w.colour + w.prefix + " |" + colourReset
+}
+
+func (w *Writer) highlight(line string) string {
+	if w.colour == "" {
+		return line
+	}
+	return colourBold + line + colourReset
+}
+
+func formatReport(r Report) string {
+	s := fmt.Sprintf("REPORT %s duration=%.2fms billed=%.0fms memory=%d/%dMB",
+		r.RequestID, r.Duration, r.BilledDuration, r.MaxMemoryUsed, r.MemorySize)
+	if r.InitDuration > 0 {
+		s += fmt.Sprintf(" init=%.2fms", r.InitDuration)
+	}
+	return s
+}
+
+func colourFor(logicalID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(logicalID))
+	return palette[h.Sum32()%uint32(len(palette))]
+}
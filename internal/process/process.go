@@ -0,0 +1,425 @@
+// Package process runs lambda functions that are native executables, such as
+// go1.x and provided runtime functions, as local processes rather than in
+// docker containers. It can be used by a lambdahost in place of the docker
+// client.
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/mindriot101/lambda-local-runner/internal/runtimeapi"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// readyTimeout is how long a function has to initialise
+	readyTimeout = 30 * time.Second
+	// stopTimeout is how long a function has to exit after SIGTERM before it
+	// is killed
+	stopTimeout = 2 * time.Second
+	// logTailLines is the number of lines of output included in start up
+	// errors
+	logTailLines = 20
+)
+
+// Supported checks whether functions of the runtime can be run as processes
+func Supported(runtime string) bool {
+	return runtime == "go1.x" || strings.HasPrefix(runtime, "provided")
+}
+
+// Runner starts and stops the processes of functions. It is safe for
+// concurrent use.
+type Runner struct {
+	mu        sync.Mutex
+	processes map[string]*process
+	nextID    int
+	session   session
+}
+
+// process is a running function
+type process struct {
+	runtime *child
+	api     *runtimeapi.Server
+	output  *output
+	session session
+	// extensions are started along with the runtime, from the extensions
+	// directories of the layers
+	extensions []*child
+}
+
+// child is a process started for a function
+type child struct {
+	cmd *exec.Cmd
+	// exited is closed once the process has exited, after which status is
+	// set
+	exited chan struct{}
+	status docker.ExitStatus
+}
+
+func New() *Runner {
+	return &Runner{
+		processes: make(map[string]*process),
+		session:   newSession(),
+	}
+}
+
+// Executable returns the file run for the function: the handler for go1.x,
+// or the bootstrap in the code or a layer for provided runtimes
+func Executable(args docker.RunContainerArgs) (string, error) {
+	if args.Runtime == "go1.x" {
+		return filepath.Abs(filepath.Join(args.SourcePath, args.Handler))
+	}
+
+	for _, dir := range append([]string{args.SourcePath}, args.LayerPaths...) {
+		bootstrap := filepath.Join(dir, "bootstrap")
+		if info, err := os.Stat(bootstrap); err == nil && !info.IsDir() {
+			return filepath.Abs(bootstrap)
+		}
+	}
+	return "", fmt.Errorf("no bootstrap found in the function code or its layers")
+}
+
+// RunContainer starts the function as a process, with its own Runtime API,
+// and waits for it to initialise. The returned ID identifies the process in
+// the other methods.
+func (r *Runner) RunContainer(ctx context.Context, args docker.RunContainerArgs) (docker.RunningContainer, error) {
+	switch {
+	case !Supported(args.Runtime):
+		return docker.RunningContainer{}, fmt.Errorf("the %s runtime needs docker, only go1.x and provided functions can run as processes", args.Runtime)
+	case args.Debug != nil:
+		return docker.RunningContainer{}, fmt.Errorf("debugging needs docker")
+	case args.DependenciesPath != "":
+		return docker.RunningContainer{}, fmt.Errorf("a dependencies directory needs docker")
+	}
+	if args.Network != "" {
+		log.Debug().Str("network", args.Network).Msg("functions running as processes are not attached to docker networks")
+	}
+
+	executable, err := Executable(args)
+	if err != nil {
+		return docker.RunningContainer{}, err
+	}
+	taskRoot, err := filepath.Abs(args.SourcePath)
+	if err != nil {
+		return docker.RunningContainer{}, fmt.Errorf("finding function code: %w", err)
+	}
+
+	extensions, err := docker.Extensions(args.LayerPaths)
+	if err != nil {
+		return docker.RunningContainer{}, err
+	}
+
+	api, err := runtimeapi.Listen(net.JoinHostPort("127.0.0.1", strconv.Itoa(args.Port)), runtimeapi.Config{
+		FunctionName: args.FunctionName,
+		Region:       docker.EnvValue(args.Env, "AWS_REGION"),
+		MemorySize:   args.FunctionMemorySize(),
+		Timeout:      args.FunctionTimeout(),
+		Handler:      args.Handler,
+		Extensions:   docker.ExtensionNames(extensions),
+	})
+	if err != nil {
+		return docker.RunningContainer{}, fmt.Errorf("starting runtime API: %w", err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(api.Port()))
+	// the extensions run on this machine rather than in a sandbox
+	api.SetSandboxHost("127.0.0.1")
+
+	// lambda runs the function from the code directory, with a clean
+	// environment
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"LANG=en_US.UTF-8",
+		"TZ=:UTC",
+		"LAMBDA_TASK_ROOT=" + taskRoot,
+		"LAMBDA_RUNTIME_DIR=" + taskRoot,
+		"AWS_EXECUTION_ENV=AWS_Lambda_" + args.Runtime,
+	}
+	env = append(env, docker.LambdaEnv(args, addr, args.FunctionTimeout())...)
+	p := &process{
+		api:     api,
+		output:  newOutput(),
+		session: r.session,
+	}
+
+	// lambda starts the extensions before the runtime
+	extensionOutput := io.MultiWriter(p.output, api.ExtensionOutput())
+	for _, extension := range extensions {
+		c, err := p.start(extension, taskRoot, env, extensionOutput)
+		if err != nil {
+			p.stop(context.Background())
+			return docker.RunningContainer{}, err
+		}
+		p.extensions = append(p.extensions, c)
+	}
+	p.runtime, err = p.start(executable, taskRoot, env, io.MultiWriter(p.output, api.Output()))
+	if err != nil {
+		p.stop(context.Background())
+		return docker.RunningContainer{}, err
+	}
+
+	r.mu.Lock()
+	id := fmt.Sprintf("%s-%d", args.ContainerName, r.nextID)
+	r.nextID++
+	r.processes[id] = p
+	r.mu.Unlock()
+
+	if err := p.waitReady(ctx); err != nil {
+		r.RemoveContainer(context.Background(), id)
+		return docker.RunningContainer{}, err
+	}
+
+	return docker.RunningContainer{
+		ID:   id,
+		Port: api.Port(),
+		Addr: addr,
+	}, nil
+}
+
+// start runs an executable from the directory with the environment,
+// sending its output to w
+func (p *process) start(executable, dir string, env []string, w io.Writer) (*child, error) {
+	cmd := exec.Command(executable)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = w
+	cmd.Stderr = w
+	// the function is not interrupted along with this program by ctrl-c
+	setProcessGroup(cmd)
+
+	log.Debug().Str("executable", executable).Msg("starting process")
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", executable, err)
+	}
+	p.session.record(cmd.Process.Pid)
+
+	c := &child{
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+	go c.wait()
+	return c, nil
+}
+
+// wait records how the process exited
+func (c *child) wait() {
+	err := c.cmd.Wait()
+
+	c.status = docker.ExitStatus{ExitCode: int64(c.cmd.ProcessState.ExitCode())}
+	if err != nil && c.status.ExitCode == 0 {
+		log.Debug().Err(err).Msg("process failed")
+		c.status.ExitCode = -1
+	}
+	close(c.exited)
+}
+
+// waitReady waits for the function to initialise. If it exits or does not
+// become ready in time, the error includes the end of its output.
+func (p *process) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	select {
+	case <-p.api.Ready():
+		if err := p.api.InitError(); err != nil {
+			return fmt.Errorf("initialising function: %w%s", err, p.output.tail())
+		}
+		return nil
+	case <-p.runtime.exited:
+		return fmt.Errorf("process exited with code %d before it was ready%s", p.runtime.status.ExitCode, p.output.tail())
+	case <-ctx.Done():
+		if pending := p.api.InitPending(); pending != "" {
+			return fmt.Errorf("lambda runtime not ready after %s, still waiting for %s%s", readyTimeout, pending, p.output.tail())
+		}
+		return fmt.Errorf("lambda runtime not ready after %s%s", readyTimeout, p.output.tail())
+	}
+}
+
+func (r *Runner) process(id string) (*process, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.processes[id]
+	if !ok {
+		return nil, fmt.Errorf("no such process %s", id)
+	}
+	return p, nil
+}
+
+// RemoveContainer stops the process and its extensions, killing them if
+// they do not exit after SIGTERM
+func (r *Runner) RemoveContainer(ctx context.Context, id string) error {
+	r.mu.Lock()
+	p, ok := r.processes[id]
+	delete(r.processes, id)
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such process %s", id)
+	}
+
+	log.Debug().Str("process", id).Msg("stopping process")
+	return p.stop(ctx)
+}
+
+// stop gives the extensions the chance to shut down, then stops the
+// processes that are still running
+func (p *process) stop(ctx context.Context) error {
+	defer p.api.Close()
+
+	if deadline := p.api.Shutdown(); !deadline.IsZero() {
+		shutdownCtx, cancel := context.WithDeadline(ctx, deadline)
+		for _, c := range p.extensions {
+			select {
+			case <-c.exited:
+			case <-shutdownCtx.Done():
+			}
+		}
+		cancel()
+	}
+
+	children := p.extensions
+	if p.runtime != nil {
+		children = append([]*child{p.runtime}, children...)
+	}
+	for _, c := range children {
+		terminate(c.cmd)
+	}
+
+	stopCtx, cancel := context.WithTimeout(ctx, stopTimeout)
+	defer cancel()
+	var err error
+	for _, c := range children {
+		select {
+		case <-c.exited:
+			continue
+		case <-stopCtx.Done():
+		}
+
+		if killErr := kill(c.cmd); killErr != nil && err == nil {
+			err = fmt.Errorf("killing process: %w", killErr)
+		}
+		<-c.exited
+	}
+	for _, c := range children {
+		p.session.forget(c.cmd.Process.Pid)
+	}
+	return err
+}
+
+// WaitContainer blocks until the process exits and reports its exit code
+func (r *Runner) WaitContainer(ctx context.Context, id string) (docker.ExitStatus, error) {
+	p, err := r.process(id)
+	if err != nil {
+		return docker.ExitStatus{ExitCode: -1}, err
+	}
+
+	select {
+	case <-p.runtime.exited:
+		return p.runtime.status, nil
+	case <-ctx.Done():
+		return docker.ExitStatus{ExitCode: -1}, ctx.Err()
+	}
+}
+
+// Logs copies the output the process has produced so far into stdout. The
+// output of a process is not split into stdout and stderr.
+func (r *Runner) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	p, err := r.process(id)
+	if err != nil {
+		return err
+	}
+
+	p.output.copy(stdout)
+	p.api.CopyLogs(stdout)
+	return nil
+}
+
+// StreamLogs follows the output of the process, copying it into stdout until
+// the process exits or the context is cancelled
+func (r *Runner) StreamLogs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	p, err := r.process(id)
+	if err != nil {
+		return err
+	}
+
+	p.api.SetLogs(stdout)
+	p.output.follow(stdout)
+	defer p.output.follow(nil)
+
+	select {
+	case <-p.runtime.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// output keeps the output of a process until it is followed, for start up
+// errors and one-off invocations
+type output struct {
+	mu      sync.Mutex
+	history bytes.Buffer
+	w       io.Writer
+}
+
+func newOutput() *output {
+	return &output{}
+}
+
+// Write implements io.Writer
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.w != nil {
+		return o.w.Write(p)
+	}
+	return o.history.Write(p)
+}
+
+// follow sends the output written so far, and everything written afterwards,
+// to w. A nil w stops following.
+func (o *output) follow(w io.Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if w != nil {
+		w.Write(o.history.Bytes())
+		o.history.Reset()
+	}
+	o.w = w
+}
+
+func (o *output) copy(w io.Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	w.Write(o.history.Bytes())
+}
+
+// tail returns the last lines of output, formatted to be appended to an error
+// message
+func (o *output) tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.history.Len() == 0 {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(o.history.String(), "\n"), "\n")
+	if len(lines) > logTailLines {
+		lines = lines[len(lines)-logTailLines:]
+	}
+	return ", process output:\n" + strings.Join(lines, "\n")
+}
@@ -0,0 +1,310 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
+)
+
+// TestMain runs the test binary as a function runtime when it is started as
+// a bootstrap by the tests
+func TestMain(m *testing.M) {
+	if os.Getenv("LLR_TEST_RUNTIME") == "1" {
+		run := echoRuntime
+		if filepath.Base(os.Args[0]) != "bootstrap" {
+			run = shutdownExtension
+		}
+		if err := run(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// echoRuntime is a custom runtime returning each event along with the
+// working directory
+func echoRuntime() error {
+	api := "http://" + os.Getenv("AWS_LAMBDA_RUNTIME_API") + "/2018-06-01/runtime/invocation/"
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println("runtime started")
+
+	for {
+		resp, err := http.Get(api + "next")
+		if err != nil {
+			return err
+		}
+		event, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		body := fmt.Sprintf(`{"event": %s, "wd": %q, "handler": %q}`, event, wd, os.Getenv("_HANDLER"))
+		resp, err = http.Post(api+resp.Header.Get("Lambda-Runtime-Aws-Request-Id")+"/response", "application/json", strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+}
+
+// shutdownExtension is an extension which records that it received the
+// SHUTDOWN event in LLR_TEST_DIR
+func shutdownExtension() error {
+	api := "http://" + os.Getenv("AWS_LAMBDA_RUNTIME_API") + "/2020-01-01/extension/"
+	req, _ := http.NewRequest("POST", api+"register", strings.NewReader(`{"events": ["SHUTDOWN"]}`))
+	req.Header.Set("Lambda-Extension-Name", filepath.Base(os.Args[0]))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	req, _ = http.NewRequest("GET", api+"event/next", nil)
+	req.Header.Set("Lambda-Extension-Identifier", resp.Header.Get("Lambda-Extension-Identifier"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	event, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return ioutil.WriteFile(filepath.Join(os.Getenv("LLR_TEST_DIR"), "event"), event, 0644)
+}
+
+func TestExecutable(t *testing.T) {
+	dir := t.TempDir()
+	code := filepath.Join(dir, "code")
+	layer := filepath.Join(dir, "layer")
+	for _, d := range []string{code, layer} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(layer, "bootstrap"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	executable, err := Executable(docker.RunContainerArgs{Runtime: "provided.al2", SourcePath: code, LayerPaths: []string{layer}})
+	if err != nil || executable != filepath.Join(layer, "bootstrap") {
+		t.Fatalf("expected the bootstrap from the layer, found %q (%v)", executable, err)
+	}
+
+	executable, err = Executable(docker.RunContainerArgs{Runtime: "go1.x", Handler: "main", SourcePath: code})
+	if err != nil || executable != filepath.Join(code, "main") {
+		t.Fatalf("expected the handler for go1.x, found %q (%v)", executable, err)
+	}
+
+	if _, err := Executable(docker.RunContainerArgs{Runtime: "provided.al2", SourcePath: code}); err == nil {
+		t.Fatalf("missing bootstrap should be an error")
+	}
+}
+
+func TestRunContainer(t *testing.T) {
+	testBinary, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := t.TempDir()
+	if err := os.Symlink(testBinary, filepath.Join(code, "bootstrap")); err != nil {
+		t.Skipf("cannot link the runtime: %v", err)
+	}
+
+	r := New()
+	r.session.dir = t.TempDir()
+	running, err := r.RunContainer(context.Background(), docker.RunContainerArgs{
+		ContainerName: "llr-HelloFunction-test",
+		FunctionName:  "HelloFunction",
+		Handler:       "hello.handler",
+		SourcePath:    code,
+		Runtime:       "provided.al2",
+		Env:           []string{"LLR_TEST_RUNTIME=1"},
+	})
+	if err != nil {
+		t.Fatalf("running process: %v", err)
+	}
+	defer r.RemoveContainer(context.Background(), running.ID)
+
+	res, err := invoke.Invoke(context.Background(), running.Addr, []byte(`{"n": 1}`))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	expected := fmt.Sprintf(`{"event": {"n": 1}, "wd": %q, "handler": "hello.handler"}`, code)
+	if string(res.Body) != expected {
+		t.Fatalf("expected %s, found %s", expected, res.Body)
+	}
+
+	var logs bytes.Buffer
+	if err := r.Logs(context.Background(), running.ID, &logs, &logs); err != nil {
+		t.Fatalf("getting logs: %v", err)
+	}
+	if !strings.Contains(logs.String(), "runtime started") || !strings.Contains(logs.String(), "REPORT RequestId: ") {
+		t.Fatalf("logs should include the process output and lifecycle lines, found %q", logs.String())
+	}
+
+	if err := r.RemoveContainer(context.Background(), running.ID); err != nil {
+		t.Fatalf("removing process: %v", err)
+	}
+	if _, err := r.WaitContainer(context.Background(), running.ID); err == nil {
+		t.Fatalf("removed process should be forgotten")
+	}
+	if files, _ := ioutil.ReadDir(r.session.dir); len(files) != 0 {
+		t.Fatalf("the pid files of stopped processes should be removed, found %d", len(files))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	if goruntime.GOOS == "windows" {
+		t.Skip("needs sleep")
+	}
+
+	// a session that has exited
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	orphan := exec.Command("sleep", "60")
+	setProcessGroup(orphan)
+	if err := orphan.Start(); err != nil {
+		t.Skipf("cannot run sleep: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		orphan.Wait()
+		close(exited)
+	}()
+
+	// a process that reused the pid of a process of the dead session
+	reused := exec.Command("sleep", "60")
+	setProcessGroup(reused)
+	if err := reused.Start(); err != nil {
+		t.Skipf("cannot run sleep: %v", err)
+	}
+	reusedExited := make(chan struct{})
+	go func() {
+		reused.Wait()
+		close(reusedExited)
+	}()
+	defer func() {
+		reused.Process.Kill()
+		<-reusedExited
+	}()
+
+	r := New()
+	r.session.dir = t.TempDir()
+	stale := session{dir: r.session.dir, pid: dead.Process.Pid}
+	stale.record(orphan.Process.Pid)
+	if err := ioutil.WriteFile(stale.file(reused.Process.Pid), []byte("an earlier start"), 0600); err != nil {
+		t.Fatalf("writing pid file: %v", err)
+	}
+	// processes of live sessions are left alone
+	r.session.record(os.Getpid())
+
+	killed, err := r.Sweep()
+	if err != nil {
+		t.Fatalf("sweeping: %v", err)
+	}
+	if killed != 1 {
+		t.Fatalf("expected 1 process killed, found %d", killed)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		orphan.Process.Kill()
+		t.Fatalf("orphaned process was not killed")
+	}
+	if _, err := os.Stat(r.session.file(os.Getpid())); err != nil {
+		t.Fatalf("the pid file of the current session should be kept: %v", err)
+	}
+	select {
+	case <-reusedExited:
+		t.Fatalf("a process reusing a recorded pid should not be killed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat(stale.file(reused.Process.Pid)); !os.IsNotExist(err) {
+		t.Fatalf("the stale pid file should be removed: %v", err)
+	}
+}
+
+func TestRunContainerExited(t *testing.T) {
+	code := t.TempDir()
+	script := "#!/bin/sh\necho 'cannot load handler' >&2\nexit 3\n"
+	if err := ioutil.WriteFile(filepath.Join(code, "bootstrap"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := New().RunContainer(context.Background(), docker.RunContainerArgs{
+		ContainerName: "llr-HelloFunction-test",
+		SourcePath:    code,
+		Runtime:       "provided.al2",
+	})
+	if err == nil {
+		t.Fatalf("process exiting should not be ready")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "exited with code 3") || !strings.Contains(msg, "cannot load handler") {
+		t.Fatalf("error should include the exit code and process output, found %q", msg)
+	}
+}
+
+func TestRunContainerUnsupported(t *testing.T) {
+	_, err := New().RunContainer(context.Background(), docker.RunContainerArgs{Runtime: "python3.9"})
+	if err == nil {
+		t.Fatalf("python functions need docker")
+	}
+}
+
+func TestRunContainerExtensions(t *testing.T) {
+	testBinary, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := t.TempDir()
+	layer := t.TempDir()
+	if err := os.Mkdir(filepath.Join(layer, "extensions"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(code, "bootstrap"), filepath.Join(layer, "extensions", "test-extension")} {
+		if err := os.Symlink(testBinary, name); err != nil {
+			t.Skipf("cannot link the runtime: %v", err)
+		}
+	}
+
+	dir := t.TempDir()
+	r := New()
+	running, err := r.RunContainer(context.Background(), docker.RunContainerArgs{
+		ContainerName: "llr-HelloFunction-test",
+		FunctionName:  "HelloFunction",
+		SourcePath:    code,
+		LayerPaths:    []string{layer},
+		Runtime:       "provided.al2",
+		Env:           []string{"LLR_TEST_RUNTIME=1", "LLR_TEST_DIR=" + dir},
+	})
+	if err != nil {
+		t.Fatalf("running process: %v", err)
+	}
+
+	if _, err := invoke.Invoke(context.Background(), running.Addr, []byte(`{}`)); err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if err := r.RemoveContainer(context.Background(), running.ID); err != nil {
+		t.Fatalf("removing process: %v", err)
+	}
+
+	event, err := ioutil.ReadFile(filepath.Join(dir, "event"))
+	if err != nil || !strings.Contains(string(event), `"eventType":"SHUTDOWN"`) {
+		t.Fatalf("the extension should receive the SHUTDOWN event, found %q (%v)", event, err)
+	}
+}
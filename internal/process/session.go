@@ -0,0 +1,110 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// session records the processes started by the running copy of this
+// program in pid files, so that they can be killed if it dies without
+// stopping them. The processes run in their own process groups, so they are
+// not killed along with it.
+type session struct {
+	// dir holds a file per process, named <session pid>-<process pid>. It
+	// contains when the process started, so that processes reusing the pid
+	// after it has exited are not killed.
+	dir string
+	pid int
+}
+
+func newSession() session {
+	return session{
+		dir: filepath.Join(os.TempDir(), fmt.Sprintf("lambda-local-runner-%d", os.Getuid())),
+		pid: os.Getpid(),
+	}
+}
+
+func (s session) file(pid int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%d-%d", s.pid, pid))
+}
+
+// record notes that a process has been started
+func (s session) record(pid int) {
+	start, err := processStart(pid)
+	if err != nil {
+		// without its start the process cannot be told apart from one
+		// reusing its pid, so it is never killed by Sweep
+		log.Debug().Err(err).Int("pid", pid).Msg("could not find when the process started")
+		return
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		log.Debug().Err(err).Msg("could not create the process directory")
+		return
+	}
+	if err := ioutil.WriteFile(s.file(pid), []byte(start), 0600); err != nil {
+		log.Debug().Err(err).Int("pid", pid).Msg("could not record the process")
+	}
+}
+
+// forget notes that a process has been stopped
+func (s session) forget(pid int) {
+	if err := os.Remove(s.file(pid)); err != nil && !os.IsNotExist(err) {
+		log.Debug().Err(err).Int("pid", pid).Msg("could not remove the process file")
+	}
+}
+
+// Sweep kills processes left behind by copies of this program that did not
+// shut down cleanly, returning the number killed
+func (r *Runner) Sweep() (int, error) {
+	entries, err := ioutil.ReadDir(r.session.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("listing processes: %w", err)
+	}
+
+	killed := 0
+	for _, entry := range entries {
+		var owner, pid int
+		if _, err := fmt.Sscanf(entry.Name(), "%d-%d", &owner, &pid); err != nil {
+			continue
+		}
+		if owner == r.session.pid || processAlive(owner) {
+			continue
+		}
+
+		name := filepath.Join(r.session.dir, entry.Name())
+		if started(pid, name) {
+			log.Debug().Int("pid", pid).Int("session", owner).Msg("killing process from a dead session")
+			err := killGroup(pid)
+			if err != nil && !errors.Is(err, os.ErrProcessDone) {
+				return killed, fmt.Errorf("killing process %d: %w", pid, err)
+			}
+			if err == nil {
+				killed++
+			}
+		}
+		if err := os.Remove(name); err != nil {
+			return killed, fmt.Errorf("removing process file: %w", err)
+		}
+	}
+	return killed, nil
+}
+
+// started checks whether the process running with the pid is the one
+// recorded in the file, rather than a process that reused its pid after a
+// crash or reboot
+func started(pid int, name string) bool {
+	recorded, err := ioutil.ReadFile(name)
+	if err != nil || len(recorded) == 0 {
+		return false
+	}
+	start, err := processStart(pid)
+	return err == nil && start == string(recorded)
+}
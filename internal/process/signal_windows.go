@@ -0,0 +1,43 @@
+package process
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminate is not supported on windows, so the process is killed
+func terminate(cmd *exec.Cmd) {
+	_ = kill(cmd)
+}
+
+func kill(cmd *exec.Cmd) error {
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+// killGroup kills a process left behind by another session, returning
+// os.ErrProcessDone if it is not running. Processes have no groups on
+// windows.
+func killGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return os.ErrProcessDone
+	}
+	return p.Kill()
+}
+
+// processAlive checks whether a process is running. Finding a process only
+// succeeds for running processes on windows.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,35 @@
+package process
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// processStart identifies when the process started: the boot and the time
+// since the boot, in clock ticks. A process whose pid has been reused has a
+// different start.
+func processStart(pid int) (string, error) {
+	bootID, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return "", fmt.Errorf("reading boot id: %w", err)
+	}
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", fmt.Errorf("reading process status: %w", err)
+	}
+
+	// the command name may contain spaces and parentheses, so the fields
+	// after it are found from the last parenthesis. The start time is the
+	// 22nd field.
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return "", fmt.Errorf("invalid process status %q", stat)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return "", fmt.Errorf("invalid process status %q", stat)
+	}
+	return strings.TrimSpace(string(bootID)) + " " + fields[19], nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package process
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processStart identifies when the process started, from its start time. A
+// process whose pid has been reused has a different start.
+func processStart(pid int) (string, error) {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", fmt.Errorf("finding process start time: %w", err)
+	}
+	start := strings.TrimSpace(string(out))
+	if start == "" {
+		return "", fmt.Errorf("process %d is not running", pid)
+	}
+	return start, nil
+}
@@ -0,0 +1,23 @@
+package process
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+)
+
+// processStart identifies when the process started, from its creation time.
+// A process whose pid has been reused has a different start.
+func processStart(pid int) (string, error) {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return "", fmt.Errorf("opening process: %w", err)
+	}
+	defer syscall.CloseHandle(h)
+
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return "", fmt.Errorf("finding process start time: %w", err)
+	}
+	return strconv.FormatInt(creation.Nanoseconds(), 10), nil
+}
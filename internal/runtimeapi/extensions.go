@@ -0,0 +1,268 @@
+package runtimeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ShutdownTimeout is how long extensions have to exit after the SHUTDOWN
+// event
+const ShutdownTimeout = 2 * time.Second
+
+// extension is an extension registered with the Extensions API
+type extension struct {
+	id   string
+	name string
+	// events are the event types the extension registered for
+	events map[string]bool
+	// queue holds events waiting for the extension to ask for them
+	queue []interface{}
+	// waiting is set while the extension is waiting for its next event,
+	// which means it has finished with the previous one
+	waiting bool
+}
+
+// done checks whether the extension has finished with the events sent to it.
+// Must be called with the lock held.
+func (e *extension) done() bool {
+	return e.waiting && len(e.queue) == 0
+}
+
+type registerRequest struct {
+	Events []string `json:"events"`
+}
+
+type registerResponse struct {
+	FunctionName    string `json:"functionName"`
+	FunctionVersion string `json:"functionVersion"`
+	Handler         string `json:"handler"`
+}
+
+type invokeEvent struct {
+	EventType          string  `json:"eventType"`
+	DeadlineMs         int64   `json:"deadlineMs"`
+	RequestID          string  `json:"requestId"`
+	InvokedFunctionArn string  `json:"invokedFunctionArn"`
+	Tracing            tracing `json:"tracing"`
+}
+
+type tracing struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type shutdownEvent struct {
+	EventType      string `json:"eventType"`
+	ShutdownReason string `json:"shutdownReason"`
+	DeadlineMs     int64  `json:"deadlineMs"`
+}
+
+// Shutdown flushes the telemetry of the extensions and sends the SHUTDOWN
+// event to the extensions registered for it. It returns the deadline by which
+// they have to exit, or the zero time if there are none.
+func (s *Server) Shutdown() time.Time {
+	s.flushSubscriptions()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline := time.Now().Add(ShutdownTimeout)
+	var subscribed bool
+	for _, ext := range s.extensions {
+		if !ext.events["SHUTDOWN"] {
+			continue
+		}
+		subscribed = true
+		ext.queue = append(ext.queue, shutdownEvent{
+			EventType:      "SHUTDOWN",
+			ShutdownReason: "spindown",
+			DeadlineMs:     milliseconds(deadline),
+		})
+	}
+	if !subscribed {
+		return time.Time{}
+	}
+	s.notify()
+	return deadline
+}
+
+// handleRegister registers an extension for the events in the request
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get("Lambda-Extension-Name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "missing Lambda-Extension-Name header")
+		return
+	}
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", fmt.Sprintf("invalid registration: %v", err))
+		return
+	}
+	events := make(map[string]bool)
+	for _, event := range req.Events {
+		if event != "INVOKE" && event != "SHUTDOWN" {
+			writeError(w, http.StatusBadRequest, "Extension.InvalidEventType", fmt.Sprintf("unknown event type %s", event))
+			return
+		}
+		events[event] = true
+	}
+
+	ext := &extension{
+		id:     newRequestID(),
+		name:   name,
+		events: events,
+	}
+	s.mu.Lock()
+	if s.initialised || s.initErr != nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusForbidden, "State.InvalidStateTransition", "extensions can only register while the function initialises")
+		return
+	}
+	s.extensions = append(s.extensions, ext)
+	s.mu.Unlock()
+	log.Debug().Str("function", s.cfg.FunctionName).Str("extension", name).Strs("events", req.Events).Msg("extension registered")
+
+	w.Header().Set("Lambda-Extension-Identifier", ext.id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(registerResponse{
+		FunctionName:    s.cfg.FunctionName,
+		FunctionVersion: "$LATEST",
+		Handler:         s.cfg.Handler,
+	})
+}
+
+// handleEventNext hands the next event to an extension, waiting for one if
+// there are none queued. Asking for the next event also tells the Server
+// that the extension has finished initialising, or with the previous event.
+func (s *Server) handleEventNext(w http.ResponseWriter, r *http.Request) {
+	ext, ok := s.extension(r)
+	if !ok {
+		writeUnknownExtension(w)
+		return
+	}
+
+	var event interface{}
+	for {
+		s.mu.Lock()
+		if len(ext.queue) > 0 {
+			event = ext.queue[0]
+			ext.queue = ext.queue[1:]
+			ext.waiting = false
+			s.mu.Unlock()
+			break
+		}
+		if !ext.waiting {
+			ext.waiting = true
+			s.checkInit()
+			if s.reporting != nil && s.extensionsDone() {
+				s.end(s.reporting)
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Lambda-Extension-Event-Identifier", newRequestID())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(event)
+}
+
+// handleExtensionInitError records that an extension failed to initialise,
+// which fails the function like an error from the runtime
+func (s *Server) handleExtensionInitError(w http.ResponseWriter, r *http.Request) {
+	ext, ok := s.extension(r)
+	if !ok {
+		writeUnknownExtension(w)
+		return
+	}
+
+	body, _ := readPayload(r.Body)
+	res := result{body: body, errorType: extensionErrorType(r)}
+	log.Debug().Str("function", s.cfg.FunctionName).Str("extension", ext.name).Str("error_type", res.errorType).Msg("extension failed to initialise")
+	s.failInit(res)
+	writeAccepted(w)
+}
+
+// handleExtensionExitError records that an extension is exiting because of
+// an error
+func (s *Server) handleExtensionExitError(w http.ResponseWriter, r *http.Request) {
+	ext, ok := s.extension(r)
+	if !ok {
+		writeUnknownExtension(w)
+		return
+	}
+
+	log.Warn().Str("function", s.cfg.FunctionName).Str("extension", ext.name).Str("error_type", extensionErrorType(r)).Msg("extension exited with an error")
+	writeAccepted(w)
+}
+
+// sendInvokeEvent queues the INVOKE event of the invocation for the
+// extensions registered for it. Must be called with the lock held.
+func (s *Server) sendInvokeEvent(inv *invocation) {
+	for _, ext := range s.extensions {
+		if !ext.events["INVOKE"] {
+			continue
+		}
+		ext.queue = append(ext.queue, invokeEvent{
+			EventType:          "INVOKE",
+			DeadlineMs:         milliseconds(inv.deadline),
+			RequestID:          inv.requestID,
+			InvokedFunctionArn: s.functionARN(),
+			Tracing: tracing{
+				Type:  "X-Amzn-Trace-Id",
+				Value: inv.traceID,
+			},
+		})
+	}
+	s.notify()
+}
+
+// extensionsDone checks whether the extensions have finished with the
+// current invocation. Must be called with the lock held.
+func (s *Server) extensionsDone() bool {
+	for _, ext := range s.extensions {
+		if ext.events["INVOKE"] && !ext.done() {
+			return false
+		}
+	}
+	return true
+}
+
+// extension finds the registered extension making the request
+func (s *Server) extension(r *http.Request) (*extension, bool) {
+	id := r.Header.Get("Lambda-Extension-Identifier")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ext := range s.extensions {
+		if ext.id == id {
+			return ext, true
+		}
+	}
+	return nil, false
+}
+
+// extensionErrorType returns the type of an error reported by an extension
+func extensionErrorType(r *http.Request) string {
+	if t := r.Header.Get("Lambda-Extension-Function-Error-Type"); t != "" {
+		return t
+	}
+	return "Extension.Unknown"
+}
+
+func writeUnknownExtension(w http.ResponseWriter) {
+	writeError(w, http.StatusForbidden, "Extension.UnknownExtensionIdentifier", "Unknown extension identifier")
+}
@@ -0,0 +1,685 @@
+// Package runtimeapi emulates the Lambda Runtime API, which the runtime in a
+// lambda container polls for invocations, along with the invoke endpoint of
+// the runtime interface emulator that invocations are sent to. The
+// Extensions, Telemetry and Logs APIs used by lambda extensions are served
+// alongside it.
+package runtimeapi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxPayloadSize is the largest event or response lambda accepts
+	maxPayloadSize = 6 * 1024 * 1024
+	// DefaultTimeout is used if the config has no timeout
+	DefaultTimeout = 300 * time.Second
+	// DefaultMemorySize is used if the config has no memory size
+	DefaultMemorySize = 128
+)
+
+// Config holds the settings of the function served by a Server
+type Config struct {
+	// FunctionName is reported to the runtime in the function ARN
+	FunctionName string
+	// Region is reported to the runtime in the function ARN
+	Region string
+	// MemorySize is the memory of the function in MB, reported in REPORT
+	// lines
+	MemorySize int
+	// Timeout limits how long an invocation may take, including waiting
+	// for the runtime to initialise
+	Timeout time.Duration
+	// Handler is reported to extensions when they register
+	Handler string
+	// Extensions are the names of the extensions started along with the
+	// runtime. The function is only initialised once they have all
+	// registered.
+	Extensions []string
+}
+
+// Server serves the Runtime API for a single lambda container, handing the
+// invocations it receives to the runtime one at a time
+type Server struct {
+	cfg      Config
+	listener net.Listener
+	srv      *http.Server
+	started  time.Time
+
+	// ready is closed once the runtime and extensions are waiting for
+	// events, or initialisation has failed
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	mu sync.Mutex
+	// queue holds invocations waiting for the runtime to ask for them
+	queue []*invocation
+	// running holds invocations handed to the runtime, by request ID
+	running map[string]*invocation
+	// changed is closed and replaced whenever an invocation is queued, or
+	// the runtime or an extension is waiting for the next event
+	changed chan struct{}
+	// extensions are the registered extensions, in order of registration
+	extensions []*extension
+	// reporting is the invocation the runtime has responded to, while the
+	// extensions are still handling it
+	reporting *invocation
+	// initDuration is how long the runtime and extensions took to
+	// initialise. It is reported with the first invocation.
+	initDuration  time.Duration
+	runtimeWaited bool
+	initialised   bool
+	reportedInit  bool
+	// initErr is set if the runtime or an extension failed to initialise
+	initErr *result
+	// logs receives the lifecycle lines of invocations. They are buffered
+	// in history until it is set.
+	logs    io.Writer
+	history []string
+
+	// subscriptionsMu guards the telemetry subscriptions, and is taken
+	// after mu
+	subscriptionsMu sync.Mutex
+	subscriptions   []*subscription
+	// sandboxHost replaces sandbox.localdomain in telemetry destinations
+	sandboxHost string
+	// unreachable says why telemetry cannot be delivered to extensions, if
+	// they cannot be reached from here
+	unreachable string
+}
+
+// invocation is a single event waiting for, or being handled by, the runtime
+type invocation struct {
+	requestID string
+	payload   []byte
+	deadline  time.Time
+	traceID   string
+	started   time.Time
+	// status is success, error or timeout once the runtime has finished
+	status string
+	// done receives the result once the runtime has responded
+	done chan result
+}
+
+// result is the outcome of an invocation
+type result struct {
+	body []byte
+	// errorType is set if the function failed
+	errorType string
+}
+
+// errorResponse is the payload of errors reported by the Server itself
+type errorResponse struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+// Listen starts serving the Runtime API on the given address (host:port)
+func Listen(addr string, cfg Config) (*Server, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MemorySize <= 0 {
+		cfg.MemorySize = DefaultMemorySize
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+
+	s := &Server{
+		cfg:      cfg,
+		listener: listener,
+		started:  time.Now(),
+		ready:    make(chan struct{}),
+		running:  make(map[string]*invocation),
+		changed:  make(chan struct{}),
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/2018-06-01/runtime/invocation/next", s.handleNext).Methods("GET")
+	r.HandleFunc("/2018-06-01/runtime/invocation/{requestID}/response", s.handleResponse).Methods("POST")
+	r.HandleFunc("/2018-06-01/runtime/invocation/{requestID}/error", s.handleError).Methods("POST")
+	r.HandleFunc("/2018-06-01/runtime/init/error", s.handleInitError).Methods("POST")
+	r.HandleFunc("/2020-01-01/extension/register", s.handleRegister).Methods("POST")
+	r.HandleFunc("/2020-01-01/extension/event/next", s.handleEventNext).Methods("GET")
+	r.HandleFunc("/2020-01-01/extension/init/error", s.handleExtensionInitError).Methods("POST")
+	r.HandleFunc("/2020-01-01/extension/exit/error", s.handleExtensionExitError).Methods("POST")
+	r.HandleFunc("/2022-07-01/telemetry", s.handleSubscribe(telemetryAPI)).Methods("PUT")
+	r.HandleFunc("/2020-08-15/logs", s.handleSubscribe(logsAPI)).Methods("PUT")
+	r.HandleFunc("/2015-03-31/functions/function/invocations", s.handleInvoke)
+	s.srv = &http.Server{Handler: r}
+
+	go func() {
+		if err := s.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warn().Err(err).Str("function", cfg.FunctionName).Msg("runtime API stopped")
+		}
+	}()
+	return s, nil
+}
+
+// Port returns the port the Server listens on
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Ready is closed once the runtime and extensions have initialised and are
+// waiting for invocations, or an initialisation error has been reported
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// InitError returns the error reported by the runtime if it failed to
+// initialise
+func (s *Server) InitError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.initErr == nil {
+		return nil
+	}
+	var res errorResponse
+	if err := json.Unmarshal(s.initErr.body, &res); err != nil || res.ErrorMessage == "" {
+		return fmt.Errorf("%s", s.initErr.errorType)
+	}
+	return fmt.Errorf("%s: %s", s.initErr.errorType, res.ErrorMessage)
+}
+
+// SetLogs sends the START, END and REPORT lines of invocations to w, after
+// the lines written so far
+func (s *Server) SetLogs(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, line := range s.history {
+		fmt.Fprintln(w, line)
+	}
+	s.history = nil
+	s.logs = w
+}
+
+// CopyLogs writes the lifecycle lines written so far to w, if SetLogs has not
+// been called
+func (s *Server) CopyLogs(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, line := range s.history {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// Close stops the Server. Invocations that have not finished fail.
+func (s *Server) Close() error {
+	s.stopSubscriptions()
+
+	s.mu.Lock()
+	pending := append([]*invocation{}, s.queue...)
+	for _, inv := range s.running {
+		pending = append(pending, inv)
+	}
+	s.queue = nil
+	s.running = make(map[string]*invocation)
+	s.mu.Unlock()
+
+	for _, inv := range pending {
+		inv.done <- errorResult("Runtime.Exited", "RequestId: "+inv.requestID+" Error: the runtime has stopped")
+	}
+	return s.srv.Close()
+}
+
+// handleInvoke runs the event in the request body, like the invoke endpoint
+// of the runtime interface emulator
+func (s *Server) handleInvoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		// used to check whether the server is up
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := readPayload(r.Body)
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "RequestEntityTooLargeException", err.Error())
+		return
+	}
+
+	res, requestID, err := s.invoke(r.Context(), payload)
+	if err != nil {
+		// the caller has gone away
+		return
+	}
+
+	w.Header().Set("X-Amzn-Requestid", requestID)
+	w.Header().Set("X-Amz-Executed-Version", "$LATEST")
+	if res.errorType != "" {
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+		w.Header().Set(invoke.ErrorTypeHeader, res.errorType)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(res.body)
+}
+
+// invoke queues the event for the runtime and waits for the result
+func (s *Server) invoke(ctx context.Context, payload []byte) (result, string, error) {
+	inv := &invocation{
+		requestID: newRequestID(),
+		payload:   payload,
+		deadline:  time.Now().Add(s.cfg.Timeout),
+		traceID:   newTraceID(),
+		done:      make(chan result, 1),
+	}
+
+	s.mu.Lock()
+	if s.initErr != nil {
+		res := *s.initErr
+		s.mu.Unlock()
+		return res, inv.requestID, nil
+	}
+	s.queue = append(s.queue, inv)
+	s.notify()
+	s.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(inv.deadline))
+	defer timer.Stop()
+
+	select {
+	case res := <-inv.done:
+		return res, inv.requestID, nil
+	case <-timer.C:
+		s.timeout(inv)
+		return <-inv.done, inv.requestID, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		// the runtime still responds to an invocation it has started
+		s.queue = withoutInvocation(s.queue, inv)
+		s.mu.Unlock()
+		return result{}, inv.requestID, ctx.Err()
+	}
+}
+
+// timeout fails an invocation that has taken too long
+func (s *Server) timeout(inv *invocation) {
+	s.mu.Lock()
+	queued := len(withoutInvocation(s.queue, inv)) < len(s.queue)
+	s.queue = withoutInvocation(s.queue, inv)
+	_, running := s.running[inv.requestID]
+	s.mu.Unlock()
+
+	message := fmt.Sprintf("Task timed out after %.2f seconds", s.cfg.Timeout.Seconds())
+	res := errorResult("Sandbox.Timedout", "RequestId: "+inv.requestID+" Error: "+message)
+	switch {
+	case queued:
+		// the invocation never reached the runtime
+		inv.done <- res
+	case running:
+		s.writeLog(fmt.Sprintf("%s %s %s", time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), inv.requestID, message))
+		// the runtime may have responded in the meantime, in which case
+		// its result is used
+		s.finish(inv.requestID, res)
+	}
+}
+
+// handleNext hands the next invocation to the runtime, waiting for one if
+// there are none queued. Invocations are only handed out once the
+// extensions have initialised and finished with the previous invocation.
+func (s *Server) handleNext(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.runtimeWaited = true
+	s.checkInit()
+	s.mu.Unlock()
+
+	var inv *invocation
+	for {
+		s.mu.Lock()
+		if s.initialised && s.reporting == nil && len(s.queue) > 0 {
+			inv = s.queue[0]
+			s.queue = s.queue[1:]
+			inv.started = time.Now()
+			s.running[inv.requestID] = inv
+			s.sendInvokeEvent(inv)
+			s.mu.Unlock()
+			break
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	s.writeLog(fmt.Sprintf("START RequestId: %s Version: $LATEST", inv.requestID))
+	s.emit("", "platform", "platform.start", startRecord{RequestID: inv.requestID, Version: "$LATEST"})
+
+	h := w.Header()
+	h.Set("Lambda-Runtime-Aws-Request-Id", inv.requestID)
+	h.Set("Lambda-Runtime-Deadline-Ms", strconv.FormatInt(milliseconds(inv.deadline), 10))
+	h.Set("Lambda-Runtime-Invoked-Function-Arn", s.functionARN())
+	h.Set("Lambda-Runtime-Trace-Id", inv.traceID)
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(inv.payload)
+}
+
+// handleResponse records the result of an invocation
+func (s *Server) handleResponse(w http.ResponseWriter, r *http.Request) {
+	requestID := mux.Vars(r)["requestID"]
+	body, err := readPayload(r.Body)
+	if err != nil {
+		message := fmt.Sprintf("Response payload size exceeded maximum allowed payload size (%d bytes).", maxPayloadSize)
+		s.finish(requestID, errorResult("Function.ResponseSizeTooLarge", message))
+		writeError(w, http.StatusRequestEntityTooLarge, "RequestEntityTooLarge", message)
+		return
+	}
+
+	if !s.finish(requestID, result{body: body}) {
+		writeError(w, http.StatusBadRequest, "InvalidRequestID", "Invalid request ID")
+		return
+	}
+	writeAccepted(w)
+}
+
+// handleError records the error raised by an invocation
+func (s *Server) handleError(w http.ResponseWriter, r *http.Request) {
+	requestID := mux.Vars(r)["requestID"]
+	body, _ := readPayload(r.Body)
+
+	if !s.finish(requestID, result{body: body, errorType: errorType(r)}) {
+		writeError(w, http.StatusBadRequest, "InvalidRequestID", "Invalid request ID")
+		return
+	}
+	writeAccepted(w)
+}
+
+// handleInitError records that the runtime failed to initialise
+func (s *Server) handleInitError(w http.ResponseWriter, r *http.Request) {
+	body, _ := readPayload(r.Body)
+	s.failInit(result{body: body, errorType: errorType(r)})
+	writeAccepted(w)
+}
+
+// failInit fails the queued invocations and any that follow with the
+// initialisation error
+func (s *Server) failInit(res result) {
+	s.mu.Lock()
+	s.initErr = &res
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+	s.markReady()
+
+	for _, inv := range queue {
+		inv.done <- res
+	}
+}
+
+// checkInit finishes initialisation once the runtime and all of the
+// extensions are waiting for events. Must be called with the lock held.
+func (s *Server) checkInit() {
+	if s.initialised || !s.runtimeWaited || len(s.extensions) < len(s.cfg.Extensions) {
+		return
+	}
+	for _, ext := range s.extensions {
+		if !ext.waiting {
+			return
+		}
+	}
+
+	s.initialised = true
+	s.initDuration = time.Since(s.started)
+	s.markReady()
+	s.notify()
+}
+
+// InitPending describes what the function is waiting for before it is
+// initialised: extensions that have not registered or asked for their first
+// event, or the runtime. It is empty once the function is initialised.
+func (s *Server) InitPending() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.initialised || s.initErr != nil {
+		return ""
+	}
+
+	registered := make(map[string]bool)
+	var waiting []string
+	for _, ext := range s.extensions {
+		registered[ext.name] = true
+		if !ext.waiting {
+			waiting = append(waiting, ext.name)
+		}
+	}
+	var unregistered []string
+	for _, name := range s.cfg.Extensions {
+		if !registered[name] {
+			unregistered = append(unregistered, name)
+		}
+	}
+
+	var pending []string
+	if len(unregistered) > 0 {
+		pending = append(pending, "extensions that did not register: "+strings.Join(unregistered, ", "))
+	}
+	if len(waiting) > 0 {
+		pending = append(pending, "extensions that did not ask for an event: "+strings.Join(waiting, ", "))
+	}
+	if !s.runtimeWaited {
+		pending = append(pending, "the runtime")
+	}
+	return strings.Join(pending, "; ")
+}
+
+// finish completes a running invocation, returning false if there is no
+// such invocation, e.g. because it has timed out. The result is returned
+// straight away, but the invocation only ends once the extensions have
+// finished with it too.
+func (s *Server) finish(requestID string, res result) bool {
+	s.mu.Lock()
+	inv, ok := s.running[requestID]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.running, requestID)
+
+	inv.status = invocationStatus(res)
+	s.emit(telemetryAPI, "platform", "platform.runtimeDone", runtimeDoneRecord{
+		RequestID: requestID,
+		Status:    inv.status,
+		Metrics:   runtimeDoneMetrics{DurationMs: durationMs(time.Since(inv.started))},
+	})
+	if s.extensionsDone() {
+		s.end(inv)
+	} else {
+		s.reporting = inv
+		// extensions that are still busy at the deadline are not waited
+		// for any longer
+		time.AfterFunc(time.Until(inv.deadline), func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.reporting == inv {
+				log.Warn().Str("function", s.cfg.FunctionName).Str("request_id", inv.requestID).Msg("extensions did not finish the invocation before the timeout")
+				s.end(inv)
+			}
+		})
+	}
+	s.mu.Unlock()
+
+	inv.done <- res
+	return true
+}
+
+// end writes the END and REPORT lines of an invocation, so the runtime can
+// be given the next one. Must be called with the lock held.
+func (s *Server) end(inv *invocation) {
+	s.reporting = nil
+
+	var initDuration time.Duration
+	if !s.reportedInit {
+		s.reportedInit = true
+		initDuration = s.initDuration
+	}
+
+	duration := time.Since(inv.started)
+	s.writeLogLocked(fmt.Sprintf("END RequestId: %s", inv.requestID))
+	s.writeLogLocked(s.report(inv.requestID, duration, initDuration))
+	s.emit(logsAPI, "platform", "platform.end", endRecord{RequestID: inv.requestID})
+	s.emit("", "platform", "platform.report", s.reportRecord(inv, duration, initDuration))
+	s.notify()
+}
+
+// report formats the REPORT line of an invocation
+func (s *Server) report(requestID string, duration, initDuration time.Duration) string {
+	ms := float64(duration) / float64(time.Millisecond)
+	line := fmt.Sprintf("REPORT RequestId: %s\t", requestID)
+	if initDuration > 0 {
+		line += fmt.Sprintf("Init Duration: %.2f ms\t", float64(initDuration)/float64(time.Millisecond))
+	}
+	// memory usage is not measured, so the whole memory size is reported
+	// as used, like the runtime interface emulator
+	return line + fmt.Sprintf("Duration: %.2f ms\tBilled Duration: %.0f ms\tMemory Size: %d MB\tMax Memory Used: %d MB\t",
+		ms, math.Ceil(ms), s.cfg.MemorySize, s.cfg.MemorySize)
+}
+
+// writeLog sends a lifecycle line to the logs, or keeps it until they are
+// set
+func (s *Server) writeLog(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writeLogLocked(line)
+}
+
+// writeLogLocked is writeLog with the lock held
+func (s *Server) writeLogLocked(line string) {
+	if s.logs == nil {
+		s.history = append(s.history, line)
+		return
+	}
+	fmt.Fprintln(s.logs, line)
+}
+
+func (s *Server) markReady() {
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// notify wakes up the runtime if it is waiting for an invocation. Must be
+// called with the lock held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) functionARN() string {
+	region := s.cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return fmt.Sprintf("arn:aws:lambda:%s:000000000000:function:%s", region, s.cfg.FunctionName)
+}
+
+// withoutInvocation returns the queue with inv removed
+func withoutInvocation(queue []*invocation, inv *invocation) []*invocation {
+	for i, other := range queue {
+		if other == inv {
+			return append(queue[:i:i], queue[i+1:]...)
+		}
+	}
+	return queue
+}
+
+// readPayload reads a request body, failing if it is larger than lambda
+// allows
+func readPayload(body io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxPayloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPayloadSize {
+		return nil, fmt.Errorf("payload is larger than %d bytes", maxPayloadSize)
+	}
+	return b, nil
+}
+
+// errorType returns the type of a function error reported by the runtime
+func errorType(r *http.Request) string {
+	if t := r.Header.Get("Lambda-Runtime-Function-Error-Type"); t != "" {
+		return t
+	}
+	return "Runtime.Unknown"
+}
+
+// invocationStatus reports the outcome of an invocation to extensions
+func invocationStatus(res result) string {
+	switch res.errorType {
+	case "":
+		return "success"
+	case "Sandbox.Timedout":
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+func errorResult(errorType, message string) result {
+	body, _ := json.Marshal(errorResponse{ErrorMessage: message, ErrorType: errorType})
+	return result{body: body, errorType: errorType}
+}
+
+func writeAccepted(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(`{"status":"OK"}`))
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{ErrorMessage: message, ErrorType: errorType})
+}
+
+// milliseconds returns the time in milliseconds since the epoch
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// newRequestID returns a random UUID
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// newTraceID returns an X-Ray trace header for an invocation that is not
+// sampled
+func newTraceID() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("Root=1-%08x-%s;Parent=%s;Sampled=0", time.Now().Unix(), hex.EncodeToString(b[:12]), hex.EncodeToString(b[12:]))
+}
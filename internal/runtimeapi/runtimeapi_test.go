@@ -0,0 +1,317 @@
+package runtimeapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to write to from several
+// goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func listen(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+
+	s, err := Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, fmt.Sprintf("127.0.0.1:%d", s.Port())
+}
+
+// next polls for the next invocation like a runtime, returning its request
+// ID and payload
+func next(t *testing.T, addr string) (string, string, http.Header) {
+	t.Helper()
+
+	resp, err := http.Get("http://" + addr + "/2018-06-01/runtime/invocation/next")
+	if err != nil {
+		t.Errorf("getting next invocation: %v", err)
+		return "", "", nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.Header.Get("Lambda-Runtime-Aws-Request-Id"), string(body), resp.Header
+}
+
+func post(t *testing.T, url string, body string, header http.Header) int {
+	t.Helper()
+
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("posting to %s: %v", url, err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestInvoke(t *testing.T) {
+	s, addr := listen(t, Config{FunctionName: "HelloFunction", Region: "eu-west-2"})
+	var logs syncBuffer
+	s.SetLogs(&logs)
+
+	// a runtime that echoes events back
+	go func() {
+		for i := 0; i < 2; i++ {
+			requestID, payload, header := next(t, addr)
+			if arn := header.Get("Lambda-Runtime-Invoked-Function-Arn"); arn != "arn:aws:lambda:eu-west-2:000000000000:function:HelloFunction" {
+				t.Errorf("invalid function arn %s", arn)
+			}
+			if status := post(t, "http://"+addr+"/2018-06-01/runtime/invocation/"+requestID+"/response", payload, nil); status != http.StatusAccepted {
+				t.Errorf("invalid status %d for response", status)
+			}
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		res, err := invoke.Invoke(context.Background(), addr, []byte(`{"n": 1}`))
+		if err != nil {
+			t.Fatalf("invoking: %v", err)
+		}
+		if string(res.Body) != `{"n": 1}` || res.FunctionError {
+			t.Fatalf("invalid result %+v", res)
+		}
+	}
+
+	select {
+	case <-s.Ready():
+	default:
+		t.Fatalf("runtime should be ready once it has asked for an invocation")
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected START, END and REPORT lines for each invocation, found %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "START RequestId: ") || !strings.HasPrefix(lines[1], "END RequestId: ") {
+		t.Fatalf("invalid lifecycle lines %q", lines)
+	}
+	if !strings.Contains(lines[2], "Init Duration") || strings.Contains(lines[5], "Init Duration") {
+		t.Fatalf("only the first REPORT line should have the init duration, found %q", lines)
+	}
+}
+
+func TestInvokeError(t *testing.T) {
+	_, addr := listen(t, Config{})
+
+	go func() {
+		requestID, _, _ := next(t, addr)
+		post(t, "http://"+addr+"/2018-06-01/runtime/invocation/"+requestID+"/error",
+			`{"errorMessage": "boom", "errorType": "ValueError"}`,
+			http.Header{"Lambda-Runtime-Function-Error-Type": {"Unhandled"}})
+	}()
+
+	res, err := invoke.Invoke(context.Background(), addr, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if !res.FunctionError || !strings.Contains(string(res.Body), "boom") {
+		t.Fatalf("expected the function error, found %+v", res)
+	}
+}
+
+func TestInvokeTimeout(t *testing.T) {
+	s, addr := listen(t, Config{Timeout: 100 * time.Millisecond})
+	var logs syncBuffer
+	s.SetLogs(&logs)
+
+	requestIDs := make(chan string, 1)
+	go func() {
+		requestID, _, _ := next(t, addr)
+		requestIDs <- requestID
+	}()
+
+	res, err := invoke.Invoke(context.Background(), addr, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if !res.FunctionError || !res.TimedOut || !strings.Contains(string(res.Body), "Sandbox.Timedout") {
+		t.Fatalf("expected a timeout, found %+v", res)
+	}
+	if !strings.Contains(logs.String(), "Task timed out after 0.10 seconds") {
+		t.Fatalf("timeout should be logged, found %q", logs.String())
+	}
+
+	// the response arrives too late
+	if status := post(t, "http://"+addr+"/2018-06-01/runtime/invocation/"+<-requestIDs+"/response", `{}`, nil); status != http.StatusBadRequest {
+		t.Fatalf("late response should be rejected, got status %d", status)
+	}
+}
+
+func TestInitError(t *testing.T) {
+	s, addr := listen(t, Config{})
+
+	status := post(t, "http://"+addr+"/2018-06-01/runtime/init/error",
+		`{"errorMessage": "No module named 'app'", "errorType": "Runtime.ImportModuleError"}`,
+		http.Header{"Lambda-Runtime-Function-Error-Type": {"Runtime.ImportModuleError"}})
+	if status != http.StatusAccepted {
+		t.Fatalf("invalid status %d for init error", status)
+	}
+
+	select {
+	case <-s.Ready():
+	default:
+		t.Fatalf("failing to initialise should finish waiting for the runtime")
+	}
+	if err := s.InitError(); err == nil || !strings.Contains(err.Error(), "No module named 'app'") {
+		t.Fatalf("expected the init error, found %v", err)
+	}
+
+	res, err := invoke.Invoke(context.Background(), addr, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if !res.FunctionError {
+		t.Fatalf("invocations should fail after an init error, found %+v", res)
+	}
+}
+
+// extensionRequest sends a request to the Extensions API as the extension
+// with the identifier, returning the response body and headers
+func extensionRequest(t *testing.T, method, url, id, body string) (string, http.Header) {
+	t.Helper()
+
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Lambda-Extension-Name", "test-extension")
+	if id != "" {
+		req.Header.Set("Lambda-Extension-Identifier", id)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("requesting %s: %v", url, err)
+		return "", nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		t.Errorf("invalid status %d for %s", resp.StatusCode, url)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	return string(b), resp.Header
+}
+
+func TestExtensions(t *testing.T) {
+	s, addr := listen(t, Config{FunctionName: "HelloFunction", Extensions: []string{"test-extension"}})
+	var logs syncBuffer
+	s.SetLogs(&logs)
+
+	// the destination of the telemetry, where the extension listens
+	var telemetry syncBuffer
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		telemetry.Write(b)
+	}))
+	defer destination.Close()
+	s.SetSandboxHost("127.0.0.1")
+
+	// the runtime asks for the first invocation before the extension has
+	// initialised
+	go func() {
+		requestID, payload, _ := next(t, addr)
+		post(t, "http://"+addr+"/2018-06-01/runtime/invocation/"+requestID+"/response", payload, nil)
+	}()
+
+	_, header := extensionRequest(t, "POST", "http://"+addr+"/2020-01-01/extension/register", "", `{"events": ["INVOKE", "SHUTDOWN"]}`)
+	id := header.Get("Lambda-Extension-Identifier")
+	subscription := fmt.Sprintf(`{"destination": {"protocol": "HTTP", "URI": "http://sandbox.localdomain:%s"}, "types": ["platform"], "buffering": {"timeoutMs": 25}}`, strings.TrimPrefix(destination.URL, "http://127.0.0.1:"))
+	extensionRequest(t, "PUT", "http://"+addr+"/2022-07-01/telemetry", id, subscription)
+
+	select {
+	case <-s.Ready():
+		t.Fatalf("function should not be ready before the extension has initialised")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	events := make(chan string)
+	go func() {
+		for i := 0; i < 2; i++ {
+			event, _ := extensionRequest(t, "GET", "http://"+addr+"/2020-01-01/extension/event/next", id, "")
+			events <- event
+			// the extension takes a while to process the invocation
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	if _, err := invoke.Invoke(context.Background(), addr, []byte(`{}`)); err != nil {
+		t.Fatalf("invoking: %v", err)
+	}
+	if event := <-events; !strings.Contains(event, `"eventType":"INVOKE"`) {
+		t.Fatalf("expected the INVOKE event, found %s", event)
+	}
+
+	// the invocation ends once the extension asks for the next event
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), "REPORT") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var duration float64
+	for _, field := range strings.Split(logs.String(), "\t") {
+		if strings.HasPrefix(field, "Duration: ") {
+			fmt.Sscanf(field, "Duration: %f ms", &duration)
+		}
+	}
+	if duration < 100 {
+		t.Fatalf("duration should include the extension, found %q", logs.String())
+	}
+
+	if s.Shutdown().IsZero() {
+		t.Fatalf("the extension should be sent the SHUTDOWN event")
+	}
+	if event := <-events; !strings.Contains(event, `"eventType":"SHUTDOWN"`) {
+		t.Fatalf("expected the SHUTDOWN event, found %s", event)
+	}
+	if !strings.Contains(telemetry.String(), `"type":"platform.report"`) {
+		t.Fatalf("the report should be sent to the telemetry destination, found %q", telemetry.String())
+	}
+}
+
+func TestInitPending(t *testing.T) {
+	s, addr := listen(t, Config{FunctionName: "HelloFunction", Extensions: []string{"test-extension", "other-extension"}})
+	s.SetUnreachable("for testing")
+
+	_, header := extensionRequest(t, "POST", "http://"+addr+"/2020-01-01/extension/register", "", `{"events": ["SHUTDOWN"]}`)
+	id := header.Get("Lambda-Extension-Identifier")
+	extensionRequest(t, "PUT", "http://"+addr+"/2022-07-01/telemetry", id, `{"destination": {"protocol": "HTTP", "URI": "http://sandbox.localdomain:4243"}, "types": ["platform"]}`)
+
+	pending := s.InitPending()
+	if !strings.HasPrefix(pending, "extensions that did not register: other-extension;") {
+		t.Fatalf("the unregistered extension should be pending, found %q", pending)
+	}
+
+	// no telemetry is sent to extensions that cannot be reached
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+	if len(s.subscriptions) != 0 {
+		t.Fatalf("the subscription should be ignored, found %d", len(s.subscriptions))
+	}
+}
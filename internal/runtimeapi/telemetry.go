@@ -0,0 +1,389 @@
+package runtimeapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// telemetryAPI and logsAPI identify the API a subscription was made
+	// with, as some events differ between them
+	telemetryAPI = "telemetry"
+	logsAPI      = "logs"
+
+	// defaultBufferingTimeout and defaultBufferingItems are used when a
+	// subscription does not configure buffering
+	defaultBufferingTimeout = time.Second
+	defaultBufferingItems   = 1000
+	// minBufferingTimeout is the shortest buffering lambda allows
+	minBufferingTimeout = 25 * time.Millisecond
+	// sendTimeout limits how long an extension may take to accept a batch
+	sendTimeout = time.Second
+)
+
+// subscription sends telemetry to an extension in batches
+type subscription struct {
+	api string
+	uri string
+	// types are the categories of events sent: platform, function or
+	// extension
+	types    map[string]bool
+	maxItems int
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	events []telemetryEvent
+	// full receives when the buffer reaches maxItems
+	full chan struct{}
+	// stop is closed when the Server closes
+	stop chan struct{}
+	// failed is set once sending to the extension has failed, after which
+	// failures are only logged at debug level
+	failed bool
+}
+
+type telemetryEvent struct {
+	Time   string      `json:"time"`
+	Type   string      `json:"type"`
+	Record interface{} `json:"record"`
+}
+
+type subscribeRequest struct {
+	SchemaVersion string `json:"schemaVersion"`
+	Destination   struct {
+		Protocol string `json:"protocol"`
+		URI      string `json:"URI"`
+	} `json:"destination"`
+	Types     []string `json:"types"`
+	Buffering struct {
+		MaxItems  int `json:"maxItems"`
+		MaxBytes  int `json:"maxBytes"`
+		TimeoutMs int `json:"timeoutMs"`
+	} `json:"buffering"`
+}
+
+type startRecord struct {
+	RequestID string `json:"requestId"`
+	Version   string `json:"version"`
+}
+
+type endRecord struct {
+	RequestID string `json:"requestId"`
+}
+
+type runtimeDoneRecord struct {
+	RequestID string             `json:"requestId"`
+	Status    string             `json:"status"`
+	Metrics   runtimeDoneMetrics `json:"metrics"`
+}
+
+type runtimeDoneMetrics struct {
+	DurationMs float64 `json:"durationMs"`
+}
+
+type reportRecord struct {
+	RequestID string        `json:"requestId"`
+	Status    string        `json:"status"`
+	Metrics   reportMetrics `json:"metrics"`
+}
+
+type reportMetrics struct {
+	DurationMs       float64 `json:"durationMs"`
+	BilledDurationMs float64 `json:"billedDurationMs"`
+	MemorySizeMB     int     `json:"memorySizeMB"`
+	MaxMemoryUsedMB  int     `json:"maxMemoryUsedMB"`
+	InitDurationMs   float64 `json:"initDurationMs,omitempty"`
+}
+
+// SetSandboxHost sets the host that telemetry sent to sandbox.localdomain,
+// where extensions listen in lambda, is delivered to
+func (s *Server) SetSandboxHost(host string) {
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+
+	s.sandboxHost = host
+}
+
+// SetUnreachable disables the delivery of telemetry to the extensions, as
+// they cannot be reached from here for the given reason. Extensions can
+// still subscribe, and a warning is logged when they do.
+func (s *Server) SetUnreachable(reason string) {
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+
+	s.unreachable = reason
+}
+
+// Output returns a writer for the output of the function, which is sent line
+// by line to the extensions subscribed to function logs
+func (s *Server) Output() io.Writer {
+	return &lineWriter{line: func(line string) {
+		s.emit("", "function", "function", line)
+	}}
+}
+
+// ExtensionOutput is like Output, for the output of extensions
+func (s *Server) ExtensionOutput() io.Writer {
+	return &lineWriter{line: func(line string) {
+		s.emit("", "extension", "extension", line)
+	}}
+}
+
+// handleSubscribe subscribes an extension to telemetry with the Telemetry
+// API or the older Logs API
+func (s *Server) handleSubscribe(api string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ext, ok := s.extension(r)
+		if !ok {
+			writeUnknownExtension(w)
+			return
+		}
+
+		var req subscribeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "ValidationError", fmt.Sprintf("invalid subscription: %v", err))
+			return
+		}
+		if req.Destination.Protocol != "HTTP" {
+			writeError(w, http.StatusBadRequest, "ValidationError", fmt.Sprintf("unsupported protocol %q, only HTTP is supported", req.Destination.Protocol))
+			return
+		}
+		if _, err := url.Parse(req.Destination.URI); err != nil {
+			writeError(w, http.StatusBadRequest, "ValidationError", fmt.Sprintf("invalid destination URI: %v", err))
+			return
+		}
+
+		sub := &subscription{
+			api:      api,
+			uri:      req.Destination.URI,
+			types:    make(map[string]bool),
+			maxItems: req.Buffering.MaxItems,
+			timeout:  time.Duration(req.Buffering.TimeoutMs) * time.Millisecond,
+			full:     make(chan struct{}, 1),
+			stop:     make(chan struct{}),
+		}
+		for _, t := range req.Types {
+			if t != "platform" && t != "function" && t != "extension" {
+				writeError(w, http.StatusBadRequest, "ValidationError", fmt.Sprintf("unknown telemetry type %s", t))
+				return
+			}
+			sub.types[t] = true
+		}
+		if sub.maxItems <= 0 {
+			sub.maxItems = defaultBufferingItems
+		}
+		if sub.timeout <= 0 {
+			sub.timeout = defaultBufferingTimeout
+		} else if sub.timeout < minBufferingTimeout {
+			sub.timeout = minBufferingTimeout
+		}
+
+		s.subscriptionsMu.Lock()
+		unreachable := s.unreachable
+		if unreachable == "" {
+			s.subscriptions = append(s.subscriptions, sub)
+		}
+		s.subscriptionsMu.Unlock()
+		if unreachable != "" {
+			log.Warn().Str("function", s.cfg.FunctionName).Str("extension", ext.name).Str("api", api).Msgf("telemetry is not sent to the extension, %s", unreachable)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			return
+		}
+		log.Debug().Str("function", s.cfg.FunctionName).Str("extension", ext.name).Str("api", api).Str("uri", sub.uri).Strs("types", req.Types).Msg("extension subscribed to telemetry")
+
+		go s.deliver(sub)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
+}
+
+// emit sends an event to the subscriptions for its category. An api limits
+// the event to subscriptions made with that API.
+func (s *Server) emit(api, category, eventType string, record interface{}) {
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+
+	event := telemetryEvent{
+		Time:   time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Type:   eventType,
+		Record: record,
+	}
+	for _, sub := range s.subscriptions {
+		if !sub.types[category] || (api != "" && sub.api != api) {
+			continue
+		}
+		sub.add(event)
+	}
+}
+
+// deliver sends the events of a subscription each time its buffering
+// timeout passes or its buffer is full, until the Server closes
+func (s *Server) deliver(sub *subscription) {
+	ticker := time.NewTicker(sub.timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-sub.full:
+		case <-sub.stop:
+			return
+		}
+		s.send(sub)
+	}
+}
+
+// flushSubscriptions sends the buffered events of every subscription
+func (s *Server) flushSubscriptions() {
+	s.subscriptionsMu.Lock()
+	subscriptions := append([]*subscription{}, s.subscriptions...)
+	s.subscriptionsMu.Unlock()
+
+	for _, sub := range subscriptions {
+		s.send(sub)
+	}
+}
+
+func (s *Server) stopSubscriptions() {
+	s.subscriptionsMu.Lock()
+	defer s.subscriptionsMu.Unlock()
+
+	for _, sub := range s.subscriptions {
+		close(sub.stop)
+	}
+	s.subscriptions = nil
+}
+
+// send posts the buffered events of a subscription to the extension
+func (s *Server) send(sub *subscription) {
+	events := sub.take()
+	if len(events) == 0 {
+		return
+	}
+
+	s.subscriptionsMu.Lock()
+	uri := sandboxURI(sub.uri, s.sandboxHost)
+	s.subscriptionsMu.Unlock()
+
+	body, err := json.Marshal(events)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not encode telemetry")
+		return
+	}
+	client := http.Client{Timeout: sendTimeout}
+	resp, err := client.Post(uri, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the first failure is reported, as the extension may never be
+		// reachable
+		level := zerolog.DebugLevel
+		sub.mu.Lock()
+		if !sub.failed {
+			sub.failed = true
+			level = zerolog.WarnLevel
+		}
+		sub.mu.Unlock()
+		log.WithLevel(level).Err(err).Str("function", s.cfg.FunctionName).Str("uri", uri).Msg("could not send telemetry to extension")
+		return
+	}
+	resp.Body.Close()
+}
+
+// reportRecord describes an invocation in platform.report events
+func (s *Server) reportRecord(inv *invocation, duration, initDuration time.Duration) reportRecord {
+	ms := durationMs(duration)
+	return reportRecord{
+		RequestID: inv.requestID,
+		Status:    inv.status,
+		Metrics: reportMetrics{
+			DurationMs:       ms,
+			BilledDurationMs: math.Ceil(ms),
+			MemorySizeMB:     s.cfg.MemorySize,
+			MaxMemoryUsedMB:  s.cfg.MemorySize,
+			InitDurationMs:   durationMs(initDuration),
+		},
+	}
+}
+
+// add buffers an event, signalling when the buffer is full
+func (sub *subscription) add(event telemetryEvent) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.events = append(sub.events, event)
+	if len(sub.events) >= sub.maxItems {
+		select {
+		case sub.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take empties the buffer, returning the events in it
+func (sub *subscription) take() []telemetryEvent {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	events := sub.events
+	sub.events = nil
+	return events
+}
+
+// sandboxURI replaces the sandbox host name in a telemetry destination, if
+// a host to replace it with is set
+func sandboxURI(uri, host string) string {
+	u, err := url.Parse(uri)
+	if err != nil || host == "" {
+		return uri
+	}
+	if name := u.Hostname(); name != "sandbox.localdomain" && name != "sandbox" {
+		return uri
+	}
+
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else {
+		u.Host = host
+	}
+	return u.String()
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// lineWriter calls line for each complete line written to it
+type lineWriter struct {
+	mu      sync.Mutex
+	partial []byte
+	line    func(string)
+}
+
+// Write implements io.Writer
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.partial[:i]))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
@@ -1,22 +1,44 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mindriot101/lambda-local-runner/internal/events"
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
+	"github.com/mindriot101/lambda-local-runner/internal/logs"
 	"github.com/rs/zerolog/log"
 )
 
+// ColdStartHeader is the response header reporting whether the request was
+// handled by a newly started container
+const ColdStartHeader = "X-Lambda-Cold-Start"
+
+// Invoker runs the lambda function behind a route
+type Invoker interface {
+	Invoke(ctx context.Context, payload []byte) (*invoke.Result, error)
+}
+
 type routeDefinition struct {
-	method string
-	path   string
-	port   int
+	method   string
+	path     string
+	function string
+	invoker  Invoker
+}
+
+// Route is an endpoint and the function handling it
+type Route struct {
+	Method   string
+	Path     string
+	Function string
+	Invoker  Invoker
 }
 
 type Server struct {
@@ -25,6 +47,9 @@ type Server struct {
 	port   int
 
 	routes []routeDefinition
+	// router holds the current *mux.Router, which is replaced as a whole
+	// when the routes change
+	router atomic.Value
 }
 
 func New(host string, port int) *Server {
@@ -34,14 +59,47 @@ func New(host string, port int) *Server {
 	}
 }
 
-func (s *Server) AddRoute(method string, path string, port int) {
+// AddRoute registers the function that handles requests to the given path
+// and method
+func (s *Server) AddRoute(method string, path string, function string, invoker Invoker) {
 	s.routes = append(s.routes, routeDefinition{
-		method: method,
-		path:   path,
-		port:   port,
+		method:   method,
+		path:     path,
+		function: function,
+		invoker:  invoker,
 	})
 }
 
+// ReplaceRoutes atomically switches to a new set of routes. Requests that
+// are already being handled are not affected.
+func (s *Server) ReplaceRoutes(routes []Route) {
+	definitions := make([]routeDefinition, 0, len(routes))
+	for _, route := range routes {
+		definitions = append(definitions, routeDefinition{
+			method:   route.Method,
+			path:     route.Path,
+			function: route.Function,
+			invoker:  route.Invoker,
+		})
+	}
+
+	s.router.Store(newRouter(definitions))
+	s.routes = definitions
+}
+
+func newRouter(routes []routeDefinition) *mux.Router {
+	router := mux.NewRouter()
+	for _, route := range routes {
+		router.HandleFunc(route.path, handleRequest(route)).Methods(route.method)
+	}
+	return router
+}
+
+// ServeHTTP dispatches the request with the current routes
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.Load().(*mux.Router).ServeHTTP(w, r)
+}
+
 // Run runs the web server in the background
 func (s *Server) Run() error {
 	if s.server != nil {
@@ -50,14 +108,10 @@ func (s *Server) Run() error {
 		panic("server already created")
 	}
 
-	router := mux.NewRouter()
-	for _, route := range s.routes {
-		router.HandleFunc(route.path, handleRequest(route.path, route.port)).Methods(route.method)
-	}
-
+	s.router.Store(newRouter(s.routes))
 	s.server = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", s.host, s.port),
-		Handler: router,
+		Handler: s,
 	}
 
 	go func() {
@@ -85,70 +139,87 @@ func (s *Server) Shutdown() {
 	s.server = nil
 }
 
-func handleRequest(endpoint string, port int) http.HandlerFunc {
+// statusWriter records the status code sent to the client
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func handleRequest(route routeDefinition) http.HandlerFunc {
 	type rawResponse struct {
 		StatusCode int               `json:"statusCode"`
 		Body       string            `json:"body"`
 		Headers    map[string]string `json:"headers"`
 	}
 
-	url := fmt.Sprintf("http://localhost:%d/2015-03-31/functions/function/invocations", port)
-	return func(w http.ResponseWriter, r *http.Request) {
-		logger := log.With().Str("endpoint", endpoint).Logger()
+	return func(rw http.ResponseWriter, r *http.Request) {
+		logger := log.With().Str("endpoint", route.path).Logger()
 		logger.Debug().Msg("got request")
 
-		var body bytes.Buffer
-		if r.Method == "POST" {
-			_, err := io.Copy(&body, r.Body)
-			if err != nil {
-				logger.Error().Msg("could not copy body from request")
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("could not copy body from request"))
-				return
-			}
-			defer r.Body.Close()
-		} else {
-			body = *bytes.NewBuffer([]byte("{}"))
-		}
-
-		logger.Debug().Msg("creating request to lambda function")
-		req, err := http.NewRequest("POST", url, &body)
+		start := time.Now()
+		w := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		var coldStart bool
+		defer func() {
+			log.WithLevel(logs.EventLevel).
+				Str("event", "invocation").
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Str("function", route.function).
+				Int("status", w.status).
+				Dur("duration", time.Since(start)).
+				Bool("cold_start", coldStart).
+				Msg("handled request")
+		}()
+
+		evt, err := events.NewAPIGatewayProxyRequest(r, route.path, mux.Vars(r))
 		if err != nil {
-			logger.Error().Msg("could not create child request")
+			logger.Error().Err(err).Msg("could not create event from request")
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("could not create child request"))
+			w.Write([]byte("could not create event from request"))
 			return
 		}
 
-		client := http.Client{}
-		logger.Debug().Msg("sending request to lambda container")
-		resp, err := client.Do(req)
+		payload, err := json.Marshal(evt)
 		if err != nil {
-			logger.Error().Msg("could not send request to lambda container")
+			logger.Error().Err(err).Msg("could not encode event")
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("error sending request"))
+			w.Write([]byte("could not encode event"))
 			return
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			logger.Error().Int("status", resp.StatusCode).Msg("invalid status code from endpoint")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("bad status from lambda"))
+		logger.Debug().Msg("sending request to lambda container")
+		res, err := route.invoker.Invoke(r.Context(), payload)
+		if errors.Is(err, invoke.ErrThrottled) {
+			// what API Gateway returns when the lambda is throttled
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message":"Rate Exceeded."}`))
 			return
 		}
-
-		var resBody bytes.Buffer
-		logger.Debug().Msg("reading response from lambda container")
-		if _, err := io.Copy(&resBody, resp.Body); err != nil {
-			logger.Error().Msg("could not copy from response")
+		if errors.Is(err, invoke.ErrCrashLooping) {
+			// the function is not restarted until its code changes, so
+			// the caller is told why, including how it last exited
+			logger.Error().Err(err).Msg("could not invoke function")
+			body, _ := json.Marshal(map[string]string{"message": err.Error()})
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write(body)
+			return
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("could not send request to lambda container")
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("could not copy body from response"))
+			w.Write([]byte("error sending request"))
 			return
 		}
+		coldStart = res.ColdStart
+		w.Header().Set(ColdStartHeader, strconv.FormatBool(coldStart))
 
 		var raw rawResponse
-		if err := json.Unmarshal(resBody.Bytes(), &raw); err != nil {
+		if err := json.Unmarshal(res.Body, &raw); err != nil {
 			logger.Error().Err(err).Msg("could not parse response from lambda")
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("invalid lambda response"))
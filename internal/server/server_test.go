@@ -1,19 +1,42 @@
 package server
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
+)
+
+type mockInvoker struct {
+	result invoke.Result
+	err    error
+}
+
+func (m *mockInvoker) Invoke(ctx context.Context, payload []byte) (*invoke.Result, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	res := m.result
+	return &res, nil
+}
 
 func TestAddRoutes(t *testing.T) {
 	server := New("localhost", 0)
-	server.AddRoute("GET", "/hello", 9002)
+	invoker := &mockInvoker{}
+	server.AddRoute("GET", "/hello", "HelloWorldFunction", invoker)
 
 	if len(server.routes) != 1 {
 		t.Fatalf("did not add route")
 	}
 
 	checkRouteDefinition(t, server.routes[0], routeDefinition{
-		method: "GET",
-		path:   "/hello",
-		port:   9002,
+		method:   "GET",
+		path:     "/hello",
+		function: "HelloWorldFunction",
+		invoker:  invoker,
 	})
 }
 
@@ -26,7 +49,92 @@ func checkRouteDefinition(t *testing.T, got, expected routeDefinition) {
 		t.Fatalf("invalid path, expected %s found %s", expected.path, got.path)
 	}
 
-	if got.port != expected.port {
-		t.Fatalf("invalid port, expected %d found %d", expected.port, got.port)
+	if got.function != expected.function {
+		t.Fatalf("invalid function, expected %s found %s", expected.function, got.function)
+	}
+
+	if got.invoker != expected.invoker {
+		t.Fatalf("invalid invoker, expected %v found %v", expected.invoker, got.invoker)
+	}
+}
+
+func TestColdStartHeader(t *testing.T) {
+	invoker := &mockInvoker{
+		result: invoke.Result{
+			Body:      []byte(`{"statusCode": 201, "body": "hello"}`),
+			ColdStart: true,
+		},
+	}
+	handler := handleRequest(routeDefinition{
+		method:   "GET",
+		path:     "/hello",
+		function: "HelloWorldFunction",
+		invoker:  invoker,
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/hello", nil))
+
+	if w.Code != 201 {
+		t.Fatalf("invalid status, expected %d found %d", 201, w.Code)
+	}
+
+	if w.Body.String() != "hello" {
+		t.Fatalf("invalid body %s", w.Body.String())
+	}
+
+	if got := w.Header().Get(ColdStartHeader); got != "true" {
+		t.Fatalf("invalid cold start header %s", got)
+	}
+}
+
+func TestCrashLoopResponse(t *testing.T) {
+	invoker := &mockInvoker{
+		err: fmt.Errorf("function HelloWorldFunction crashed 5 times in a row, last exit code 137 (out of memory): %w", invoke.ErrCrashLooping),
+	}
+	handler := handleRequest(routeDefinition{
+		method:   "GET",
+		path:     "/hello",
+		function: "HelloWorldFunction",
+		invoker:  invoker,
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/hello", nil))
+
+	if w.Code != 502 {
+		t.Fatalf("invalid status, expected %d found %d", 502, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "last exit code 137 (out of memory)") {
+		t.Fatalf("the body should say how the function exited, found %s", w.Body.String())
+	}
+}
+
+func TestReplaceRoutes(t *testing.T) {
+	server := New("localhost", 0)
+	old := &mockInvoker{result: invoke.Result{Body: []byte(`{"statusCode": 200, "body": "old"}`)}}
+	server.AddRoute("GET", "/old", "OldFunction", old)
+	server.router.Store(newRouter(server.routes))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	if w := request("/old"); w.Body.String() != "old" {
+		t.Fatalf("invalid body %s", w.Body.String())
+	}
+
+	updated := &mockInvoker{result: invoke.Result{Body: []byte(`{"statusCode": 200, "body": "new"}`)}}
+	server.ReplaceRoutes([]Route{
+		{Method: "GET", Path: "/new", Function: "NewFunction", Invoker: updated},
+	})
+
+	if w := request("/new"); w.Body.String() != "new" {
+		t.Fatalf("invalid body %s", w.Body.String())
+	}
+	if w := request("/old"); w.Code != 404 {
+		t.Fatalf("removed route returned status %d", w.Code)
 	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mindriot101/lambda-local-runner/internal/config"
+	"github.com/mindriot101/lambda-local-runner/internal/docker"
+	"github.com/mindriot101/lambda-local-runner/internal/invoke"
+	"github.com/rs/zerolog/log"
+)
+
+type InvokeArgs struct {
+	LogicalID string `required:"yes" positional-arg-name:"logical-id"`
+}
+
+// InvokeOpts are the options for the one-shot `invoke` command
+type InvokeOpts struct {
+	RootDir            string     `short:"r" long:"root"                description:"Unpacked root directory"                                                          env:"LLR_ROOT"`
+	Template           string     `short:"t" long:"template"            description:"CloudFormation template"                                                          env:"LLR_TEMPLATE"       default:"template.yaml"`
+	Event              string     `short:"e" long:"event"               description:"File containing the event, or - for stdin"                                                                 default:"-"`
+	Port               int        `short:"p" long:"port"                description:"Port the runtime API of the lambda container listens on (0 picks a free port)"                             default:"0"`
+	DockerNetwork      string     `          long:"docker-network"      description:"Attach the lambda container to this docker network"                               env:"LLR_DOCKER_NETWORK"`
+	ParameterOverrides []string   `          long:"parameter-overrides" description:"Override the value of a template parameter (<name>=<value>)"`
+	EnvVars            string     `          long:"env-vars"            description:"JSON file with environment variables for the function, in the format used by SAM" env:"LLR_ENV_VARS"`
+	FromSource         bool       `          long:"from-source"         description:"Run the function from its CodeUri and layers from their ContentUri, without a build"`
+	DepsDir            string     `          long:"deps-dir"            description:"Directory of installed dependencies to use with --from-source (python and nodejs only)"`
+	NoDocker           bool       `          long:"no-docker"           description:"Run the function as a local process instead of in a docker container (go1.x and provided only)"`
+	AWS                AWSOpts    `group:"AWS Options"`
+	Args               InvokeArgs `required:"yes" positional-args:"yes"`
+
+	// Functions are the settings for individual functions from the config
+	// files
+	Functions map[string]config.Function `no-flag:"yes"`
+}
+
+// invokeFunction runs a single function once with the given event, printing the
+// response to stdout and the function logs to stderr
+func invokeFunction(ctx context.Context, opts InvokeOpts) error {
+	if err := checkFromSource(opts.RootDir, opts.FromSource, opts.DepsDir); err != nil {
+		return err
+	}
+	parameters, err := parseParameterOverrides(opts.ParameterOverrides)
+	if err != nil {
+		return err
+	}
+	vars, err := readEnvVars(opts.EnvVars)
+	if err != nil {
+		return err
+	}
+
+	payload, err := readEvent(opts.Event)
+	if err != nil {
+		return fmt.Errorf("reading event: %w", err)
+	}
+
+	definition, err := parseFunction(opts.Template, opts.Args.LogicalID, parameters)
+	if err != nil {
+		return fmt.Errorf("parsing template: %w", err)
+	}
+	log.Debug().Interface("definition", definition).Msg("parsed template")
+
+	awsEnv, err := awsEnviron(opts.AWS)
+	if err != nil {
+		return err
+	}
+
+	runner, cli, err := newContainerRunner(opts.NoDocker)
+	if err != nil {
+		return err
+	}
+
+	// the container is cleaned up regardless of what happens to the caller's
+	// context
+	dockerCtx := context.Background()
+
+	var imageName string
+	if cli != nil {
+		imageName, err = cli.BuildImage(dockerCtx, definition.Runtime, definition.Architecture)
+		if err != nil {
+			return fmt.Errorf("building docker image: %w", err)
+		}
+	}
+
+	sourcePath, layerPaths, err := functionPaths(opts.RootDir, opts.Template, opts.FromSource, definition)
+	if err != nil {
+		return err
+	}
+	fn := opts.Functions[definition.LogicalID]
+	var dependenciesPath string
+	if opts.FromSource {
+		dependenciesPath = functionDependencies(opts.DepsDir, fn)
+	}
+
+	running, err := runner.RunContainer(dockerCtx, docker.RunContainerArgs{
+		ContainerName: containerName(definition),
+		ImageName:     imageName,
+		FunctionName:  definition.LogicalID,
+		Architecture:  definition.Architecture,
+		Handler:       definition.Handler,
+		SourcePath:    sourcePath,
+		LayerPaths:    layerPaths,
+		Port:          opts.Port,
+		Network:       opts.DockerNetwork,
+		Runtime:       definition.Runtime,
+		Env:           functionEnv(definition, fn, vars, awsEnv),
+
+		DependenciesPath: dependenciesPath,
+		Timeout:          definition.Timeout,
+		MemorySize:       definition.MemorySize,
+	})
+	if err != nil {
+		return fmt.Errorf("running container: %w", err)
+	}
+	defer func() {
+		if err := runner.RemoveContainer(dockerCtx, running.ID); err != nil {
+			log.Warn().Err(err).Str("container_id", running.ID).Msg("could not remove the lambda container")
+		}
+	}()
+
+	res, err := invoke.Invoke(ctx, running.Addr, payload)
+	if err != nil {
+		return fmt.Errorf("invoking function: %w", err)
+	}
+
+	if err := runner.Logs(dockerCtx, running.ID, os.Stderr, os.Stderr); err != nil {
+		log.Warn().Err(err).Msg("could not fetch function logs")
+	}
+
+	fmt.Fprintf(os.Stdout, "%s\n", res.Body)
+
+	if res.FunctionError {
+		return fmt.Errorf("function %s returned an error", definition.LogicalID)
+	}
+	return nil
+}
+
+// readEvent reads the event payload from a file, or stdin if the filename
+// is "-"
+func readEvent(filename string) ([]byte, error) {
+	if filename == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(filename)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mindriot101/lambda-local-runner/internal/logs"
+	"github.com/rs/zerolog/log"
+)
+
+// logOutputs manages where the output of each function's containers is
+// written. Every function gets a single writer, shared by all of its
+// containers, which each split their output into lines before writing to it.
+type logOutputs struct {
+	dir        string
+	colour     bool
+	jsonOutput bool
+	writers    map[string]io.Writer
+	files      []*os.File
+}
+
+func newLogOutputs(dir string, colour bool, jsonOutput bool) *logOutputs {
+	return &logOutputs{
+		dir:        dir,
+		colour:     colour,
+		jsonOutput: jsonOutput,
+		writers:    make(map[string]io.Writer),
+	}
+}
+
+// For returns the writer for the function with the given logical ID. The
+// output is printed to stderr prefixed with the logical ID (or as structured
+// log events in JSON mode), and additionally written to a log file if a log
+// directory is configured.
+func (l *logOutputs) For(logicalID string) (io.Writer, error) {
+	if w, ok := l.writers[logicalID]; ok {
+		return w, nil
+	}
+
+	var w io.Writer = logs.NewWriter(os.Stderr, logicalID, l.colour)
+	if l.jsonOutput {
+		w = logs.NewJSONWriter(log.Logger, logicalID)
+	}
+	if l.dir != "" {
+		if err := os.MkdirAll(l.dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating log directory: %w", err)
+		}
+
+		filename := filepath.Join(l.dir, logicalID+".log")
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening log file %s: %w", filename, err)
+		}
+		l.files = append(l.files, f)
+		w = io.MultiWriter(w, f)
+	}
+
+	l.writers[logicalID] = w
+	return w, nil
+}
+
+// Close closes any open log files
+func (l *logOutputs) Close() error {
+	for _, f := range l.files {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("closing log file: %w", err)
+		}
+	}
+	return nil
+}
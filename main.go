@@ -7,19 +7,27 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
-	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/awslabs/goformation/v6"
+	"github.com/awslabs/goformation/v6/cloudformation"
+	"github.com/awslabs/goformation/v6/cloudformation/global"
 	"github.com/awslabs/goformation/v6/cloudformation/serverless"
+	"github.com/awslabs/goformation/v6/intrinsics"
 	"github.com/docker/docker/client"
-	"github.com/fsnotify/fsnotify"
 	"github.com/jessevdk/go-flags"
+	"github.com/mindriot101/lambda-local-runner/internal/config"
 	"github.com/mindriot101/lambda-local-runner/internal/docker"
 	"github.com/mindriot101/lambda-local-runner/internal/lambdahost"
+	"github.com/mindriot101/lambda-local-runner/internal/logs"
+	"github.com/mindriot101/lambda-local-runner/internal/process"
 	"github.com/mindriot101/lambda-local-runner/internal/server"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -51,6 +59,25 @@ type HandlerDefinition struct {
 	Handler string
 	// Port is the internal port of the listening container
 	Port int
+	// ReservedConcurrency limits the number of concurrent containers of the
+	// function, if set in the template (nil if not set). A function with a
+	// reserved concurrency of 0 is throttled.
+	ReservedConcurrency *int
+	// Layers lists the logical IDs of the layers from the same template that
+	// the function uses, in order
+	Layers []string
+	// LayerURIs are the ContentUri of each of the layers, relative to the
+	// template. They are empty for layers whose content is not local.
+	LayerURIs []string
+	// Environment are the environment variables set in the template
+	Environment map[string]string
+	// CodeURI is the directory containing the source of the function,
+	// relative to the template. It is empty if the code is not local.
+	CodeURI string
+	// Timeout and MemorySize are set in the template, or 0 for the lambda
+	// defaults
+	Timeout    time.Duration
+	MemorySize int
 }
 
 // EndpointMapping is a mapping from endpoint definition to the details needed to run the handler
@@ -72,6 +99,44 @@ func (e EndpointMapping) MarshalJSON() ([]byte, error) {
 	return res, nil
 }
 
+// Functions returns the distinct functions handling the endpoints, sorted by
+// logical ID
+func (e EndpointMapping) Functions() []HandlerDefinition {
+	seen := make(map[string]bool)
+	out := []HandlerDefinition{}
+	for _, definition := range e {
+		if seen[definition.LogicalID] {
+			continue
+		}
+		seen[definition.LogicalID] = true
+		out = append(out, definition)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].LogicalID < out[j].LogicalID
+	})
+	return out
+}
+
+// Endpoints returns the endpoints handled by the function with the given
+// logical ID, sorted by path and method
+func (e EndpointMapping) Endpoints(logicalID string) []Endpoint {
+	out := []Endpoint{}
+	for endpoint, definition := range e {
+		if definition.LogicalID == logicalID {
+			out = append(out, endpoint)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].URLPath != out[j].URLPath {
+			return out[i].URLPath < out[j].URLPath
+		}
+		return out[i].Method < out[j].Method
+	})
+	return out
+}
+
 // https://stackoverflow.com/a/31832326
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
@@ -87,13 +152,155 @@ func randStringRunes(n int) string {
 // containerName generates the container name that is meant to be both:
 // * informative, and
 // * unique
-func containerName(endpoint Endpoint, definition HandlerDefinition) string {
-	sanitisedURL := strings.ReplaceAll(endpoint.URLPath, "/", "_")
-	return fmt.Sprintf("llr-%s-%s%s-%s", definition.LogicalID, endpoint.Method, sanitisedURL, randStringRunes(6))
+func containerName(definition HandlerDefinition) string {
+	return fmt.Sprintf("llr-%s-%s", definition.LogicalID, randStringRunes(6))
+}
+
+// handlerDefinition extracts the details needed to run a function from its
+// template definition
+func handlerDefinition(template *cloudformation.Template, logicalID string, f *serverless.Function) HandlerDefinition {
+	architecture := "x86_64"
+	if f.Architectures != nil && len(*f.Architectures) >= 1 {
+		architecture = (*f.Architectures)[0]
+	}
+
+	runtime := "python3.8"
+	if f.Runtime != nil && *f.Runtime != "" {
+		runtime = *f.Runtime
+	}
+
+	var handler string
+	if f.Handler != nil {
+		handler = *f.Handler
+	}
+
+	var environment map[string]string
+	if f.Environment != nil {
+		environment = f.Environment.Variables
+	}
+
+	var codeURI string
+	if f.CodeUri != nil && f.CodeUri.String != nil {
+		codeURI = *f.CodeUri.String
+	}
+
+	layers, layerURIs := templateLayers(template, f)
+
+	// settings of the function override those in the Globals section
+	timeoutSeconds, memorySize := f.Timeout, f.MemorySize
+	if globals, ok := template.Globals["Function"].(*global.Function); ok {
+		if timeoutSeconds == nil {
+			timeoutSeconds = globals.Timeout
+		}
+		if memorySize == nil {
+			memorySize = globals.MemorySize
+		}
+	}
+	var timeout time.Duration
+	if timeoutSeconds != nil {
+		timeout = time.Duration(*timeoutSeconds) * time.Second
+	}
+
+	return HandlerDefinition{
+		LogicalID:           logicalID,
+		Architecture:        architecture,
+		Runtime:             runtime,
+		Handler:             handler,
+		Port:                -1,
+		ReservedConcurrency: f.ReservedConcurrentExecutions,
+		Layers:              layers,
+		LayerURIs:           layerURIs,
+		Environment:         environment,
+		CodeURI:             codeURI,
+		Timeout:             timeout,
+		MemorySize:          intValue(memorySize),
+	}
+}
+
+// intValue returns the value of an optional template property, or 0 if it is
+// not set
+func intValue(v *int) int {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// templateLayers returns the logical IDs of the layers used by the function
+// that are defined in the template, and their ContentUri. Layers referenced
+// by ARN cannot be run locally and are skipped.
+func templateLayers(template *cloudformation.Template, f *serverless.Function) ([]string, []string) {
+	if f.Layers == nil {
+		return nil, nil
+	}
+
+	var out, uris []string
+	for _, layer := range *f.Layers {
+		resource, ok := template.Resources[layer]
+		if !ok {
+			log.Debug().Str("layer", layer).Msg("skipping layer not defined in the template")
+			continue
+		}
+
+		switch resource.AWSCloudFormationType() {
+		case "AWS::Serverless::LayerVersion", "AWS::Lambda::LayerVersion":
+			out = append(out, layer)
+			uris = append(uris, layerContentURI(resource))
+		default:
+			log.Warn().Str("layer", layer).Msg("layer reference is not a layer version")
+		}
+	}
+	return out, uris
+}
+
+// layerContentURI returns the local ContentUri of a layer, or an empty string
+func layerContentURI(resource cloudformation.Resource) string {
+	layer, ok := resource.(*serverless.LayerVersion)
+	if !ok || layer.ContentUri == nil || layer.ContentUri.String == nil {
+		return ""
+	}
+	return *layer.ContentUri.String
+}
+
+// openTemplate parses the template, resolving references to other resources
+// to their logical IDs so that layers defined in the template can be found.
+// The parameters override the defaults of the template parameters.
+func openTemplate(filename string, parameters map[string]interface{}) (*cloudformation.Template, error) {
+	return goformation.OpenWithOptions(filename, &intrinsics.ProcessorOptions{
+		IntrinsicHandlerOverrides: map[string]intrinsics.IntrinsicHandler{
+			"Ref": resourceRef,
+		},
+		ParameterOverrides: parameters,
+	})
 }
 
-func parseTemplate(filename string) (EndpointMapping, error) {
-	template, err := goformation.Open(filename)
+// resourceRef resolves a Ref like the default handler, but returns the
+// logical ID for references to resources rather than dropping them
+func resourceRef(name string, input interface{}, template interface{}) interface{} {
+	if res := intrinsics.Ref(name, input, template); res != nil {
+		return res
+	}
+
+	ref, ok := input.(string)
+	if !ok {
+		return nil
+	}
+	t, ok := template.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	resources, ok := t["Resources"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if _, ok := resources[ref]; ok {
+		return ref
+	}
+	return nil
+}
+
+func parseTemplate(filename string, parameters map[string]interface{}) (EndpointMapping, error) {
+	template, err := openTemplate(filename, parameters)
 	if err != nil {
 		return nil, fmt.Errorf("parsing template: %w", err)
 	}
@@ -108,18 +315,11 @@ func parseTemplate(filename string) (EndpointMapping, error) {
 				return nil, fmt.Errorf("invalid function %s", logicalID)
 			}
 
-			var architecture string
-			if len(*f.Architectures) >= 1 {
-				architecture = (*f.Architectures)[0]
-			} else {
-				architecture = "x86_64"
-			}
-
-			runtime := "x86_64"
-			if *f.Runtime != "" {
-				runtime = *f.Runtime
+			if f.Events == nil {
+				continue
 			}
 
+			def := handlerDefinition(template, logicalID, f)
 			for _, event := range *f.Events {
 				if event.Type != "Api" {
 					continue
@@ -135,13 +335,6 @@ func parseTemplate(filename string) (EndpointMapping, error) {
 					URLPath: evt.Path,
 					Method:  Method(evt.Method),
 				}
-				def := HandlerDefinition{
-					LogicalID:    logicalID,
-					Architecture: architecture,
-					Runtime:      runtime,
-					Handler:      *f.Handler,
-					Port:         -1,
-				}
 				out[endpoint] = def
 			}
 
@@ -152,144 +345,505 @@ func parseTemplate(filename string) (EndpointMapping, error) {
 	return out, nil
 }
 
+// parseFunction finds a single function in the template by its logical ID,
+// whether or not it has any API events attached
+func parseFunction(filename string, logicalID string, parameters map[string]interface{}) (HandlerDefinition, error) {
+	template, err := openTemplate(filename, parameters)
+	if err != nil {
+		return HandlerDefinition{}, fmt.Errorf("parsing template: %w", err)
+	}
+
+	f, err := template.GetServerlessFunctionWithName(logicalID)
+	if err != nil {
+		return HandlerDefinition{}, fmt.Errorf("finding function %s: %w", logicalID, err)
+	}
+
+	return handlerDefinition(template, logicalID, f), nil
+}
+
 type Args struct {
-	Template string `required:"yes" positional-arg-name:"template"`
+	Template string `positional-arg-name:"template"`
 }
 
+// Opts are the options for the long-running `run` command
 type Opts struct {
-	Verbose []bool `short:"v" long:"verbose" description:"Print verbose logging output"`
-	RootDir string `short:"r" long:"root"    description:"Unpacked root directory"      required:"yes"`
-	Port    int    `short:"p" long:"port"    description:"Server port to listen on"                    default:"8080"`
-	Host    string `short:"H" long:"host"    description:"Host to listen on"                           default:"localhost"`
-	Args    Args   `                                                                    required:"yes"                     positional-args:"yes"`
+	RootDir            string        `short:"r" long:"root"                 description:"Unpacked root directory"                                                                       env:"LLR_ROOT"`
+	Port               int           `short:"p" long:"port"                 description:"Server port to listen on"                                                                      env:"LLR_PORT"           default:"8080"`
+	Host               string        `short:"H" long:"host"                 description:"Host to listen on"                                                                             env:"LLR_HOST"           default:"localhost"`
+	PortRange          string        `          long:"port-range"           description:"Serve the runtime API of lambda containers on ports from this range (e.g. 9001-9100)"          env:"LLR_PORT_RANGE"`
+	DockerNetwork      string        `          long:"docker-network"       description:"Attach the lambda containers to this docker network"                                           env:"LLR_DOCKER_NETWORK"`
+	LogDir             string        `          long:"log-dir"              description:"Also write each function's logs to <dir>/<LogicalID>.log"`
+	NoColor            bool          `          long:"no-color"             description:"Do not colourise function log output"`
+	MaxConcurrency     int           `          long:"max-concurrency"      description:"Maximum number of containers per function (capped by ReservedConcurrentExecutions)"                                     default:"4"`
+	IdleTimeout        time.Duration `          long:"idle-timeout"         description:"Remove extra containers after they have been idle for this long"                                                        default:"5m"`
+	Lazy               bool          `          long:"lazy"                 description:"Start each function's first container on its first request"`
+	ScaleToZero        bool          `          long:"scale-to-zero"        description:"Also remove the last container of a function once it has been idle"`
+	DebugFunction      string        `          long:"debug-function"       description:"Start this function with a debug agent for a debugger to attach to"`
+	DebugPort          int           `          long:"debug-port"           description:"Port the debug agent listens on"                                                                                        default:"5858"`
+	DebugWait          bool          `          long:"debug-wait"           description:"Wait for the debugger to attach before running the handler"`
+	DebuggerPath       string        `          long:"debugger-path"        description:"Directory containing the debugger for go and custom runtimes (dlv)"`
+	CrashLoopThreshold int           `          long:"crash-loop-threshold" description:"Stop restarting a function after it crashes this many times in a row"                                                   default:"5"`
+	WatchInclude       []string      `          long:"watch-include"        description:"Only restart functions when files matching this glob change"                                   env:"LLR_WATCH_INCLUDE"                      env-delim:","`
+	WatchExclude       []string      `          long:"watch-exclude"        description:"Ignore files and directories matching this glob, besides swap files, __pycache__ and .git"     env:"LLR_WATCH_EXCLUDE"                      env-delim:","`
+	WatchDebounce      time.Duration `          long:"watch-debounce"       description:"Wait for changes to settle for this long before restarting functions"                                                   default:"200ms"`
+	WatchSource        bool          `          long:"watch-source"         description:"Watch each function's CodeUri and copy changed files to the build directory before restarting"`
+	BuildCommand       string        `          long:"build-command"        description:"Shell command building a function after its CodeUri changes, instead of copying the files"     env:"LLR_BUILD_COMMAND"`
+	ParameterOverrides []string      `          long:"parameter-overrides"  description:"Override the value of a template parameter (<name>=<value>)"`
+	EnvVars            string        `          long:"env-vars"             description:"JSON file with environment variables for the functions, in the format used by SAM"             env:"LLR_ENV_VARS"`
+	FromSource         bool          `          long:"from-source"          description:"Run each function from its CodeUri and layers from their ContentUri, without a build"`
+	DepsDir            string        `          long:"deps-dir"             description:"Directory of installed dependencies to use with --from-source (python and nodejs only)"`
+	NoDocker           bool          `          long:"no-docker"            description:"Run go1.x and provided functions as local processes instead of in docker containers"`
+	AWS                AWSOpts       `group:"AWS Options"`
+	Args               Args          `positional-args:"yes"`
+
+	// LogFormat is copied from the global options
+	LogFormat string `no-flag:"yes"`
+	// Functions are the settings for individual functions from the config
+	// files
+	Functions map[string]config.Function `no-flag:"yes"`
 }
 
-func run(ctx context.Context, opts Opts) error {
-	endpointMapping, err := parseTemplate(opts.Args.Template)
-	if err != nil {
-		return fmt.Errorf("parsing template: %w", err)
+// Options are the top level command line options
+type Options struct {
+	Verbose       []bool            `short:"v" long:"verbose"           description:"Print verbose logging output"`
+	LogFormat     string            `          long:"log-format"        description:"Format of log output"                                                 choice:"console" choice:"json" default:"console"`
+	Run           Opts              `          command:"run"            description:"Serve the API endpoints defined in a template"`
+	Invoke        InvokeOpts        `          command:"invoke"         description:"Invoke a single function once and exit"`
+	GenerateEvent GenerateEventOpts `          command:"generate-event" description:"Print a sample event for an event source"`
+	Config        ConfigOpts        `          command:"config"         description:"Show the configuration read from flags, environment and config files"`
+	Cleanup       CleanupOpts       `          command:"cleanup"        description:"Remove leftover containers and images"`
+}
+
+// routeInfo describes an endpoint served to the user
+type routeInfo struct {
+	Method   string `json:"method"`
+	URL      string `json:"url"`
+	Function string `json:"function"`
+}
+
+// printListening tells the user which endpoints are available, either as a
+// human readable banner or as structured log events
+func printListening(jsonOutput bool, routes []routeInfo) {
+	if jsonOutput {
+		for _, route := range routes {
+			log.Info().
+				Str("event", "route").
+				Str("method", route.Method).
+				Str("url", route.URL).
+				Str("function", route.Function).
+				Msg("route available")
+		}
+		log.Info().Str("event", "listening").Int("routes", len(routes)).Msg("server listening")
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Server listening\n")
+	fmt.Fprintf(os.Stderr, "Available endpoints:\n")
+	for _, route := range routes {
+		fmt.Fprintf(os.Stderr, " - %s %s\n", route.Method, route.URL)
+	}
+}
+
+func printShuttingDown(jsonOutput bool) {
+	if jsonOutput {
+		log.Info().Str("event", "shutdown").Msg("shutting down the server")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Shutting down the server\n")
+}
+
+// maxConcurrency limits the number of containers of a function to its
+// reserved concurrency, if it has one
+func maxConcurrency(limit int, reserved *int) int {
+	if reserved != nil && *reserved > 0 && *reserved < limit {
+		return *reserved
+	}
+	return limit
+}
+
+// throttled checks whether the function has a reserved concurrency of 0, so
+// it cannot be invoked
+func throttled(definition HandlerDefinition) bool {
+	return definition.ReservedConcurrency != nil && *definition.ReservedConcurrency == 0
+}
+
+// functionMaxConcurrency returns the concurrency limit of a function, which
+// may be overridden in the config files
+func functionMaxConcurrency(opts Opts, logicalID string) int {
+	if limit := opts.Functions[logicalID].MaxConcurrency; limit > 0 {
+		return limit
+	}
+	return opts.MaxConcurrency
+}
+
+// functionDependencies returns the dependencies directory of a function,
+// which may be overridden in the config files
+func functionDependencies(depsDir string, fn config.Function) string {
+	if fn.DependenciesDir != "" {
+		return fn.DependenciesDir
+	}
+	return depsDir
+}
+
+// checkFromSource checks that the code of the functions can be found: either
+// a root directory is given, or the functions are run from their source
+func checkFromSource(rootDir string, fromSource bool, depsDir string) error {
+	if !fromSource {
+		if rootDir == "" {
+			return fmt.Errorf("no root directory given, pass --root or --from-source, or set them in %s", config.FileName)
+		}
+		if depsDir != "" {
+			return fmt.Errorf("--deps-dir can only be used with --from-source")
+		}
+	}
+	return nil
+}
+
+// newContainerRunner connects to docker, or with noDocker returns a runner
+// for local processes and a nil docker client
+func newContainerRunner(noDocker bool) (containerRunner, *docker.Client, error) {
+	if noDocker {
+		return process.New(), nil, nil
 	}
-	log.Debug().Interface("endpoint_mapping", endpointMapping).Msg("parsed template")
 
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
-		return fmt.Errorf("connecting to docker: %w", err)
+		return nil, nil, fmt.Errorf("connecting to docker: %w", err)
 	}
 	cli := docker.New(dockerClient)
+	return cli, cli, nil
+}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-
-	srv := server.New(opts.Host, opts.Port)
-	containerIdx := 0
-	containerPort := 9001
-	lambdaHosts := []*lambdahost.LambdaHost{}
-	done := make(chan struct{})
-	dockerCtx := context.Background()
+// parsePortRange parses a range of ports in the form <start>-<end>
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected <start>-<end>", s)
+	}
 
-	watcher, err := fsnotify.NewWatcher()
+	start, err := strconv.Atoi(parts[0])
 	if err != nil {
-		return fmt.Errorf("creating file system watcher: %w", err)
+		return 0, 0, fmt.Errorf("invalid start port %q: %w", parts[0], err)
 	}
-	defer watcher.Close()
+	end, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end port %q: %w", parts[1], err)
+	}
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %d-%d", start, end)
+	}
+	return start, end, nil
+}
 
-	endpointStrings := []string{}
-	var wg sync.WaitGroup
-	for endpoint, definition := range endpointMapping {
-		wg.Add(1)
+func run(ctx context.Context, opts Opts) error {
+	jsonOutput := opts.LogFormat == "json"
 
-		imageName, err := cli.BuildImage(dockerCtx)
-		if err != nil {
-			return fmt.Errorf("building docker image: %w", err)
-		}
+	if err := checkFromSource(opts.RootDir, opts.FromSource, opts.DepsDir); err != nil {
+		return err
+	}
+	if opts.FromSource && (opts.WatchSource || opts.BuildCommand != "") {
+		return fmt.Errorf("--from-source cannot be used with --watch-source or --build-command")
+	}
+	if opts.NoDocker && opts.DebugFunction != "" {
+		return fmt.Errorf("--debug-function cannot be used with --no-docker")
+	}
+	if opts.Args.Template == "" {
+		return fmt.Errorf("no template given, pass it as an argument or set template in %s", config.FileName)
+	}
+	parameters, err := parseParameterOverrides(opts.ParameterOverrides)
+	if err != nil {
+		return err
+	}
+	vars, err := readEnvVars(opts.EnvVars)
+	if err != nil {
+		return err
+	}
+
+	endpointMapping, err := parseTemplate(opts.Args.Template, parameters)
+	if err != nil {
+		return fmt.Errorf("parsing template: %w", err)
+	}
+	log.Debug().Interface("endpoint_mapping", endpointMapping).Msg("parsed template")
+	if opts.DebugFunction != "" && len(endpointMapping.Endpoints(opts.DebugFunction)) == 0 {
+		return fmt.Errorf("no endpoints are handled by the function to debug %s", opts.DebugFunction)
+	}
+	if jsonOutput {
+		log.Info().Str("event", "startup").Str("template", opts.Args.Template).Int("endpoints", len(endpointMapping)).Msg("starting")
+	}
 
-		containerName := containerName(endpoint, definition)
+	awsEnv, err := awsEnviron(opts.AWS)
+	if err != nil {
+		return err
+	}
 
-		// FIXME: this leaks implementation details about the docker layer to
-		// the lambda host
-		args := docker.RunContainerArgs{
-			ContainerName: containerName,
-			ImageName:     imageName,
-			Handler:       definition.Handler,
-			SourcePath:    path.Join(opts.RootDir, definition.LogicalID),
-			Port:          containerPort,
+	runner, cli, err := newContainerRunner(opts.NoDocker)
+	if err != nil {
+		return err
+	}
+	if cli != nil {
+		if removed, err := cli.Sweep(ctx); err != nil {
+			log.Warn().Err(err).Msg("could not remove containers left behind by previous runs")
+		} else if removed > 0 {
+			log.Info().Str("event", "sweep").Int("containers", removed).Msg("removed containers left behind by previous runs")
 		}
+	} else if processes, ok := runner.(*process.Runner); ok {
+		if killed, err := processes.Sweep(); err != nil {
+			log.Warn().Err(err).Msg("could not stop processes left behind by previous runs")
+		} else if killed > 0 {
+			log.Info().Str("event", "sweep").Int("processes", killed).Msg("stopped processes left behind by previous runs")
+		}
+	}
 
-		host := lambdahost.New(cli, args)
-		go host.Run(dockerCtx, done, &wg)
-		defer host.RemoveContainer(dockerCtx)
-		lambdaHosts = append(lambdaHosts, host)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-		srv.AddRoute(string(endpoint.Method), endpoint.URLPath, args.Port)
-		containerIdx++
-		containerPort++
+	srv := server.New(opts.Host, opts.Port)
+	var ports *lambdahost.Ports
+	if opts.PortRange != "" {
+		start, end, err := parsePortRange(opts.PortRange)
+		if err != nil {
+			return fmt.Errorf("parsing port range: %w", err)
+		}
+		ports = lambdahost.NewPorts(start, end)
+	}
 
-		endpointStrings = append(endpointStrings,
-			fmt.Sprintf(" - %s http://%s:%d%s\n", string(endpoint.Method), opts.Host, opts.Port, endpoint.URLPath))
+	// when building from the source, the build directory may be inside a
+	// source directory
+	var excludeDirs []string
+	if opts.RootDir != "" {
+		excludeDirs = append(excludeDirs, opts.RootDir)
+	}
+	watcher, err := newCodeWatcher(watchConfig{
+		Include:     opts.WatchInclude,
+		Exclude:     opts.WatchExclude,
+		Debounce:    opts.WatchDebounce,
+		ExcludeDirs: excludeDirs,
+	})
+	if err != nil {
+		return fmt.Errorf("creating file system watcher: %w", err)
+	}
+	defer watcher.Close()
 
-		watchPath := path.Join(opts.RootDir, definition.LogicalID)
-		log.Debug().Str("path", watchPath).Msg("adding path to watch list")
-		if err := watcher.Add(watchPath); err != nil {
-			log.Warn().Err(err).Str("path", watchPath).Msg("could not watch directory")
-		}
+	templateWatcher, err := newFileWatcher(opts.Args.Template, opts.WatchDebounce)
+	if err != nil {
+		return fmt.Errorf("watching template: %w", err)
+	}
+	defer templateWatcher.Close()
+
+	logOutputs := newLogOutputs(opts.LogDir, !opts.NoColor, jsonOutput)
+	defer logOutputs.Close()
+
+	// functions are keyed by their logical ID
+	functions := &functionManager{
+		opts:       opts,
+		cli:        cli,
+		runner:     runner,
+		ports:      ports,
+		logOutputs: logOutputs,
+		watcher:    watcher,
+		vars:       vars,
+		awsEnv:     awsEnv,
+		ctx:        context.Background(),
+		functions:  make(map[string]*runningFunction),
+	}
+	defer functions.RemoveContainers()
 
+	builder := &builder{
+		command: opts.BuildCommand,
+		dir:     filepath.Dir(opts.Args.Template),
+		skip:    watcher.excluded,
 	}
+	// functions that have been built after their source changed. Builds are
+	// cancelled when run returns.
+	built := make(chan []string)
+	buildCtx, cancelBuilds := context.WithCancel(ctx)
+	defer cancelBuilds()
 
+	var wg sync.WaitGroup
+	if err := functions.Start(endpointMapping, &wg); err != nil {
+		return err
+	}
+	srv.ReplaceRoutes(functions.Routes())
 	srv.Run()
 
 	// print information for the user
 	wg.Wait()
-	fmt.Fprintf(os.Stderr, "Server listening\n")
-	fmt.Fprintf(os.Stderr, "Available endpoints:\n")
-	for _, s := range endpointStrings {
-		fmt.Fprintf(os.Stderr, s)
-	}
-
-	// helper function to print info for the user
-	printShuttingDown := func() {
-		fmt.Fprintf(os.Stderr, "Shutting down the server\n")
-	}
+	printListening(jsonOutput, routeInfos(opts, functions.Routes()))
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Debug().Msg("got context timeout")
 			srv.Shutdown()
-			for _, host := range lambdaHosts {
-				host.Shutdown()
-			}
-			printShuttingDown()
+			functions.Shutdown()
+			printShuttingDown(jsonOutput)
 			return nil
 		case <-c:
 			log.Debug().Msg("got ctrl-c")
 			srv.Shutdown()
-			for _, host := range lambdaHosts {
-				host.Shutdown()
-			}
-			printShuttingDown()
+			functions.Shutdown()
+			printShuttingDown(jsonOutput)
 			return nil
-		case event, ok := <-watcher.Events:
-			log.Debug().Interface("event", event).Msg("got event")
+		case changed := <-watcher.Changes:
+			jobs, restart := functions.BuildJobs(changed)
+			functions.Restart(restart)
+			if len(jobs) > 0 {
+				go func() {
+					logicalIDs := builder.Build(buildCtx, jobs)
+					select {
+					case built <- logicalIDs:
+					case <-buildCtx.Done():
+					}
+				}()
+			}
+		case logicalIDs := <-built:
+			functions.Restart(logicalIDs)
+		case <-templateWatcher.Changes:
+			reloadTemplate(opts, parameters, srv, functions, jsonOutput)
+		case err, ok := <-watcher.Errors():
 			if !ok {
 				continue
 			}
 
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				log.Debug().Msg("modified file")
-				for _, host := range lambdaHosts {
-					host.Restart()
-				}
-			}
-		case err, ok := <-watcher.Errors:
+			log.Warn().Err(err).Msg("error watching code")
+		case err, ok := <-templateWatcher.Errors():
 			if !ok {
 				continue
 			}
 
-			log.Warn().Err(err).Msg("error watching code")
-		case <-done:
-			return nil
+			log.Warn().Err(err).Msg("error watching template")
+		}
+	}
+}
+
+// reloadTemplate applies changes to the template to the running functions
+// and routes. The functions keep running as they are if the template is
+// invalid.
+func reloadTemplate(opts Opts, parameters map[string]interface{}, srv *server.Server, functions *functionManager, jsonOutput bool) {
+	endpointMapping, err := parseTemplate(opts.Args.Template, parameters)
+	if err != nil {
+		log.Error().Str("event", "template_error").Err(err).Msg("could not parse the template, still serving the previous version")
+		return
+	}
+
+	var wg sync.WaitGroup
+	diff, err := functions.Apply(endpointMapping, &wg)
+	// the routes only switch once the new functions can serve them
+	wg.Wait()
+	if err != nil {
+		log.Error().Str("event", "template_error").Err(err).Msg("could not apply the changes to the template")
+		return
+	}
+	srv.ReplaceRoutes(functions.Routes())
+	functions.Stop(diff.Removed)
+
+	log.Info().
+		Str("event", "template_reload").
+		Strs("added", diff.Added).
+		Strs("removed", diff.Removed).
+		Strs("reconfigured", diff.Reconfigured).
+		Msg("reloaded template")
+	printListening(jsonOutput, routeInfos(opts, functions.Routes()))
+}
+
+// routeInfos describes the routes for the user
+func routeInfos(opts Opts, routes []server.Route) []routeInfo {
+	out := make([]routeInfo, 0, len(routes))
+	for _, route := range routes {
+		out = append(out, routeInfo{
+			Method:   route.Method,
+			URL:      fmt.Sprintf("http://%s:%d%s", opts.Host, opts.Port, route.Path),
+			Function: route.Function,
+		})
+	}
+	return out
+}
+
+// defaultCommand prepends the run command to the arguments if they do not
+// name a command, so that `lambda-local-runner -r <root> template.yaml` keeps
+// working
+func defaultCommand(parser *flags.Parser, args []string) []string {
+	i, help := firstArgument(parser, args)
+	if help || i >= 0 && parser.Find(args[i]) != nil {
+		return args
+	}
+	return append([]string{"run"}, args...)
+}
+
+// commandName returns the name of the command given in the arguments, or an
+// empty string if there is none
+func commandName(parser *flags.Parser, args []string) string {
+	if i, _ := firstArgument(parser, args); i >= 0 {
+		if command := parser.Find(args[i]); command != nil {
+			return command.Name
 		}
 	}
+	return ""
+}
+
+// firstArgument returns the index of the first argument that is not an
+// option or the value of one, or -1 if there is none. help is set if help
+// was asked for before it.
+func firstArgument(parser *flags.Parser, args []string) (int, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return i, false
+		}
+		if arg == "-h" || arg == "--help" {
+			return -1, true
+		}
+		if takesValue(parser, arg) {
+			i++
+		}
+	}
+	return -1, false
+}
+
+// takesValue reports whether the option given as a command line argument is
+// followed by its value as the next argument
+func takesValue(parser *flags.Parser, arg string) bool {
+	if strings.Contains(arg, "=") {
+		return false
+	}
+
+	run := parser.Find("run")
+	if strings.HasPrefix(arg, "--") {
+		name := strings.TrimPrefix(arg, "--")
+		option := parser.FindOptionByLongName(name)
+		if option == nil {
+			option = run.FindOptionByLongName(name)
+		}
+		return needsValue(option)
+	}
+
+	// in a group of short options, e.g. -vr, the first one taking a value
+	// takes the rest of the argument, or the next argument if there is none
+	for i, name := range arg[1:] {
+		option := parser.FindOptionByShortName(name)
+		if option == nil {
+			option = run.FindOptionByShortName(name)
+		}
+		if needsValue(option) {
+			return i == len(arg)-2
+		}
+	}
+	return false
+}
+
+// needsValue reports whether the option must be given a value
+func needsValue(option *flags.Option) bool {
+	if option == nil || option.OptionalArgument {
+		return false
+	}
+	t := option.Field().Type
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.Kind() != reflect.Bool
 }
 
 func main() {
@@ -302,12 +856,38 @@ func main() {
 		Out: os.Stderr,
 	})
 
-	var opts Opts
-	_, err := flags.Parse(&opts)
-	if err != nil {
+	var opts Options
+	parser := flags.NewParser(&opts, flags.Default)
+	args := defaultCommand(parser, os.Args[1:])
+
+	// the config files only set the defaults of the commands that use them
+	cfg := config.New()
+	var err error
+	if usesConfig(commandName(parser, args)) {
+		if cfg, err = config.Load("."); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := applyConfig(parser, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if _, err := parser.ParseArgs(args); err != nil {
 		// special error handling - the flags package prints the help for us
 		os.Exit(1)
 	}
+	opts.Run.Args.Template = templateFile(opts.Run.Args.Template, cfg)
+	opts.Run.Functions = cfg.Functions
+	opts.Invoke.Functions = cfg.Functions
+
+	jsonOutput := opts.LogFormat == "json"
+	if jsonOutput {
+		zerolog.TimeFieldFormat = time.RFC3339Nano
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+		logs.EventLevel = zerolog.InfoLevel
+	}
+	opts.Run.LogFormat = opts.LogFormat
 
 	switch len(opts.Verbose) {
 	case 0:
@@ -321,8 +901,24 @@ func main() {
 	log.Debug().Interface("opts", opts).Msg("parsed command line options")
 
 	ctx := context.TODO()
-	if err := run(ctx, opts); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	switch parser.Active.Name {
+	case "run":
+		err = run(ctx, opts.Run)
+	case "invoke":
+		err = invokeFunction(ctx, opts.Invoke)
+	case "generate-event":
+		err = generateEvent(opts.GenerateEvent, parser.Active.Active.Name)
+	case "cleanup":
+		err = cleanup(ctx, jsonOutput)
+	case "config":
+		showConfig(os.Stdout, parser, cfg, opts.Run.Args.Template)
+	}
+	if err != nil {
+		if jsonOutput {
+			log.Error().Str("event", "error").Err(err).Msg("exiting with error")
+		} else {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
 		os.Exit(1)
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jessevdk/go-flags"
 	cp "github.com/otiai10/copy"
 )
 
@@ -86,9 +87,8 @@ func TestIntegration(t *testing.T) {
 		Args: Args{
 			Template: "testdata/integration/template.yaml",
 		},
-		Host:    host,
-		Port:    port,
-		Verbose: []bool{true, true, true},
+		Host: host,
+		Port: port,
 	}
 
 	firstResponse := FirstResponse{
@@ -119,8 +119,9 @@ func TestIntegration(t *testing.T) {
 		t.Fatalf("writing new source: %v", err)
 	}
 
+	// requests keep succeeding while the function reloads
 	t.Logf("waiting for reload")
-	time.Sleep(3 * time.Second)
+	assertNoFailures(t, host, port, 3*time.Second)
 
 	assertHTTPResponse(t, host, port, &secondResponse)
 
@@ -134,40 +135,24 @@ func TestIntegration(t *testing.T) {
 func assertHTTPResponse(t *testing.T, host string, port int, expected expectation) {
 	t.Helper()
 
-	http5XXCount := 0
 	for {
 		// try to make an HTTP request
 		t.Logf("making HTTP request")
 		resp, err := http.Get(fmt.Sprintf("http://%s:%d/hello", host, port))
 		if err != nil {
-			if _, ok := err.(net.Error); ok {
-				if strings.Contains(err.Error(), "connection refused") {
-					t.Logf("server not up yet")
-					time.Sleep(time.Second)
-					continue
-				}
-			} else {
-				t.Fatalf("error making HTTP request: %v", err)
+			if _, ok := err.(net.Error); ok && strings.Contains(err.Error(), "connection refused") {
+				t.Logf("server not up yet")
+				time.Sleep(time.Second)
+				continue
 			}
+			t.Fatalf("error making HTTP request: %v", err)
 		}
 		t.Logf("request completed")
 		defer resp.Body.Close()
 
 		// assert on the response
 		if resp.StatusCode != http.StatusOK {
-			if resp.StatusCode == 500 {
-				t.Logf("got 5XX, current count: %d", http5XXCount)
-				http5XXCount++
-
-				if http5XXCount >= 5 {
-					t.Fatalf("too many 5XX failures")
-				}
-
-				time.Sleep(time.Second)
-				continue
-			} else {
-				t.Fatalf("bad status code %d", resp.StatusCode)
-			}
+			t.Fatalf("bad status code %d", resp.StatusCode)
 		}
 
 		b, err := ioutil.ReadAll(resp.Body)
@@ -180,3 +165,62 @@ func assertHTTPResponse(t *testing.T, host string, port int, expected expectatio
 		return
 	}
 }
+
+// assertNoFailures keeps making requests for the duration, failing the test
+// if any of them does not succeed
+func assertNoFailures(t *testing.T, host string, port int, duration time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(fmt.Sprintf("http://%s:%d/hello", host, port))
+		if err != nil {
+			t.Fatalf("error making HTTP request during reload: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("bad status code %d during reload", resp.StatusCode)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDefaultCommand(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-r", "build", "template.yaml"}, []string{"run", "-r", "build", "template.yaml"}},
+		{[]string{"-vr", "invoke", "template.yaml"}, []string{"run", "-vr", "invoke", "template.yaml"}},
+		{[]string{"-rbuild", "template.yaml"}, []string{"run", "-rbuild", "template.yaml"}},
+		{[]string{"--log-format", "json", "invoke", "Function"}, []string{"--log-format", "json", "invoke", "Function"}},
+		{[]string{"-v", "run", "template.yaml"}, []string{"-v", "run", "template.yaml"}},
+		{[]string{"cleanup"}, []string{"cleanup"}},
+		{[]string{"--help"}, []string{"--help"}},
+		{[]string{}, []string{"run"}},
+	} {
+		var opts Options
+		got := defaultCommand(flags.NewParser(&opts, flags.None), tc.args)
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Fatalf("%v: got %v, expected %v", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"run", "template.yaml"}, "run"},
+		{[]string{"--log-format", "json", "invoke", "Function"}, "invoke"},
+		{[]string{"generate-event", "sqs"}, "generate-event"},
+		{[]string{"--help"}, ""},
+		{[]string{"template.yaml"}, ""},
+	} {
+		var opts Options
+		if got := commandName(flags.NewParser(&opts, flags.None), tc.args); got != tc.want {
+			t.Fatalf("%v: got %q, expected %q", tc.args, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultWatchExclude are the patterns of files that never cause a restart:
+// editor swap and backup files, compiled python and version control
+// metadata
+var defaultWatchExclude = []string{
+	".git",
+	"__pycache__",
+	"*.pyc",
+	".*.swp",
+	".*.swx",
+	"*~",
+	".#*",
+	"#*#",
+	"4913",
+	".DS_Store",
+}
+
+// watchConfig configures which changes restart functions
+type watchConfig struct {
+	// Include limits restarts to files matching one of the patterns. Every
+	// file is included if empty.
+	Include []string
+	// Exclude lists patterns of files and directories that are not watched,
+	// in addition to the defaults
+	Exclude []string
+	// Debounce is how long the code must be left unchanged before the
+	// affected functions are restarted
+	Debounce time.Duration
+	// ExcludeDirs are directories that are never watched, e.g. the build
+	// directory inside a watched source directory. They may be relative to
+	// the working directory.
+	ExcludeDirs []string
+}
+
+// codeWatcher recursively watches the code directories of the running
+// functions and maps file system events back to the functions they affect. A
+// directory may be shared by several functions, e.g. a layer. Bursts of
+// changes are coalesced into a single notification.
+type codeWatcher struct {
+	watcher *fsnotify.Watcher
+	cfg     watchConfig
+
+	mu sync.Mutex
+	// owners maps each watched root directory to the logical IDs of the
+	// functions using it
+	owners map[string][]string
+
+	// Changes receives the logical IDs of the functions whose code changed,
+	// once the changes have settled
+	Changes chan []string
+	// done is closed by Close, so that changes nobody receives any more are
+	// dropped
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newCodeWatcher(cfg watchConfig) (*codeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Exclude = append(append([]string{}, defaultWatchExclude...), cfg.Exclude...)
+	// roots and events are compared as absolute paths, as code directories
+	// may be relative to the working directory
+	excludeDirs := make([]string, 0, len(cfg.ExcludeDirs))
+	for _, dir := range cfg.ExcludeDirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("finding excluded directory %s: %w", dir, err)
+		}
+		excludeDirs = append(excludeDirs, abs)
+	}
+	cfg.ExcludeDirs = excludeDirs
+
+	w := &codeWatcher{
+		watcher: watcher,
+		cfg:     cfg,
+		owners:  make(map[string][]string),
+		Changes: make(chan []string),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Errors reports errors from the underlying file system watcher
+func (w *codeWatcher) Errors() <-chan error {
+	return w.watcher.Errors
+}
+
+// Close stops watching for changes
+func (w *codeWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return w.watcher.Close()
+}
+
+// Add recursively watches the directory for changes to the code of the
+// function
+func (w *codeWatcher) Add(dir string, logicalID string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("finding directory: %w", err)
+	}
+
+	w.mu.Lock()
+	_, watched := w.owners[dir]
+	w.owners[dir] = append(w.owners[dir], logicalID)
+	w.mu.Unlock()
+
+	if watched {
+		return nil
+	}
+	return w.addRecursive(dir, dir)
+}
+
+// addRecursive watches dir and every directory below it that is not
+// excluded
+func (w *codeWatcher) addRecursive(root, dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if name == dir {
+				return err
+			}
+			log.Warn().Err(err).Str("path", name).Msg("could not watch directory")
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if name != root && w.excluded(root, name) {
+			return filepath.SkipDir
+		}
+
+		log.Debug().Str("path", name).Msg("adding path to watch list")
+		return w.watcher.Add(name)
+	})
+}
+
+// run collects file system events until the watcher is closed, publishing
+// the affected functions once no changes have been seen for the debounce
+// window
+func (w *codeWatcher) run() {
+	pending := make(map[string]bool)
+	var settled <-chan time.Time
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			log.Debug().Interface("event", event).Msg("got event")
+
+			logicalIDs := w.handle(event)
+			if len(logicalIDs) == 0 {
+				continue
+			}
+			for _, logicalID := range logicalIDs {
+				pending[logicalID] = true
+			}
+			settled = time.After(w.cfg.Debounce)
+
+		case <-settled:
+			changed := make([]string, 0, len(pending))
+			for logicalID := range pending {
+				changed = append(changed, logicalID)
+			}
+			sort.Strings(changed)
+			pending = make(map[string]bool)
+			settled = nil
+
+			select {
+			case w.Changes <- changed:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// handle returns the functions affected by a single file system event,
+// watching any directory created inside a watched directory
+func (w *codeWatcher) handle(event fsnotify.Event) []string {
+	if event.Op == fsnotify.Chmod {
+		return nil
+	}
+
+	name, err := filepath.Abs(event.Name)
+	if err != nil {
+		return nil
+	}
+	root, ok := w.rootFor(name)
+	if !ok || w.excluded(root, name) {
+		return nil
+	}
+
+	isDir := false
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			isDir = true
+			if err := w.addRecursive(root, name); err != nil {
+				log.Warn().Err(err).Str("path", name).Msg("could not watch directory")
+			}
+		}
+	}
+
+	if !isDir && !w.included(root, name) {
+		return nil
+	}
+
+	log.Debug().Str("path", name).Msg("modified file")
+	return w.Owners(name)
+}
+
+// rootFor finds the watched root directory containing the path. When roots
+// are nested, e.g. a function's code inside another's, the innermost one is
+// used.
+func (w *codeWatcher) rootFor(name string) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	root := ""
+	for dir := range w.owners {
+		if isWithin(dir, name) && len(dir) > len(root) {
+			root = dir
+		}
+	}
+	return root, root != ""
+}
+
+// excluded checks whether the path, or any directory between it and the
+// root, matches an exclude pattern
+func (w *codeWatcher) excluded(root, name string) bool {
+	for _, dir := range w.cfg.ExcludeDirs {
+		// the directory is only excluded from roots that contain it
+		if isWithin(dir, name) && !isWithin(dir, root) {
+			return true
+		}
+	}
+
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	if matchesAny(w.cfg.Exclude, rel) {
+		return true
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if matchesAny(w.cfg.Exclude, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// included checks whether a file matches the include patterns, either by
+// its name or its path relative to the root
+func (w *codeWatcher) included(root, name string) bool {
+	if len(w.cfg.Include) == 0 {
+		return true
+	}
+
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return matchesAny(w.cfg.Include, rel) || matchesAny(w.cfg.Include, filepath.Base(name))
+}
+
+// Owners returns the logical IDs of the functions affected by a change to the
+// given path, sorted and without duplicates
+func (w *codeWatcher) Owners(name string) []string {
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := make(map[string]bool)
+	out := []string{}
+	for dir, logicalIDs := range w.owners {
+		if !isWithin(dir, name) {
+			continue
+		}
+
+		for _, logicalID := range logicalIDs {
+			if !seen[logicalID] {
+				seen[logicalID] = true
+				out = append(out, logicalID)
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// isWithin checks whether name is dir or is inside it
+func isWithin(dir, name string) bool {
+	return name == dir || strings.HasPrefix(name, dir+string(filepath.Separator))
+}
+
+// matchesAny checks whether the name matches one of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// codePaths returns the directories containing the code of the function: its
+// own directory followed by the directories of its layers
+func codePaths(rootDir string, definition HandlerDefinition) (string, []string) {
+	layers := make([]string, 0, len(definition.Layers))
+	for _, layer := range definition.Layers {
+		layers = append(layers, path.Join(rootDir, layer))
+	}
+	return path.Join(rootDir, definition.LogicalID), layers
+}
+
+// functionPaths returns the directories containing the code of the function
+// and its layers: from the root directory, or from their source if fromSource
+// is set
+func functionPaths(rootDir, template string, fromSource bool, definition HandlerDefinition) (string, []string, error) {
+	if fromSource {
+		return sourcePaths(template, definition)
+	}
+	sourcePath, layerPaths := codePaths(rootDir, definition)
+	return sourcePath, layerPaths, nil
+}
+
+// sourcePaths returns the directories containing the source of the function
+// and its layers, from their CodeUri and ContentUri relative to the template,
+// for running them without a build
+func sourcePaths(template string, definition HandlerDefinition) (string, []string, error) {
+	dir := filepath.Dir(template)
+	if definition.CodeURI == "" {
+		return "", nil, fmt.Errorf("function %s has no local CodeUri", definition.LogicalID)
+	}
+	sourcePath := filepath.Join(dir, definition.CodeURI)
+	if _, err := os.Stat(sourcePath); err != nil {
+		return "", nil, fmt.Errorf("finding the source of function %s: %w", definition.LogicalID, err)
+	}
+
+	layers := make([]string, 0, len(definition.LayerURIs))
+	for i, uri := range definition.LayerURIs {
+		if uri == "" {
+			return "", nil, fmt.Errorf("layer %s has no local ContentUri", definition.Layers[i])
+		}
+		layerPath := filepath.Join(dir, uri)
+		if _, err := os.Stat(layerPath); err != nil {
+			return "", nil, fmt.Errorf("finding the source of layer %s: %w", definition.Layers[i], err)
+		}
+		layers = append(layers, layerPath)
+	}
+	return sourcePath, layers, nil
+}
+
+// Remove stops restarting the function when its code changes, and stops
+// watching directories that no other function uses
+func (w *codeWatcher) Remove(logicalID string) {
+	var unused []string
+
+	w.mu.Lock()
+	for dir, logicalIDs := range w.owners {
+		kept := []string{}
+		for _, owner := range logicalIDs {
+			if owner != logicalID {
+				kept = append(kept, owner)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(w.owners, dir)
+			unused = append(unused, dir)
+		} else {
+			w.owners[dir] = kept
+		}
+	}
+	w.mu.Unlock()
+
+	for _, dir := range unused {
+		filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				// directories that were excluded are not watched
+				w.watcher.Remove(name)
+			}
+			return nil
+		})
+	}
+}
+
+// fileWatcher notifies when a single file changes. Its directory is watched
+// rather than the file itself, as editors often save by replacing the file.
+type fileWatcher struct {
+	watcher  *fsnotify.Watcher
+	name     string
+	debounce time.Duration
+
+	// Changes receives once the file has been left unchanged for the
+	// debounce window
+	Changes chan struct{}
+	// done is closed by Close, so that changes nobody receives any more are
+	// dropped
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFileWatcher(filename string, debounce time.Duration) (*fileWatcher, error) {
+	name, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(name)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	w := &fileWatcher{
+		watcher:  watcher,
+		name:     name,
+		debounce: debounce,
+		Changes:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Errors reports errors from the underlying file system watcher
+func (w *fileWatcher) Errors() <-chan error {
+	return w.watcher.Errors
+}
+
+// Close stops watching the file
+func (w *fileWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return w.watcher.Close()
+}
+
+// affected checks whether the event is a change to the watched file
+func (w *fileWatcher) affected(event fsnotify.Event) bool {
+	return event.Op != fsnotify.Chmod && filepath.Clean(event.Name) == w.name
+}
+
+func (w *fileWatcher) run() {
+	var settled <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.affected(event) {
+				continue
+			}
+			log.Debug().Str("path", event.Name).Msg("modified file")
+			settled = time.After(w.debounce)
+
+		case <-settled:
+			settled = nil
+			select {
+			case w.Changes <- struct{}{}:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
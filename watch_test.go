@@ -0,0 +1,355 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestCodeWatcherOwners(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"HelloFunction", "OtherFunction", "SharedLayer"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+	}
+
+	watcher, err := newCodeWatcher(watchConfig{})
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	for _, w := range []struct{ dir, logicalID string }{
+		{"HelloFunction", "HelloFunction"},
+		{"SharedLayer", "HelloFunction"},
+		{"OtherFunction", "OtherFunction"},
+		{"SharedLayer", "OtherFunction"},
+	} {
+		if err := watcher.Add(filepath.Join(root, w.dir), w.logicalID); err != nil {
+			t.Fatalf("watching %s: %v", w.dir, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"HelloFunction/app.py", []string{"HelloFunction"}},
+		{"OtherFunction/app.py", []string{"OtherFunction"}},
+		{"SharedLayer/python/lib.py", []string{"HelloFunction", "OtherFunction"}},
+		{"HelloFunctionOld/app.py", []string{}},
+	}
+	for _, test := range tests {
+		owners := watcher.Owners(filepath.Join(root, test.name))
+		if !reflect.DeepEqual(owners, test.expected) {
+			t.Fatalf("invalid owners of %s, expected %v found %v", test.name, test.expected, owners)
+		}
+	}
+}
+
+func TestCodeWatcherRootFor(t *testing.T) {
+	watcher := &codeWatcher{owners: map[string][]string{
+		"/project":          {"ProjectFunction"},
+		"/project/src/api":  {"ApiFunction"},
+		"/project/src":      {"SrcFunction"},
+		"/project/src/apis": {"ApisFunction"},
+	}}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"/project/template.yaml", "/project"},
+		{"/project/src/app.py", "/project/src"},
+		{"/project/src/api/app.py", "/project/src/api"},
+		{"/project/src/apis/app.py", "/project/src/apis"},
+	}
+	// the map order changes between runs, so each path is checked a few
+	// times
+	for i := 0; i < 10; i++ {
+		for _, test := range tests {
+			if root, _ := watcher.rootFor(test.name); root != test.expected {
+				t.Fatalf("invalid root of %s, expected %s found %s", test.name, test.expected, root)
+			}
+		}
+	}
+	if _, ok := watcher.rootFor("/other/app.py"); ok {
+		t.Fatalf("path outside every root should not have one")
+	}
+}
+
+func TestCodePaths(t *testing.T) {
+	sourcePath, layerPaths := codePaths("build", HandlerDefinition{
+		LogicalID: "HelloFunction",
+		Layers:    []string{"SharedLayer"},
+	})
+
+	if sourcePath != "build/HelloFunction" {
+		t.Fatalf("invalid source path %s", sourcePath)
+	}
+	if !reflect.DeepEqual(layerPaths, []string{"build/SharedLayer"}) {
+		t.Fatalf("invalid layer paths %v", layerPaths)
+	}
+}
+
+func TestSourcePaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"hello_world", "shared"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+	}
+	definition := HandlerDefinition{
+		LogicalID: "HelloFunction",
+		CodeURI:   "hello_world/",
+		Layers:    []string{"SharedLayer"},
+		LayerURIs: []string{"shared/"},
+	}
+
+	sourcePath, layerPaths, err := sourcePaths(filepath.Join(dir, "template.yaml"), definition)
+	if err != nil {
+		t.Fatalf("finding source: %v", err)
+	}
+	if sourcePath != filepath.Join(dir, "hello_world") {
+		t.Fatalf("invalid source path %s", sourcePath)
+	}
+	if !reflect.DeepEqual(layerPaths, []string{filepath.Join(dir, "shared")}) {
+		t.Fatalf("invalid layer paths %v", layerPaths)
+	}
+
+	definition.LayerURIs = []string{""}
+	if _, _, err := sourcePaths(filepath.Join(dir, "template.yaml"), definition); err == nil {
+		t.Fatalf("expected an error for a layer without local content")
+	}
+	definition.CodeURI = "missing/"
+	if _, _, err := sourcePaths(filepath.Join(dir, "template.yaml"), definition); err == nil {
+		t.Fatalf("expected an error for a missing source directory")
+	}
+}
+
+func TestCodeWatcherExcluded(t *testing.T) {
+	watcher := &codeWatcher{cfg: watchConfig{Exclude: []string{".*.swp", "*~", "__pycache__", "*.md"}}}
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"app.py", false},
+		{"pkg/module.py", false},
+		{".app.py.swp", true},
+		{"app.py~", true},
+		{"__pycache__/app.cpython-39.pyc", true},
+		{"pkg/__pycache__/module.cpython-39.pyc", true},
+		{"README.md", true},
+	}
+	for _, test := range tests {
+		if got := watcher.excluded("/code", filepath.Join("/code", test.name)); got != test.expected {
+			t.Fatalf("%s: expected excluded=%v", test.name, test.expected)
+		}
+	}
+}
+
+func TestCodeWatcherExcludeDirs(t *testing.T) {
+	watcher := &codeWatcher{cfg: watchConfig{ExcludeDirs: []string{"/project/.aws-sam/build"}}}
+
+	// the build directory inside a source directory is not watched
+	if !watcher.excluded("/project", "/project/.aws-sam/build/HelloFunction/app.py") {
+		t.Fatalf("build directory not excluded from the source directory")
+	}
+	if watcher.excluded("/project", "/project/app.py") {
+		t.Fatalf("source file excluded")
+	}
+	// but it can still be watched itself
+	if watcher.excluded("/project/.aws-sam/build/HelloFunction", "/project/.aws-sam/build/HelloFunction/app.py") {
+		t.Fatalf("file excluded from its own build directory")
+	}
+}
+
+func TestCodeWatcherRelativeCodeURI(t *testing.T) {
+	project := t.TempDir()
+	build := filepath.Join(project, ".aws-sam", "build")
+	if err := os.MkdirAll(filepath.Join(build, "HelloFunction"), 0755); err != nil {
+		t.Fatalf("creating directory: %v", err)
+	}
+
+	// the CodeUri of the function is the project directory, relative to
+	// the working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("finding working directory: %v", err)
+	}
+	source, err := filepath.Rel(cwd, project)
+	if err != nil {
+		t.Fatalf("finding relative path: %v", err)
+	}
+
+	watcher, err := newCodeWatcher(watchConfig{ExcludeDirs: []string{build}})
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(source, "HelloFunction"); err != nil {
+		t.Fatalf("watching source: %v", err)
+	}
+
+	built := fsnotify.Event{Name: filepath.Join(source, ".aws-sam", "build", "HelloFunction", "app.py"), Op: fsnotify.Write}
+	if owners := watcher.handle(built); len(owners) != 0 {
+		t.Fatalf("changes to the build directory should be ignored, found %v", owners)
+	}
+	changed := fsnotify.Event{Name: filepath.Join(source, "app.py"), Op: fsnotify.Write}
+	if owners := watcher.handle(changed); !reflect.DeepEqual(owners, []string{"HelloFunction"}) {
+		t.Fatalf("changes to the source should restart the function, found %v", owners)
+	}
+}
+
+func TestCodeWatcherIncluded(t *testing.T) {
+	watcher := &codeWatcher{cfg: watchConfig{Include: []string{"*.py", "templates/*"}}}
+
+	if !watcher.included("/code", "/code/pkg/module.py") {
+		t.Fatalf("file matching by name should be included")
+	}
+	if !watcher.included("/code", "/code/templates/index.html") {
+		t.Fatalf("file matching by relative path should be included")
+	}
+	if watcher.included("/code", "/code/data.json") {
+		t.Fatalf("file not matching should not be included")
+	}
+}
+
+func TestCodeWatcherRecursiveDebounced(t *testing.T) {
+	root := t.TempDir()
+	code := filepath.Join(root, "HelloFunction")
+	if err := os.MkdirAll(filepath.Join(code, "pkg"), 0755); err != nil {
+		t.Fatalf("creating directory: %v", err)
+	}
+	// changes to the sentinel function mark that every earlier event has
+	// been handled, as the events are handled in order
+	sentinel := filepath.Join(root, "Sentinel")
+	if err := os.Mkdir(sentinel, 0755); err != nil {
+		t.Fatalf("creating directory: %v", err)
+	}
+
+	watcher, err := newCodeWatcher(watchConfig{Debounce: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(code, "HelloFunction"); err != nil {
+		t.Fatalf("watching code: %v", err)
+	}
+	if err := watcher.Add(sentinel, "Sentinel"); err != nil {
+		t.Fatalf("watching sentinel: %v", err)
+	}
+
+	// ignored files do not cause a restart
+	write(t, filepath.Join(code, ".app.py.swp"))
+	write(t, filepath.Join(sentinel, "x"))
+	expectChange(t, watcher, []string{"Sentinel"})
+
+	// a burst of changes in subdirectories causes a single restart
+	write(t, filepath.Join(code, "pkg", "a.py"))
+	write(t, filepath.Join(code, "pkg", "b.py"))
+	expectChange(t, watcher, []string{"HelloFunction"})
+	write(t, filepath.Join(sentinel, "x"))
+	expectChange(t, watcher, []string{"Sentinel"})
+
+	// new directories are watched too
+	if err := os.Mkdir(filepath.Join(code, "newpkg"), 0755); err != nil {
+		t.Fatalf("creating directory: %v", err)
+	}
+	expectChange(t, watcher, []string{"HelloFunction"})
+	write(t, filepath.Join(code, "newpkg", "c.py"))
+	expectChange(t, watcher, []string{"HelloFunction"})
+}
+
+func write(t *testing.T, name string) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, []byte("x"), 0644); err != nil {
+		t.Fatalf("writing %s: %v", name, err)
+	}
+}
+
+func expectChange(t *testing.T, watcher *codeWatcher, expected []string) {
+	t.Helper()
+	select {
+	case changed := <-watcher.Changes:
+		if !reflect.DeepEqual(changed, expected) {
+			t.Fatalf("invalid change, expected %v found %v", expected, changed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for change")
+	}
+}
+
+func TestCodeWatcherRemove(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"HelloFunction", "SharedLayer"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+	}
+
+	watcher, err := newCodeWatcher(watchConfig{})
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	for _, w := range []struct{ dir, logicalID string }{
+		{"HelloFunction", "HelloFunction"},
+		{"SharedLayer", "HelloFunction"},
+		{"SharedLayer", "OtherFunction"},
+	} {
+		if err := watcher.Add(filepath.Join(root, w.dir), w.logicalID); err != nil {
+			t.Fatalf("watching %s: %v", w.dir, err)
+		}
+	}
+
+	watcher.Remove("HelloFunction")
+
+	if owners := watcher.Owners(filepath.Join(root, "HelloFunction", "app.py")); len(owners) != 0 {
+		t.Fatalf("removed function still owns its code: %v", owners)
+	}
+	if owners := watcher.Owners(filepath.Join(root, "SharedLayer", "lib.py")); !reflect.DeepEqual(owners, []string{"OtherFunction"}) {
+		t.Fatalf("invalid owners of the shared layer: %v", owners)
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.yaml")
+	write(t, template)
+
+	watcher, err := newFileWatcher(template, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("creating watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	// other files in the directory are ignored
+	if watcher.affected(fsnotify.Event{Name: filepath.Join(dir, "README.md"), Op: fsnotify.Write}) {
+		t.Fatalf("change to another file should be ignored")
+	}
+	if watcher.affected(fsnotify.Event{Name: template, Op: fsnotify.Chmod}) {
+		t.Fatalf("permission changes should be ignored")
+	}
+
+	// replacing the file, as editors do, is noticed
+	replacement := filepath.Join(dir, "template.yaml.tmp")
+	write(t, replacement)
+	if err := os.Rename(replacement, template); err != nil {
+		t.Fatalf("replacing template: %v", err)
+	}
+	select {
+	case <-watcher.Changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("change to the template not noticed")
+	}
+}